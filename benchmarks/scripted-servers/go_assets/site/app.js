@@ -0,0 +1,9 @@
+fetch('/status')
+  .then((resp) => resp.json())
+  .then((status) => {
+    document.getElementById('status').textContent =
+      `server=${status.server} threads=${status.threads} h2=${status.h2} tls=${status.tls}`;
+  })
+  .catch((err) => {
+    document.getElementById('status').textContent = `status unavailable: ${err}`;
+  });
@@ -7,388 +7,7571 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/textproto"
+	"net/url"
 	"os"
-	"path/filepath"
-	"regexp"
+	"os/signal"
+	"path"
 	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/language"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 const charset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 
+// Build metadata, populated with
+// -ldflags "-X main.buildVersion=... -X main.buildCommit=... -X main.buildTime=...".
+var (
+	buildVersion = "unknown"
+	buildCommit  = "unknown"
+	buildTime    = "unknown"
+)
+
+// faviconPNG is a 1x1 transparent PNG served at /favicon.ico.
+//
+//go:embed go_assets/favicon.png
+var faviconPNG []byte
+
+// embeddedSite is the demo site served by --embedded-static.
+//
+//go:embed go_assets/site
+var embeddedSite embed.FS
+
 var numThreads int
-var staticDir string
 var routeCount int
+var patternRouteCount int
+
+// Static files: --static, --embedded-static, --preload-static, --mime-types.
+var staticDir string
+var embeddedStatic bool
+
+// staticFS is the file system behind handleStatic: --static DIR when given,
+// else the embedded demo site with --embedded-static, else nil (disabled).
+var staticFS fs.FS
+
+// staticCache holds the files read by --preload-static, keyed by staticFS
+// name. It is filled while the server is not ready yet and only read once it
+// is, withReadiness keeping requests away from handleStatic until then.
+var staticCache map[string]*cachedFile
+
+// notReady holds why the server is still starting up, nil once it is ready.
+var notReady atomic.Pointer[string]
+
+// cachedFile is one preloaded static file.
+type cachedFile struct {
+	data []byte
+	info fs.FileInfo
+	etag string
+}
+
+// mimeOverrides maps lower-case extensions to Content-Types from --mime-types.
+var mimeOverrides map[string]string
+
+// HTTP/2: --h2 and its settings.
 var h2Enabled bool
+var h2MaxStreams int
+var h2MaxReadFrameSize int
+var h2IdleTimeout time.Duration
+var h2PriorityFrames bool
+
+// TLS: --tls and its settings.
 var tlsEnabled bool
 var certFile string
 var keyFile string
+var tlsSessionTickets bool
+var tlsCurvePreferences []tls.CurveID
+var tlsCipherSuites []uint16
+var tlsOCSPStapleFile string
+var tlsHandshakeDelay time.Duration
+
+// Listener: address, socket options and accept loops.
+//
+// ipVersion is the --ip-version of the main listener: "4" (the default), "6"
+// or "dual"; listenHost the address it binds, from --listen-addr or the
+// version's default.
+var ipVersion string
+var listenHost string
+var listenBacklog int
+var tcpFastOpenQueue int
+var acceptLoops int
+var acceptRamp time.Duration
+var acceptRampRate float64
+var proxyProtocol bool
+
+// With --metrics, acceptCounts holds the connections accepted by each accept
+// loop, acceptBusyNs the time the loops spent between an Accept returning and
+// the next call, and acceptWait the recent time blocked in Accept.
+var acceptCounts []atomic.Int64
+var acceptBusyNs atomic.Int64
+var acceptWait latencyWindow
+
+// Connections and request reading: timeouts, header limits, keep-alive.
+var readHeaderTimeout time.Duration
+
+// writeTimeout is the main server's WriteTimeout.
+var writeTimeout = 30 * time.Second
+var maxHeaderBytes int
+var maxHeaderValueSize int
+var timeout408 bool
+var bodyReadTimeout time.Duration
+var maxRequestsPerConn int
+var handshakeTiming bool
+var byteAccounting bool
+var teGzip bool
+var methodOverride bool
+var queryParseOnce bool
+
+// Response writing: framing, buffering and flushing.
+var chunkedThreshold int
+var chunkWriteDeadline time.Duration
+var flushAfterWrite bool
+var responseBufferSize int
+
+// Worker pool: --worker-pool and --worker-queue.
+var workerPoolSize int
+var workerQueueSize int
+
+// Per-route limits and settings.
+var maxIDCount int
+var maxUploadSize int64
+var maxDecompressedSize int64
+var maxDecompressRatio int
+var maxMandelbrotSize int
+var maxMandelbrotIter int
+var maxBatchSize int
+var batchTimeout time.Duration
+var latencyBudget time.Duration
+var wsPingInterval time.Duration
+var wsMaxFrame int
+var hashAlgo string
+
+// bodySchema is the compiled --schema-file; /validate-schema exists only when set.
+var bodySchema *jsonschema.Schema
+
+// defaultHandler answers paths no route matches (--default-handler).
+var defaultHandler http.HandlerFunc = http.NotFound
+
+// Upstream calls: /fanout and the upstream health check.
+var maxFanout int
+var fanoutTimeout time.Duration
+var upstreamDialDelay time.Duration
+
+// /health/deep checks.
+var healthUpstream string
+var healthMaxHeap int
+var healthTimeout time.Duration
+var healthCacheTTL time.Duration
+
+// Memory: --soft-mem-limit and load shedding.
+var softMemLimit int
+
+// memHighWatermark enables load shedding under memory pressure
+// (--mem-high-watermark); memDegraded is set by monitorMemory while shedding
+// and degradedRejected counts the requests refused meanwhile.
+var memHighWatermark int
+var memDegraded atomic.Bool
+var degradedRejected atomic.Int64
+
+// Fault injection: --chaos and --inject-write-errors.
+var chaosEnabled bool
+var writeErrorRate float64
+
+// writeErrorsInjected counts the responses --inject-write-errors cut short.
+var writeErrorsInjected atomic.Int64
+
+// Response cache: --response-cache and its settings.
+var responseCacheEnabled bool
+var responseCacheTTL time.Duration
+var responseCacheMaxEntry int
+var responseCacheEntries int
+
+// responseCache serves --response-cache hits; nil when disabled.
+var responseCache *lruCache
+
+// cacheableRoutes lists the deterministic GET routes --response-cache may
+// serve from memory. Routes whose output must change per request (/sequence,
+// /flaky, /delay, /metrics, ...) and long streams are deliberately absent.
+var cacheableRoutes = map[string]bool{
+	"/json":     true,
+	"/protobuf": true,
+	"/compute":  true,
+	"/status":   true,
+	"/version":  true,
+	"/params":   true,
+	"/csv":      true,
+}
+
+// Observability: metrics, tracing and the self-test.
+var metricsEnabled bool
+var selfTestEnabled bool
+var otelEnabled bool
+var otelEndpoint string
+
+var configFile string
+var adminPort int
+var seed int64
+
+// seededRand makes generated payloads reproducible across runs when --seed is
+// given; otherwise the global math/rand source is used.
+var seededRand *lockedRand
+
+// requestCounters counts requests per route label when --metrics is set.
+var requestCounters pathCounters
+
+// responseCounters counts responses per route label and status class when
+// --metrics is set, keyed "route class" (e.g. "/users/{id} 4xx").
+var responseCounters pathCounters
+
+// panicCount counts handler panics converted to 500 by withRecovery.
+var panicCount atomic.Int64
+
+// panicStackOnce limits stack dumps to the first recovered panic.
+var panicStackOnce sync.Once
+
+// requestIDCounter generates X-Request-ID values for requests without one.
+var requestIDCounter atomic.Uint64
+
+// sequenceCounter backs /sequence; it is reset from the admin port.
+var sequenceCounter atomic.Uint64
+
+// /flaky window state: the last window served (1 = up) and responses per window.
+var flakyUp atomic.Int64
+var flakyUpResponses atomic.Int64
+var flakyDownResponses atomic.Int64
+
+// With --coalesce, concurrent identical /compute requests share one
+// computation; computeCoalesced counts the requests that did not run their own.
+var coalesceCompute bool
+var computeGroup singleflight.Group
+var computeCoalesced atomic.Int64
+
+// hashBytes counts bytes hashed by /hash as they stream in, so a scrape shows
+// the progress of uploads still in flight.
+var hashBytes atomic.Int64
+
+// recorder appends requests to the --record file; nil when not recording.
+// recordDropped counts the records it had no room for.
+var recorder *requestRecorder
+var recordDropped atomic.Int64
+
+// currentConfig holds the hot-reloadable settings loaded from --config.
+// Handlers read it atomically so SIGHUP can swap it under live traffic.
+var currentConfig atomic.Pointer[liveConfig]
+
+// logLevel filters the default slog logger. --log-level sets flagLogLevel;
+// a non-empty log_level in --config overrides it on every (re)load.
+var (
+	logLevel     slog.LevelVar
+	flagLogLevel slog.Level
+)
+
+// queryKey is the context key under which withQueryCache stores url.Values.
+type queryKey struct{}
+
+// connInfoKey is the context key under which ConnContext stores *connInfo.
+type connInfoKey struct{}
+
+// connInfo carries per-connection state shared by all requests on a connection.
+type connInfo struct {
+	accepted time.Time
+	requests atomic.Int64
+	local    net.Addr
+	reader   *firstByteConn  // cleartext with --handshake-timing only
+	priority *h2PriorityTap  // cleartext --h2 with --h2-priority-frames only
+	proxy    *proxyProtoConn // with --proxy-protocol only
+}
+
+// connContext is the server's ConnContext: it stores a fresh connInfo for c.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, &connInfo{
+		accepted: time.Now(),
+		local:    c.LocalAddr(),
+		reader:   findConn[*firstByteConn](c),
+		priority: findConn[*h2PriorityTap](c),
+		proxy:    findConn[*proxyProtoConn](c),
+	})
+}
+
+// Pattern route matchers
+var userPostPattern = compileSegmentPattern("/users/:id/posts/:post")
+var apiPattern = compileSegmentPattern("/api/v1/resources/:resource/items/:item/actions/:action")
+
+// segmentPattern matches a path against a /fixed/:param template one segment
+// at a time, without regexp. Parameters match any non-empty segment, so
+// "/users/:id/posts/:post" accepts exactly what ^/users/([^/]+)/posts/([^/]+)$
+// accepts.
+type segmentPattern struct {
+	template string
+	segments []string
+	isParam  []bool
+}
+
+func compileSegmentPattern(template string) segmentPattern {
+	p := segmentPattern{template: template}
+	for _, seg := range strings.Split(strings.TrimPrefix(template, "/"), "/") {
+		p.isParam = append(p.isParam, strings.HasPrefix(seg, ":"))
+		p.segments = append(p.segments, seg)
+	}
+	return p
+}
+
+// match reports whether path matches p and appends the captured parameters to
+// params. Callers can pass a stack-allocated buffer to keep matching allocation-free.
+func (p *segmentPattern) match(path string, params []string) ([]string, bool) {
+	if len(path) == 0 || path[0] != '/' {
+		return params, false
+	}
+	rest := path[1:]
+	last := len(p.segments) - 1
+	for i, seg := range p.segments {
+		part := rest
+		if idx := strings.IndexByte(rest, '/'); idx >= 0 {
+			if i == last {
+				return params, false
+			}
+			part, rest = rest[:idx], rest[idx+1:]
+		} else if i != last {
+			return params, false
+		}
+		if p.isParam[i] {
+			if part == "" {
+				return params, false
+			}
+			params = append(params, part)
+		} else if part != seg {
+			return params, false
+		}
+	}
+	return params, true
+}
+
+// newTopHandler dispatches requests through rt and, with --metrics, counts
+// them per route and per route and status class. Error responses are logged
+// by statusWriter.logError. Upgrade requests are resolved by upgradeRoute
+// before the path is looked at.
+func newTopHandler(rt *router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, h, ok := upgradeRoute(r)
+		if !ok {
+			route, h = rt.lookup(r.URL.Path)
+		}
+		if otelEnabled {
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		// Browser favicon probes are not benchmark traffic.
+		if metricsEnabled && route != "/favicon.ico" {
+			requestCounters.inc(route)
+			defer func() {
+				if class := sw.class(); class != "" {
+					responseCounters.inc(route + " " + class)
+				}
+			}()
+		}
+		h(sw, r)
+		sw.returned = true
+		sw.logError(r, route)
+	})
+}
+
+// maxLoggedError bounds the http.Error message kept for the error log.
+const maxLoggedError = 256
+
+// statusWriter notes the status a handler responds with, for the per-class
+// response counters and the handler error log.
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	errMsg   string // start of the http.Error message of an error response
+	hijacked bool
+	returned bool // the handler returned rather than panicked
+}
+
+// logError logs an http.Error response once the handler has returned: 5xx
+// at error level, 4xx at debug level so miss-heavy load does not flood the
+// log. Scripted statuses written without http.Error are not handler errors,
+// and panics are logged by withRecovery.
+func (sw *statusWriter) logError(r *http.Request, route string) {
+	if sw.errMsg == "" || sw.hijacked {
+		return
+	}
+	level := slog.LevelDebug
+	if sw.status >= 500 {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, "handler error", "method", r.Method, "route", route,
+		"path", r.URL.Path, "status", sw.status, "error", sw.errMsg)
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 && code >= 200 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	// http.Error is the one writer of error bodies setting nosniff.
+	if sw.status >= 400 && sw.errMsg == "" && sw.Header().Get("X-Content-Type-Options") == "nosniff" {
+		sw.errMsg = strings.TrimSpace(string(p[:min(len(p), maxLoggedError)]))
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	_ = http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// ReadFrom keeps the underlying writer's io.ReaderFrom reachable, so
+// http.ServeContent still sends files with sendfile while metrics are on.
+func (sw *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if rf, ok := sw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(sw.ResponseWriter, src)
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err == nil {
+		sw.hijacked = true
+	}
+	return conn, brw, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// class returns the status class of the response, "" for a hijacked
+// connection. A handler that returned without responding sent an implicit
+// 200; one that panicked before responding gets withRecovery's 500.
+func (sw *statusWriter) class() string {
+	status := sw.status
+	switch {
+	case sw.hijacked:
+		return ""
+	case status == 0 && sw.returned:
+		status = http.StatusOK
+	case status == 0:
+		status = http.StatusInternalServerError
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// upgradeRoute picks the handler for an HTTP/1.1 protocol upgrade request:
+// one with an Upgrade header that Connection names. Upgrade offers are tried
+// in the order RFC 9110 section 7.8 suggests, the first one supported wins:
+//
+//   - websocket goes to the WebSocket handler, whatever the path;
+//   - h2c is ignored and the request served normally over HTTP/1.1. With
+//     cleartext --h2 a valid upgrade never gets here: the h2c handler takes
+//     it first;
+//   - anything else (label "upgrade") is answered 501 Not Implemented.
+//
+// ok is false for requests that are not upgrade requests, or that only offer
+// h2c.
+func upgradeRoute(r *http.Request) (route string, h http.HandlerFunc, ok bool) {
+	if r.ProtoMajor != 1 || len(r.Header["Upgrade"]) == 0 ||
+		!httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade") {
+		return "", nil, false
+	}
+	h2cOffered := false
+	for _, v := range r.Header["Upgrade"] {
+		for _, offer := range strings.Split(v, ",") {
+			// protocol-name ["/" protocol-version]
+			name, _, _ := strings.Cut(strings.TrimSpace(offer), "/")
+			switch {
+			case strings.EqualFold(name, "websocket"):
+				return "/ws-ping", handleWSPing, true
+			case strings.EqualFold(name, "h2c"):
+				h2cOffered = true
+			}
+		}
+	}
+	if h2cOffered {
+		return "", nil, false
+	}
+	return "upgrade", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unsupported upgrade protocol", http.StatusNotImplemented)
+	}, true
+}
+
+// router resolves a path in a fixed order, the first match winning:
+//
+//  1. an exact literal route;
+//  2. pattern routes: /users/:id/posts/:post, the api pattern, then the
+//     generated --pattern-routes in registration order;
+//  3. literal routes ending in "/" as prefixes, longest first, so "/a/b/"
+//     beats "/a/" and a literal "/" only catches what nothing else did;
+//  4. the static file tree (label "static") when --static or the embedded
+//     site is enabled, which answers 404 for missing files itself;
+//  5. defaultHandler (label "unmatched").
+//
+// The returned route label is a template rather than the raw path, keeping
+// metrics cardinality bounded.
+type router struct {
+	literals routeTable
+	prefixes []string // literal routes ending in "/", longest first
+}
+
+// literalRoute is a registered literal route: its handler and the methods it
+// answers, nil for any. The methods are what /_routes reports; handlers
+// still refuse the others themselves.
+type literalRoute struct {
+	handler http.HandlerFunc
+	methods []string
+}
+
+// routeTable holds the literal routes by path.
+type routeTable map[string]literalRoute
+
+// handle registers h at path, answering only methods if any are given.
+func (t routeTable) handle(path string, h http.HandlerFunc, methods ...string) {
+	t[path] = literalRoute{handler: h, methods: methods}
+}
+
+func newRouter(literalRoutes routeTable) *router {
+	rt := &router{literals: literalRoutes}
+	for lit := range literalRoutes {
+		if strings.HasSuffix(lit, "/") {
+			rt.prefixes = append(rt.prefixes, lit)
+		}
+	}
+	sort.Slice(rt.prefixes, func(i, j int) bool {
+		if len(rt.prefixes[i]) != len(rt.prefixes[j]) {
+			return len(rt.prefixes[i]) > len(rt.prefixes[j])
+		}
+		return rt.prefixes[i] < rt.prefixes[j]
+	})
+	return rt
+}
+
+// routeInfo describes one route of a router for /_routes.
+type routeInfo struct {
+	Template string   `json:"template"`
+	Kind     string   `json:"kind"`    // literal, pattern, prefix, static or default
+	Methods  []string `json:"methods"` // ["*"] for any
+}
+
+// routes lists what rt dispatches to, in lookup order, each under the label
+// lookup returns for it.
+func (rt *router) routes() []routeInfo {
+	var out []routeInfo
+	add := func(template, kind string) {
+		methods := rt.literals[template].methods
+		if methods == nil {
+			methods = []string{"*"}
+		}
+		out = append(out, routeInfo{Template: template, Kind: kind, Methods: methods})
+	}
+	for _, lit := range slices.Sorted(maps.Keys(rt.literals)) {
+		if !strings.HasSuffix(lit, "/") {
+			add(lit, "literal")
+		}
+	}
+	add(userPostPattern.template, "pattern")
+	add(apiPattern.template, "pattern")
+	for i := range patternRoutes {
+		add(patternRoutes[i].pattern.template, "pattern")
+	}
+	for _, prefix := range rt.prefixes {
+		add(prefix, "prefix")
+	}
+	if staticFS != nil {
+		add("static", "static")
+	}
+	add("unmatched", "default")
+	return out
+}
+
+func (rt *router) lookup(path string) (string, http.HandlerFunc) {
+	if lr, ok := rt.literals[path]; ok {
+		return path, lr.handler
+	}
+
+	if _, ok := userPostPattern.match(path, nil); ok {
+		return userPostPattern.template, handleUserPost
+	}
+	if _, ok := apiPattern.match(path, nil); ok {
+		return apiPattern.template, handleApiPattern
+	}
+	for i := range patternRoutes {
+		pr := &patternRoutes[i]
+		if _, ok := pr.pattern.match(path, nil); ok {
+			return pr.pattern.template, pr.handler
+		}
+	}
+
+	for _, prefix := range rt.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return prefix, rt.literals[prefix].handler
+		}
+	}
+
+	if staticFS != nil {
+		return "static", handleStatic
+	}
+	return "unmatched", defaultHandler
+}
+
+// parseDefaultHandler maps a --default-handler mode (notfound, echo or
+// status:CODE) to the handler serving unmatched paths.
+func parseDefaultHandler(mode string) (http.HandlerFunc, error) {
+	switch {
+	case mode == "notfound":
+		return http.NotFound, nil
+	case mode == "echo":
+		return handleDefaultEcho, nil
+	case strings.HasPrefix(mode, "status:"):
+		code, err := strconv.Atoi(strings.TrimPrefix(mode, "status:"))
+		if err != nil || code < 200 || code > 599 {
+			return nil, fmt.Errorf("invalid status in %q", mode)
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(code)
+			fmt.Fprintf(w, "%d %s", code, http.StatusText(code))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown mode %q (want notfound, echo or status:CODE)", mode)
+}
+
+// handleDefaultEcho answers an unmatched path with its request line, its
+// headers merged by normalizeHeader and sorted by name, a blank line, then the
+// request body. A repeated singleton header is answered with 400.
+func handleDefaultEcho(w http.ResponseWriter, r *http.Request) {
+	header, err := normalizeHeader(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := slices.Sorted(maps.Keys(header))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+		}
+	}
+	buf.WriteByte('\n')
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write(buf.Bytes())
+	_, _ = io.Copy(w, r.Body)
+}
+
+// patternRoute is a parameterized route tried, in registration order, after
+// the literal table misses.
+type patternRoute struct {
+	pattern segmentPattern
+	handler http.HandlerFunc
+}
+
+// Generated pattern routes for router stress tests (--pattern-routes N).
+var patternRoutes []patternRoute
+
+func main() {
+	port := getPort()
+	numThreads = getThreads()
+	routeCount = getRouteCount()
+	patternRouteCount = getFlagInt("--pattern-routes", 0)
+
+	var ok bool
+	if flagLogLevel, ok = parseLogLevel(getFlagValue("--log-level")); !ok {
+		fatal("invalid --log-level (use debug, info, warn or error)", "value", getFlagValue("--log-level"))
+	}
+	logLevel.Set(flagLogLevel)
+	logger, err := newLogger(getFlagValue("--log-format"))
+	if err != nil {
+		fatal("invalid --log-format", "err", err)
+	}
+	slog.SetDefault(logger)
+
+	staticDir = getStaticDir()
+	embeddedStatic = hasFlag("--embedded-static")
+	if staticDir != "" {
+		staticFS = os.DirFS(staticDir)
+	} else if embeddedStatic {
+		staticFS, _ = fs.Sub(embeddedSite, "go_assets/site")
+	}
+	if file := getFlagValue("--mime-types"); file != "" {
+		if mimeOverrides, err = loadMimeTypes(file); err != nil {
+			fatal("invalid --mime-types", "err", err)
+		}
+	}
+	if staticFS != nil && hasFlag("--preload-static") {
+		// The listener accepts meanwhile; withReadiness answers 503.
+		reason := "preloading static files"
+		notReady.Store(&reason)
+		concurrency := getFlagInt("--preload-concurrency", runtime.NumCPU())
+		go func() {
+			start := time.Now()
+			cache, size, err := preloadStatic(staticFS, concurrency)
+			if err != nil {
+				fatal("static preload failed", "err", err)
+			}
+			staticCache = cache
+			notReady.Store(nil)
+			slog.Info("static files preloaded, ready", "files", len(cache), "bytes", size, "elapsed", time.Since(start))
+		}()
+	}
+
+	h2Enabled = hasFlag("--h2")
+	h2MaxStreams = getFlagInt("--h2-max-streams", 0)
+	h2MaxReadFrameSize = getFlagInt("--h2-max-read-frame-size", 0)
+	h2IdleTimeout = getFlagDuration("--h2-idle-timeout", 0)
+	if h2MaxStreams < 0 || h2MaxStreams > 1<<32-1 {
+		fatal("invalid --h2-max-streams", "value", h2MaxStreams)
+	}
+	if h2MaxReadFrameSize != 0 && (h2MaxReadFrameSize < minH2FrameSize || h2MaxReadFrameSize > maxH2FrameSize) {
+		fatal(fmt.Sprintf("invalid --h2-max-read-frame-size, want [%d,%d]", minH2FrameSize, maxH2FrameSize), "value", h2MaxReadFrameSize)
+	}
+	h2PriorityFrames = hasFlag("--h2-priority-frames")
+
+	tlsEnabled = hasFlag("--tls")
+	certFile = getFlagValue("--cert")
+	keyFile = getFlagValue("--key")
+	tlsSessionTickets = getFlagValue("--tls-session-tickets") != "disable"
+	tlsOCSPStapleFile = getFlagValue("--tls-ocsp-staple")
+	tlsHandshakeDelay = getFlagDuration("--tls-handshake-delay", 0)
+	if tlsCurvePreferences, err = parseCurvePreferences(getFlagValue("--tls-curve-preferences")); err != nil {
+		fatal("invalid --tls-curve-preferences", "err", err)
+	}
+	if tlsCipherSuites, err = parseCipherSuites(getFlagValue("--tls-cipher-suites")); err != nil {
+		fatal("invalid --tls-cipher-suites", "err", err)
+	}
+
+	ipVersion = getFlagValue("--ip-version")
+	if ipVersion == "" {
+		ipVersion = "4"
+	}
+	if listenHost, err = resolveListenHost(ipVersion, getFlagValue("--listen-addr")); err != nil {
+		fatal("invalid --ip-version or --listen-addr", "err", err)
+	}
+	listenBacklog = getFlagInt("--backlog", 0)
+	if hasFlag("--tcp-fastopen") {
+		tcpFastOpenQueue = getFlagInt("--tcp-fastopen-queue", 256)
+	}
+	acceptLoops = max(getFlagInt("--accept-loops", 1), 1)
+	acceptRamp = getFlagDuration("--accept-ramp", 0)
+	acceptRampRate = float64(getFlagInt("--accept-ramp-rate", 50))
+	proxyProtocol = hasFlag("--proxy-protocol")
+
+	readHeaderTimeout = getFlagDuration("--read-header-timeout", 0)
+	maxHeaderBytes = getFlagInt("--max-header-bytes", 256*1024)
+	maxHeaderValueSize = getFlagInt("--max-header-value-size", 0)
+	timeout408 = hasFlag("--timeout-408")
+	bodyReadTimeout = getFlagDuration("--body-read-timeout", 10*time.Second)
+	maxRequestsPerConn = getFlagInt("--max-requests-per-conn", 0)
+	handshakeTiming = hasFlag("--handshake-timing")
+	byteAccounting = hasFlag("--byte-accounting")
+	teGzip = hasFlag("--te-gzip")
+	methodOverride = hasFlag("--method-override")
+	queryParseOnce = hasFlag("--query-parse-once")
+
+	chunkedThreshold = getFlagInt("--chunked-threshold", 0)
+	chunkWriteDeadline = getFlagDuration("--write-deadline", 5*time.Second)
+	flushAfterWrite = hasFlag("--flush-after-write")
+	responseBufferSize = getFlagInt("--response-buffer-size", 0)
+
+	workerPoolSize = getFlagInt("--worker-pool", 0)
+	workerQueueSize = getFlagInt("--worker-queue", workerPoolSize)
+
+	maxIDCount = getFlagInt("--max-id-count", 10000)
+	maxUploadSize = int64(getFlagInt("--max-upload-size", 64<<20))
+	maxDecompressedSize = int64(getFlagInt("--max-decompressed-size", 64<<20))
+	maxDecompressRatio = getFlagInt("--max-ratio", 100)
+	maxMandelbrotSize = getFlagInt("--max-mandelbrot-size", 4096)
+	maxMandelbrotIter = getFlagInt("--max-mandelbrot-iter", 10000)
+	maxBatchSize = getFlagInt("--max-batch-size", 100)
+	batchTimeout = getFlagDuration("--batch-timeout", 10*time.Second)
+	latencyBudget = getFlagDuration("--latency-budget", 100*time.Millisecond)
+	wsPingInterval = getFlagDuration("--ws-ping-interval", 0)
+	wsMaxFrame = getFlagInt("--ws-max-frame", 1<<20)
+	hashAlgo = getFlagValue("--hash-algo")
+	if hashAlgo == "" {
+		hashAlgo = "sha256"
+	}
+	if _, ok := newHasher(hashAlgo); !ok {
+		fatal("invalid --hash-algo (use sha256, sha1, blake2b or crc32)", "value", hashAlgo)
+	}
+	if file := getFlagValue("--schema-file"); file != "" {
+		if bodySchema, err = jsonschema.NewCompiler().Compile(file); err != nil {
+			fatal("invalid --schema-file", "err", err)
+		}
+	}
+	if mode := getFlagValue("--default-handler"); mode != "" {
+		if defaultHandler, err = parseDefaultHandler(mode); err != nil {
+			fatal("invalid --default-handler", "err", err)
+		}
+	}
+
+	maxFanout = getFlagInt("--max-fanout", 100)
+	fanoutTimeout = getFlagDuration("--fanout-timeout", 5*time.Second)
+	upstreamDialDelay = getFlagDuration("--upstream-dial-delay", 0)
+	fanoutClient.Transport = newFanoutTransport(maxFanout, upstreamDialDelay)
+
+	healthUpstream = getFlagValue("--upstream")
+	healthMaxHeap = getFlagInt("--health-max-heap", 0)
+	healthTimeout = getFlagDuration("--health-timeout", time.Second)
+	healthCacheTTL = getFlagDuration("--health-cache-ttl", 2*time.Second)
+
+	softMemLimit = getFlagInt("--soft-mem-limit", 0)
+	if softMemLimit > 0 {
+		debug.SetMemoryLimit(int64(softMemLimit))
+	}
+	memHighWatermark = getFlagInt("--mem-high-watermark", 0)
+	memLowWatermark := getFlagInt("--mem-low-watermark", memHighWatermark/10*8)
+	if memHighWatermark < 0 || memLowWatermark < 0 || memLowWatermark > memHighWatermark {
+		fatal("invalid --mem-high-watermark or --mem-low-watermark, want 0 <= low <= high")
+	}
+	memCheckInterval := getFlagDuration("--mem-check-interval", 250*time.Millisecond)
+	if memCheckInterval <= 0 {
+		fatal("invalid --mem-check-interval, want > 0", "value", memCheckInterval)
+	}
+	if memHighWatermark > 0 {
+		go monitorMemory(uint64(memHighWatermark), uint64(memLowWatermark), memCheckInterval)
+	}
+
+	chaosEnabled = hasFlag("--chaos")
+	if val := getFlagValue("--inject-write-errors"); val != "" {
+		if writeErrorRate, err = strconv.ParseFloat(val, 64); err != nil || writeErrorRate < 0 || writeErrorRate > 1 {
+			fatal("invalid --inject-write-errors, want a rate in [0,1]", "value", val)
+		}
+	}
+
+	responseCacheEnabled = hasFlag("--response-cache")
+	responseCacheTTL = getFlagDuration("--response-cache-ttl", time.Second)
+	responseCacheMaxEntry = getFlagInt("--response-cache-max-entry", 64*1024)
+	responseCacheEntries = getFlagInt("--response-cache-entries", 1024)
+	if responseCacheEnabled {
+		responseCache = newLRUCache(responseCacheEntries)
+	}
+
+	metricsEnabled = hasFlag("--metrics")
+	selfTestEnabled = hasFlag("--self-test")
+	otelEnabled = hasFlag("--otel")
+	otelEndpoint = getFlagValue("--otel-endpoint")
+	if otelEndpoint == "" {
+		otelEndpoint = "localhost:4318"
+	}
+
+	coalesceCompute = hasFlag("--coalesce")
+	recordFile := getFlagValue("--record")
+	if recordFile != "" {
+		f, err := os.OpenFile(recordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fatal("invalid --record", "err", err)
+		}
+		recorder = newRequestRecorder(f, recordQueueSize, getFlagInt("--record-body-max", 64*1024))
+	}
+	adminPort = getFlagInt("--admin-port", 0)
+	if val := getFlagValue("--seed"); val != "" {
+		if seed, err = strconv.ParseInt(val, 10, 64); err != nil {
+			fatal("invalid --seed", "err", err)
+		}
+		seededRand = &lockedRand{rng: rand.New(rand.NewSource(seed))}
+	}
+
+	configFile = getFlagValue("--config")
+	if configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			fatal("invalid --config", "err", err)
+		}
+		// Command-line flags take precedence over the config file for the
+		// settings that are only applied at startup.
+		if cfg.Port != 0 && getFlagValue("--port") == "" && os.Getenv("BENCH_PORT") == "" {
+			port = cfg.Port
+		}
+		if certFile == "" {
+			certFile = cfg.TLSCert
+		}
+		if keyFile == "" {
+			keyFile = cfg.TLSKey
+		}
+		cfg.Port, cfg.TLSCert, cfg.TLSKey = port, certFile, keyFile
+		applyConfig(cfg)
+	}
+
+	// Limit Go scheduler parallelism to the requested count.
+	// GOMAXPROCS only limits goroutine parallelism; Go's runtime creates
+	// additional OS threads for sysmon, GC workers, and goroutines blocked in
+	// syscalls (e.g. file I/O). These typically add 3-5 threads on top of
+	// GOMAXPROCS. We intentionally do not hard-cap runtime threads because too
+	// small limits can trigger fatal "thread exhaustion" under load.
+	if numThreads > 0 {
+		// reserve ~2 slot for sysmon + GC/netpoller
+		procs := numThreads - 2
+		if procs < 1 {
+			procs = 1
+		}
+		runtime.GOMAXPROCS(procs)
+	}
+
+	// Build a deterministic router: literal route map + top-level handler
+	literalRoutes := newLiteralRoutes()
+
+	if routeCount > 0 {
+		for i := 0; i < routeCount; i++ {
+			idx := i // capture
+			path := fmt.Sprintf("/r%d", i)
+			literalRoutes.handle(path, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(fmt.Sprintf("route %d", idx)))
+			})
+		}
+	}
+
+	for i := 0; i < patternRouteCount; i++ {
+		patternRoutes = append(patternRoutes, newGeneratedPatternRoute(i))
+	}
+
+	if metricsEnabled {
+		literalRoutes.handle("/metrics", handleMetrics)
+	}
+	if bodySchema != nil {
+		literalRoutes.handle("/validate-schema", handleSchema, http.MethodPost)
+	}
+
+	if adminPort == 0 {
+		literalRoutes.handle("/_routes", handleRoutes)
+	}
+	servingRouter = newRouter(literalRoutes)
+
+	healthChecks = defaultHealthChecks()
+	topHandler := newTopHandler(servingRouter)
+	batchHandler = withRecovery(topHandler)
+
+	// Wrap handler for h2c (HTTP/2 cleartext) if requested
+	var inner http.Handler = topHandler
+	if writeErrorRate > 0 {
+		inner = withWriteErrors(inner, writeErrorRate)
+	}
+	var handler http.Handler = withRecovery(inner)
+	if responseCacheEnabled {
+		handler = withResponseCache(handler)
+	}
+	handler = withConnTracking(withPadding(withHTTP10Compat(withWriteStrategy(handler))))
+	if chaosEnabled {
+		handler = withChaos(handler)
+	}
+	if methodOverride {
+		handler = withMethodOverride(handler)
+	}
+	if queryParseOnce {
+		handler = withQueryCache(handler)
+	}
+	if teGzip {
+		handler = withTransferGzip(handler)
+	}
+	if maxHeaderValueSize > 0 {
+		handler = withMaxHeaderValueSize(handler, maxHeaderValueSize)
+	}
+	if timeout408 {
+		handler = withBodyReadTimeout(handler, bodyReadTimeout)
+	}
+	if configFile != "" {
+		handler = withRuntimeConfig(handler)
+		go reloadConfigOnSIGHUP()
+	}
+	if workerPoolSize > 0 {
+		handler = withWorkerPool(handler, workerPoolSize, workerQueueSize)
+	}
+	if memHighWatermark > 0 {
+		// Outside the worker pool, so shed requests never take a queue slot.
+		handler = withMemoryShedding(handler)
+	}
+	if recorder != nil {
+		handler = withRecording(handler, recorder)
+	}
+	if otelEnabled {
+		if err := setupTracing(otelEndpoint); err != nil {
+			fatal("invalid --otel-endpoint", "err", err)
+		}
+		handler = otelhttp.NewHandler(handler, "go-bench-server")
+		fanoutClient.Transport = otelhttp.NewTransport(fanoutClient.Transport)
+	}
+	if notReady.Load() != nil {
+		handler = withReadiness(handler)
+	}
+	if tlsEnabled {
+		handler = withTLSInfo(handler)
+	}
+	var h2s *http2.Server
+	if h2Enabled {
+		h2s = newH2Server()
+	}
+	if h2Enabled && !tlsEnabled {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+
+	server := &http.Server{
+		Addr:         net.JoinHostPort(listenHost, strconv.Itoa(port)),
+		Handler:      handler,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: writeTimeout,
+		// Bounds how long a client may trickle the request line and headers
+		// (slowloris); when zero net/http falls back to ReadTimeout.
+		ReadHeaderTimeout: readHeaderTimeout,
+		MaxHeaderBytes:    maxHeaderBytes, // 256KB by default for stress tests
+		ConnContext:       connContext,
+	}
+	server.ConnState = func(c net.Conn, state http.ConnState) {
+		if timeout408 {
+			trackTimeout408State(c, state)
+		}
+		logConnState(c, state)
+	}
+
+	if tlsEnabled && certFile != "" && keyFile != "" {
+		tlsConfig, err := buildTLSConfig()
+		if err != nil {
+			fatal("TLS setup failed", "err", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	// ConfigureServer sets up h2 over TLS, and for both TLS and h2c fills in
+	// the idle timeout from the server's and sends GOAWAY on shutdown.
+	if h2Enabled {
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			fatal("HTTP/2 setup failed", "err", err)
+		}
+	}
+
+	protocol := "http/1.1"
+	if h2Enabled {
+		if tlsEnabled {
+			protocol = "h2-tls"
+		} else {
+			protocol = "h2c"
+		}
+	}
+	slog.Info("go benchmark server starting", "port", port, "threads", numThreads, "protocol", protocol)
+	if h2Enabled {
+		streams, frameSize := effectiveH2Limits(h2s)
+		slog.Info("http2", "max_concurrent_streams", streams, "max_read_frame_size", frameSize, "idle_timeout", h2s.IdleTimeout)
+	}
+	if staticDir != "" {
+		slog.Info("static files", "dir", staticDir)
+	} else if embeddedStatic {
+		slog.Info("static files", "dir", "embedded demo site")
+	}
+	if routeCount > 0 {
+		slog.Info("generated literal routes", "count", routeCount)
+	}
+	if patternRouteCount > 0 {
+		slog.Info("generated pattern routes", "count", patternRouteCount)
+	}
+	effectiveHeaderTimeout := server.ReadHeaderTimeout
+	if effectiveHeaderTimeout == 0 {
+		effectiveHeaderTimeout = server.ReadTimeout
+	}
+	slog.Info("timeouts", "read_header", effectiveHeaderTimeout, "read", server.ReadTimeout, "write", server.WriteTimeout)
+	if flushAfterWrite {
+		slog.Info("write strategy", "flush_after_write", true)
+	} else if responseBufferSize > 0 {
+		slog.Info("write strategy", "buffer_bytes", responseBufferSize)
+	}
+	if responseCacheEnabled {
+		slog.Info("response cache", "entries", responseCacheEntries, "ttl", responseCacheTTL, "max_entry_bytes", responseCacheMaxEntry)
+	}
+	if timeout408 {
+		slog.Info("408 on slow request line, headers or body", "body_read_timeout", bodyReadTimeout)
+	}
+	if handshakeTiming {
+		slog.Info("handshake timing: X-Handshake-Ms on the first response of each connection")
+	}
+	if maxRequestsPerConn > 0 {
+		slog.Info("keep-alive limit", "max_requests_per_conn", maxRequestsPerConn)
+	}
+	if mode := getFlagValue("--default-handler"); mode != "" {
+		slog.Info("default handler", "mode", mode)
+	}
+	if chaosEnabled {
+		slog.Info("chaos: _fail query parameter enabled on all routes")
+	}
+	if writeErrorRate > 0 {
+		slog.Info("injecting response write errors", "rate", writeErrorRate)
+	}
+	if metricsEnabled {
+		slog.Info("metrics enabled", "path", "/metrics")
+	}
+	if upstreamDialDelay > 0 {
+		slog.Info("upstream dial delay", "delay", upstreamDialDelay)
+	}
+	if softMemLimit > 0 {
+		slog.Info("soft memory limit", "bytes", softMemLimit)
+	}
+	if memHighWatermark > 0 {
+		slog.Info("memory load shedding", "high_watermark", memHighWatermark, "low_watermark", memLowWatermark, "interval", memCheckInterval)
+	}
+	if coalesceCompute {
+		slog.Info("coalescing identical concurrent /compute requests")
+	}
+	if teGzip {
+		slog.Info("gzip transfer coding accepted on cleartext HTTP/1.1 requests")
+	}
+	if chunkedThreshold > 0 {
+		slog.Info("framing: Content-Length up to threshold, chunked above", "chunked_threshold", chunkedThreshold)
+	}
+	if workerPoolSize > 0 {
+		slog.Info("worker pool", "workers", workerPoolSize, "queue", workerQueueSize)
+	}
+	if byteAccounting {
+		slog.Info("byte accounting enabled", "path", "/metrics")
+	}
+	if otelEnabled {
+		slog.Info("tracing enabled", "otlp_endpoint", otelEndpoint)
+	}
+	if adminPort > 0 {
+		adminMux := newAdminMux(server, port)
+		adminMux.HandleFunc("/_routes", handleRoutes)
+		adminServer := &http.Server{
+			Addr:    fmt.Sprintf("127.0.0.1:%d", adminPort),
+			Handler: adminMux,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil {
+				slog.Error("admin server error", "err", err)
+			}
+		}()
+		slog.Info("admin server", "port", adminPort)
+	}
+	if recorder != nil {
+		slog.Info("recording requests", "file", recordFile, "body_max", recorder.bodyMax)
+	}
+	if configFile != "" {
+		slog.Info("config file loaded, send SIGHUP to reload", "file", configFile)
+	}
+	if tlsEnabled {
+		slog.Info("tls", "session_tickets", tlsSessionTickets, "curves", len(tlsCurvePreferences),
+			"cipher_suites", len(tlsCipherSuites), "ocsp_staple", tlsOCSPStapleFile != "")
+	}
+	if tlsHandshakeDelay > 0 {
+		slog.Info("delaying every TLS handshake", "delay", tlsHandshakeDelay)
+	}
+	shutdownDone := shutdownOnSignal(server)
+	// Each listener gets its own net/http accept loop; more than one share
+	// the port through SO_REUSEPORT.
+	lns := make([]net.Listener, acceptLoops)
+	for i := range lns {
+		if lns[i], err = listenTCP(server.Addr); err != nil {
+			fatal("server error", "err", err)
+		}
+	}
+	families := map[string]string{"4": "IPv4", "6": "IPv6", "dual": "IPv4 and IPv6"}
+	slog.Info("listening", "addr", lns[0].Addr().String(), "ip_version", families[ipVersion])
+	if acceptLoops > 1 {
+		slog.Info("accept loops", "listeners", acceptLoops)
+	}
+	if listenBacklog > 0 {
+		slog.Info("listen backlog", "requested", listenBacklog, "effective", effectiveBacklog(listenBacklog))
+	}
+	if tcpFastOpenQueue > 0 {
+		logTCPFastOpen(tcpFastOpenErr)
+	}
+	if acceptRamp > 0 {
+		slog.Info("accept ramp", "duration", acceptRamp, "conns_per_second", acceptRampRate)
+	}
+	if metricsEnabled {
+		acceptCounts = make([]atomic.Int64, acceptLoops)
+	}
+	// The ramp limits accepts across all loops together.
+	rampLimiter := rate.NewLimiter(rate.Limit(acceptRampRate), 1)
+	rampUntil := time.Now().Add(acceptRamp)
+	serveErr := make(chan error, len(lns))
+	tlsServe := tlsEnabled && certFile != "" && keyFile != ""
+	for i, ln := range lns {
+		if acceptRamp > 0 {
+			ln = &rampListener{ln, rampUntil, rampLimiter}
+		}
+		if proxyProtocol {
+			// Below every other wrapper, so all of them see the real client address.
+			ln = newProxyProtoListener(ln, proxyHeaderTimeout)
+		}
+		if handshakeTiming && !tlsEnabled {
+			// Innermost, so the first byte is timed before any other wrapper.
+			ln = firstByteListener{ln}
+		}
+		if h2PriorityFrames && h2Enabled && !tlsEnabled {
+			ln = h2PriorityListener{ln}
+		}
+		if byteAccounting {
+			ln = countingListener{ln}
+		}
+		if !tlsServe && teGzip {
+			ln = teGzipListener{ln}
+		}
+		if !tlsServe && timeout408 {
+			// The raw 408 is plaintext, so only cleartext listeners get it.
+			ln = timeout408Listener{ln}
+		}
+		if acceptCounts != nil {
+			// Outermost, so it times net/http's own loop.
+			ln = &acceptStatsListener{Listener: ln, loop: i}
+		}
+		go func() {
+			if tlsServe {
+				// Certificates are already loaded into server.TLSConfig.
+				serveErr <- server.ServeTLS(ln, "", "")
+			} else {
+				serveErr <- server.Serve(ln)
+			}
+		}()
+	}
+	if selfTestEnabled {
+		scheme := "http"
+		if tlsServe {
+			scheme = "https"
+		}
+		go selfTest(scheme+"://"+lns[0].Addr().String(), tlsServe, servingRouter)
+	}
+	err = <-serveErr
+	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdownDone
+		if recorder != nil {
+			recorder.close()
+		}
+		slog.Info("server stopped")
+		return
+	}
+	fatal("server error", "err", err)
+}
+
+// HTTP/2 frame payloads may be 16KB to 16MB-1 (RFC 9113 section 4.2).
+const (
+	minH2FrameSize = 1 << 14
+	maxH2FrameSize = 1<<24 - 1
+)
+
+// newH2Server returns the HTTP/2 settings of --h2-max-streams,
+// --h2-max-read-frame-size and --h2-idle-timeout; zero keeps x/net/http2's
+// defaults, and a zero idle timeout falls back to the server's ReadTimeout
+// once ConfigureServer has run.
+func newH2Server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams: uint32(h2MaxStreams),
+		MaxReadFrameSize:     uint32(h2MaxReadFrameSize),
+		IdleTimeout:          h2IdleTimeout,
+	}
+}
+
+// effectiveH2Limits returns the SETTINGS_MAX_CONCURRENT_STREAMS and
+// SETTINGS_MAX_FRAME_SIZE h2s advertises, x/net/http2 replacing zero with
+// 250 streams and 1MB frames.
+func effectiveH2Limits(h2s *http2.Server) (streams, frameSize uint32) {
+	streams, frameSize = h2s.MaxConcurrentStreams, h2s.MaxReadFrameSize
+	if streams == 0 {
+		streams = 250
+	}
+	if frameSize == 0 {
+		frameSize = 1 << 20
+	}
+	return streams, frameSize
+}
+
+// newLiteralRoutes returns the endpoints every server registers; main adds
+// the ones that depend on flags.
+func newLiteralRoutes() routeTable {
+	literalRoutes := make(routeTable)
+	literalRoutes.handle("/ping", handlePing)
+	literalRoutes.handle("/readyz", handleReadyz)
+	literalRoutes.handle("/headers", handleHeaders)
+	literalRoutes.handle("/uppercase", handleUppercase)
+	literalRoutes.handle("/body-codec", handleBodyCodec, http.MethodPost)
+	literalRoutes.handle("/decompress", handleDecompress, http.MethodPost)
+	literalRoutes.handle("/compute", handleCompute)
+	literalRoutes.handle("/mandelbrot", handleMandelbrot)
+	literalRoutes.handle("/json", handleJSON)
+	literalRoutes.handle("/slow-json", handleSlowJSON)
+	literalRoutes.handle("/ndjson", handleNDJSON)
+	literalRoutes.handle("/countdown", handleCountdown)
+	literalRoutes.handle("/delay", handleDelay)
+	literalRoutes.handle("/latency-budget", handleLatencyBudget)
+	literalRoutes.handle("/body", handleBody)
+	literalRoutes.handle("/priority", handlePriority)
+	literalRoutes.handle("/status", handleStatus)
+	literalRoutes.handle("/custom-status", handleCustomStatus)
+	literalRoutes.handle("/partial-write-flush", handlePartialWriteFlush)
+	literalRoutes.handle("/reflect-status-from-body", handleReflectStatus, http.MethodPost)
+	literalRoutes.handle("/resource/", handleResource, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	literalRoutes.handle("/connection-close-race", handleConnectionCloseRace)
+	literalRoutes.handle("/protobuf", handleProtobuf, http.MethodGet, http.MethodHead, http.MethodPost)
+	literalRoutes.handle("/xml", handleXML, http.MethodGet, http.MethodHead, http.MethodPost)
+	literalRoutes.handle("/inspect", handleInspect)
+	literalRoutes.handle("/conninfo", handleConnInfo)
+	literalRoutes.handle("/early-hints", handleEarlyHints)
+	literalRoutes.handle("/echo-body", handleEchoBody)
+	literalRoutes.handle("/gzip-stream", handleGzipStream)
+	literalRoutes.handle("/version", handleVersion)
+	literalRoutes.handle("/favicon.ico", handleFavicon)
+	literalRoutes.handle("/flaky", handleFlaky)
+	literalRoutes.handle("/slow-body", handleSlowBody)
+	literalRoutes.handle("/download", handleDownload)
+	literalRoutes.handle("/query", handleQuery, http.MethodPost)
+	literalRoutes.handle("/backpressure", handleBackpressure)
+	literalRoutes.handle("/throttle", handleThrottle)
+	literalRoutes.handle("/csv", handleCSV)
+	literalRoutes.handle("/params", handleParams)
+	literalRoutes.handle("/sequence", handleSequence)
+	literalRoutes.handle("/encoding", handleEncoding)
+	literalRoutes.handle("/multipart-mixed", handleMultipartDownload)
+	literalRoutes.handle("/locale", handleLocale)
+	literalRoutes.handle("/range", handleRangeDownload)
+	literalRoutes.handle("/time", handleTime)
+	literalRoutes.handle("/id", handleID)
+	literalRoutes.handle("/tee", handleTee)
+	literalRoutes.handle("/ws-ping", handleWSPing, http.MethodGet)
+	literalRoutes.handle("/fanout", handleFanout)
+	literalRoutes.handle("/batch", handleBatch, http.MethodPost)
+	literalRoutes.handle("/consistency", handleConsistency)
+	literalRoutes.handle("/upload", handleUpload, http.MethodPost, http.MethodPut)
+	literalRoutes.handle("/hash", handleHashUpload, http.MethodPost, http.MethodPut)
+	literalRoutes.handle("/redirect", handleRedirect)
+	literalRoutes.handle("/encoding-passthrough", handleEncodingPassthrough, http.MethodPost, http.MethodPut)
+	literalRoutes.handle("/health/deep", handleHealthDeep)
+	return literalRoutes
+}
+
+// shutdownOnSignal stops server gracefully on SIGINT or SIGTERM, giving
+// in-flight requests up to five seconds, and closes the returned channel once
+// it is done.
+func shutdownOnSignal(server *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("shutdown did not complete, closing remaining connections", "err", err)
+			server.Close()
+		}
+		close(done)
+	}()
+	return done
+}
+
+// setupTracing installs a global tracer provider batching spans to an OTLP/HTTP
+// collector at endpoint (host:port, plaintext). otelhttp picks it up for the
+// per-request spans; topHandler then names them after the route.
+func setupTracing(endpoint string) error {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure())
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "go-bench-server"))),
+	))
+	return nil
+}
+
+// fileConfig is the JSON layout of the --config file. Only log_level,
+// rate_limit, rate_burst and routes can be changed by a SIGHUP reload; port and
+// TLS certificate changes require a restart.
+//
+//	{
+//	  "port": 8083,
+//	  "tls_cert": "cert.pem",
+//	  "tls_key": "key.pem",
+//	  "log_level": "info",
+//	  "rate_limit": 50000,
+//	  "rate_burst": 1000,
+//	  "routes": {"/delay": {"timeout": "500ms"}, "/stream": {"close_after": true}}
+//	}
+type fileConfig struct {
+	Port      int                    `json:"port"`
+	TLSCert   string                 `json:"tls_cert"`
+	TLSKey    string                 `json:"tls_key"`
+	LogLevel  string                 `json:"log_level"`
+	RateLimit float64                `json:"rate_limit"` // requests per second, 0 disables limiting
+	RateBurst int                    `json:"rate_burst"`
+	Routes    map[string]routeConfig `json:"routes"`
+}
+
+// routeConfig holds per-route settings keyed by exact request path.
+// CloseAfter ends the HTTP/1.x connection after each response on the route.
+type routeConfig struct {
+	Timeout    configDuration `json:"timeout"`
+	CloseAfter bool           `json:"close_after"`
+}
+
+// configDuration decodes a JSON string such as "250ms" with time.ParseDuration.
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+// liveConfig is the applied form of a fileConfig.
+type liveConfig struct {
+	fileConfig
+	limiter *rate.Limiter // nil when rate limiting is disabled
+}
+
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if _, ok := parseLogLevel(cfg.LogLevel); !ok {
+		return nil, fmt.Errorf("unknown log_level %q", cfg.LogLevel)
+	}
+	if cfg.RateLimit < 0 || cfg.RateBurst < 0 {
+		return nil, fmt.Errorf("rate_limit and rate_burst must not be negative")
+	}
+	return &cfg, nil
+}
+
+func parseLogLevel(value string) (slog.Level, bool) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug, true
+	case "", "info":
+		return slog.LevelInfo, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	}
+	return 0, false
+}
+
+// applyConfig atomically publishes cfg to the request path.
+func applyConfig(cfg *fileConfig) {
+	live := &liveConfig{fileConfig: *cfg}
+	if cfg.RateLimit > 0 {
+		burst := cfg.RateBurst
+		if burst == 0 {
+			burst = int(cfg.RateLimit)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		live.limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), burst)
+	}
+	if level, _ := parseLogLevel(cfg.LogLevel); cfg.LogLevel != "" {
+		logLevel.Set(level)
+	} else {
+		logLevel.Set(flagLogLevel)
+	}
+	currentConfig.Store(live)
+}
+
+// reloadConfigOnSIGHUP re-reads --config on every SIGHUP. The listener is never
+// rebound; settings that cannot be hot-applied are reported and ignored.
+func reloadConfigOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			slog.Error("config reload failed, keeping previous settings", "err", err)
+			continue
+		}
+		prev := currentConfig.Load()
+		if cfg.Port != 0 && cfg.Port != prev.Port {
+			slog.Warn("config reload: port change requires a restart, ignored", "port", cfg.Port)
+		}
+		if (cfg.TLSCert != "" && cfg.TLSCert != prev.TLSCert) || (cfg.TLSKey != "" && cfg.TLSKey != prev.TLSKey) {
+			slog.Warn("config reload: TLS certificate changes require a restart, ignored")
+		}
+		cfg.Port, cfg.TLSCert, cfg.TLSKey = prev.Port, prev.TLSCert, prev.TLSKey
+		applyConfig(cfg)
+		slog.Info("config reloaded", "file", configFile)
+	}
+}
+
+// withRuntimeConfig enforces the hot-reloadable rate limit and per-route
+// timeouts and forced closes. Route timeouts use http.TimeoutHandler, which
+// buffers the response, so they should not be configured on streaming
+// routes. The write deadline of such a route follows its timeout, so a route
+// timeout above --write-timeout still gets its response out.
+func withRuntimeConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig.Load()
+		if cfg.limiter != nil && !cfg.limiter.Allow() {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		route, ok := cfg.Routes[r.URL.Path]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route.CloseAfter && r.ProtoMajor == 1 {
+			// net/http closes the connection after a response carrying
+			// this header; HTTP/2 has no per-response equivalent.
+			w.Header().Set("Connection", "close")
+		}
+		if route.Timeout > 0 {
+			timeout := time.Duration(route.Timeout)
+			// The margin leaves time to write the buffered response,
+			// or the 503, once the handler is done.
+			rc := http.NewResponseController(w)
+			_ = rc.SetWriteDeadline(time.Now().Add(timeout + time.Second))
+			http.TimeoutHandler(next, timeout, "Request Timeout").ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newLogger returns a stderr logger in the --log-format (text, the default,
+// or json), filtered by logLevel.
+func newLogger(format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown format %q (use text or json)", format)
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logConnState logs connection state transitions at debug level.
+func logConnState(c net.Conn, state http.ConnState) {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug("connection", "remote", c.RemoteAddr().String(), "state", state.String())
+	}
+}
+
+// buildTLSConfig loads the server certificate and applies the TLS tuning flags
+// used to compare handshake cost with and without session resumption.
+func buildTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if tlsOCSPStapleFile != "" {
+		staple, err := os.ReadFile(tlsOCSPStapleFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading OCSP staple: %w", err)
+		}
+		cert.OCSPStaple = staple
+	}
+	cfg := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		SessionTicketsDisabled: !tlsSessionTickets,
+		CurvePreferences:       tlsCurvePreferences,
+		CipherSuites:           tlsCipherSuites,
+	}
+	if tlsHandshakeDelay > 0 {
+		delayHandshakes(cfg, tlsHandshakeDelay)
+	}
+	return cfg, nil
+}
+
+// delayHandshakes makes the server wait delay after each ClientHello before
+// answering it (--tls-handshake-delay), as one stuck on a slow CA or OCSP
+// lookup would, so clients can check their TLS handshake timeouts. Every TLS
+// connection is delayed alike, resumptions included, whatever its SNI or
+// ALPN. The wait ends early when the client goes away. The handshake runs
+// under the connection's ReadHeaderTimeout (or ReadTimeout), so a delay
+// beyond it fails every handshake.
+func delayHandshakes(cfg *tls.Config, delay time.Duration) {
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return nil, nil // carry on with cfg itself
+		case <-hello.Context().Done():
+			return nil, hello.Context().Err()
+		}
+	}
+}
+
+// parseCurvePreferences parses a comma-separated list of curve names
+// (X25519, P256, P384, P521, X25519MLKEM768). An empty list keeps Go's defaults.
+func parseCurvePreferences(value string) ([]tls.CurveID, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var curves []tls.CurveID
+	for _, name := range strings.Split(value, ",") {
+		switch strings.ToUpper(strings.TrimSpace(name)) {
+		case "X25519":
+			curves = append(curves, tls.X25519)
+		case "P256", "P-256":
+			curves = append(curves, tls.CurveP256)
+		case "P384", "P-384":
+			curves = append(curves, tls.CurveP384)
+		case "P521", "P-521":
+			curves = append(curves, tls.CurveP521)
+		case "X25519MLKEM768":
+			curves = append(curves, tls.X25519MLKEM768)
+		default:
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+	}
+	return curves, nil
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names as
+// reported by tls.CipherSuiteName. Only TLS 1.0-1.2 suites are configurable;
+// TLS 1.3 suites are always enabled by crypto/tls.
+func parseCipherSuites(value string) ([]uint16, error) {
+	if value == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(value, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// withTLSInfo reports the negotiated cipher suite and whether the TLS session
+// was resumed, so handshake cost can be correlated with resumption.
+func withTLSInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("X-TLS-Cipher", tls.CipherSuiteName(r.TLS.CipherSuite))
+			w.Header().Set("X-TLS-Resumed", strconv.FormatBool(r.TLS.DidResume))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withWriteStrategy applies --flush-after-write or --response-buffer-size.
+//
+// net/http buffers handler writes (about 2KB on HTTP/1.1) and, when the handler
+// returns before the buffer fills, sends the response with a Content-Length.
+// Flushing after every write commits the headers on the first Write, so on
+// HTTP/1.1 any response without an explicit Content-Length becomes chunked and
+// each Write turns into its own chunk. A larger response buffer coalesces small
+// writes before they reach net/http; responses that outgrow net/http's own
+// buffer are still chunked. On HTTP/2 both settings only change DATA frame
+// boundaries.
+func withWriteStrategy(next http.Handler) http.Handler {
+	if flushAfterWrite {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&flushWriter{ResponseWriter: w}, r)
+		})
+	}
+	if responseBufferSize > 0 {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bw := &bufferedWriter{ResponseWriter: w, buf: bufio.NewWriterSize(w, responseBufferSize)}
+			next.ServeHTTP(bw, r)
+			_ = bw.buf.Flush()
+		})
+	}
+	return next
+}
+
+// withHTTP10Compat buffers responses to HTTP/1.0 clients, which cannot receive
+// chunked encoding. Streaming handlers flush as they go assuming chunked
+// framing; for HTTP/1.0 their flushes are absorbed and the whole body is sent
+// with a Content-Length once the handler returns, so Connection: keep-alive
+// clients keep their connection. Interim 1xx responses are dropped as HTTP/1.0
+// does not define them. net/http already closes HTTP/1.0 connections unless
+// keep-alive was requested.
+func withHTTP10Compat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 || r.ProtoMinor != 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hw := &http10Writer{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(hw, r)
+		hw.finish()
+	})
+}
+
+// http10Writer collects a response in memory for withHTTP10Compat.
+type http10Writer struct {
+	http.ResponseWriter
+	buf      bytes.Buffer
+	status   int
+	hijacked bool
+}
+
+func (hw *http10Writer) WriteHeader(code int) {
+	if code >= 200 {
+		hw.status = code
+	}
+}
+
+func (hw *http10Writer) Write(p []byte) (int, error) {
+	return hw.buf.Write(p)
+}
+
+// Flush is a no-op: the response is sent in one piece by finish.
+func (hw *http10Writer) Flush() {}
+
+// Hijack hands the connection to handlers that write their own response
+// (/custom-status, /connection-close-race); finish then has nothing to send.
+func (hw *http10Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(hw.ResponseWriter).Hijack()
+	if err == nil {
+		hw.hijacked = true
+	}
+	return conn, brw, err
+}
+
+func (hw *http10Writer) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+func (hw *http10Writer) finish() {
+	if hw.hijacked {
+		return
+	}
+	if hw.ResponseWriter.Header().Get("Content-Length") == "" {
+		hw.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(hw.buf.Len()))
+	}
+	hw.ResponseWriter.WriteHeader(hw.status)
+	_, _ = hw.ResponseWriter.Write(hw.buf.Bytes())
+}
+
+// flushWriter flushes the underlying connection after every Write.
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.ResponseWriter.Write(p)
+	if err == nil {
+		err = http.NewResponseController(fw.ResponseWriter).Flush()
+	}
+	return n, err
+}
+
+func (fw *flushWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// bufferedWriter coalesces handler writes in an application-side buffer.
+type bufferedWriter struct {
+	http.ResponseWriter
+	buf *bufio.Writer
+}
+
+func (bw *bufferedWriter) Write(p []byte) (int, error) {
+	return bw.buf.Write(p)
+}
+
+func (bw *bufferedWriter) Flush() {
+	_ = bw.buf.Flush()
+	_ = http.NewResponseController(bw.ResponseWriter).Flush()
+}
+
+func (bw *bufferedWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// addCounter adds n to a metrics counter. It is a single atomic add with no
+// lock around it: takeMetricsSnapshot zeroes each counter with its own Swap,
+// so a reset never loses an increment, but counters are not reset at one
+// common instant.
+func addCounter(c *atomic.Int64, n int64) {
+	c.Add(n)
+}
+
+// pathCounters is a set of per-route request counters that avoids a global
+// lock: once every route has been seen the sync.Map is read-only, and each
+// increment is a single atomic add.
+type pathCounters struct {
+	counters sync.Map // route label -> *atomic.Int64
+}
+
+func (c *pathCounters) inc(route string) {
+	v, ok := c.counters.Load(route)
+	if !ok {
+		v, _ = c.counters.LoadOrStore(route, new(atomic.Int64))
+	}
+	addCounter(v.(*atomic.Int64), 1)
+}
+
+// snapshot returns the current value of every counter, zeroing them if reset
+// is set. Routes stay registered with a zero count.
+func (c *pathCounters) snapshot(reset bool) map[string]int64 {
+	out := make(map[string]int64)
+	c.counters.Range(func(key, value any) bool {
+		counter := value.(*atomic.Int64)
+		if reset {
+			out[key.(string)] = counter.Swap(0)
+		} else {
+			out[key.(string)] = counter.Load()
+		}
+		return true
+	})
+	return out
+}
+
+// metricsSnapshot is a copy of every counter, each read atomically on its
+// own; it is also the JSON body of /admin/reset-metrics.
+type metricsSnapshot struct {
+	Requests           map[string]int64 `json:"requests"`
+	Responses          map[string]int64 `json:"responses"`
+	Panics             int64            `json:"panics"`
+	CacheHits          int64            `json:"response_cache_hits"`
+	CacheMisses        int64            `json:"response_cache_misses"`
+	SocketBytesRead    int64            `json:"socket_bytes_read"`
+	SocketBytesWritten int64            `json:"socket_bytes_written"`
+	FlakyUpResponses   int64            `json:"flaky_up_responses"`
+	FlakyDownResponses int64            `json:"flaky_down_responses"`
+	ComputeCoalesced   int64            `json:"compute_coalesced"`
+	HashBytes          int64            `json:"hash_bytes"`
+	RecordDropped      int64            `json:"record_dropped"`
+	WriteErrors        int64            `json:"write_errors_injected"`
+	DegradedRejected   int64            `json:"degraded_rejected"`
+	Accepts            []int64          `json:"accepts,omitempty"`
+	AcceptBusyNs       int64            `json:"accept_busy_ns"`
+}
+
+// takeMetricsSnapshot reads every counter and, if reset is set, swaps each to
+// zero, so every increment is counted in exactly one snapshot. A reset also
+// clears the /flaky window gauge and the latency windows (/ws-ping pongs,
+// accept waits), so quantiles start over.
+func takeMetricsSnapshot(reset bool) metricsSnapshot {
+	load := func(c *atomic.Int64) int64 {
+		if reset {
+			return c.Swap(0)
+		}
+		return c.Load()
+	}
+	snap := metricsSnapshot{
+		Requests:           requestCounters.snapshot(reset),
+		Responses:          responseCounters.snapshot(reset),
+		Panics:             load(&panicCount),
+		SocketBytesRead:    load(&socketBytesRead),
+		SocketBytesWritten: load(&socketBytesWritten),
+		FlakyUpResponses:   load(&flakyUpResponses),
+		FlakyDownResponses: load(&flakyDownResponses),
+		ComputeCoalesced:   load(&computeCoalesced),
+		HashBytes:          load(&hashBytes),
+		RecordDropped:      load(&recordDropped),
+		AcceptBusyNs:       load(&acceptBusyNs),
+		WriteErrors:        load(&writeErrorsInjected),
+		DegradedRejected:   load(&degradedRejected),
+	}
+	for i := range acceptCounts {
+		snap.Accepts = append(snap.Accepts, load(&acceptCounts[i]))
+	}
+	if responseCache != nil {
+		snap.CacheHits = load(&responseCache.hits)
+		snap.CacheMisses = load(&responseCache.misses)
+	}
+	if reset {
+		flakyUp.Store(0)
+		wsPongLatency.reset()
+		acceptWait.reset()
+	}
+	return snap
+}
+
+// handleMetrics exports the counters in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := takeMetricsSnapshot(false)
+	routes := make([]string, 0, len(snap.Requests))
+	for route := range snap.Requests {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	var buf bytes.Buffer
+	buf.WriteString("# HELP go_bench_requests_total Requests handled, by route.\n")
+	buf.WriteString("# TYPE go_bench_requests_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(&buf, "go_bench_requests_total{route=%q} %d\n", route, snap.Requests[route])
+	}
+	responses := make([]string, 0, len(snap.Responses))
+	for key := range snap.Responses {
+		responses = append(responses, key)
+	}
+	sort.Strings(responses)
+	buf.WriteString("# HELP go_bench_responses_total Responses sent, by route and status class.\n")
+	buf.WriteString("# TYPE go_bench_responses_total counter\n")
+	for _, key := range responses {
+		i := strings.LastIndexByte(key, ' ')
+		fmt.Fprintf(&buf, "go_bench_responses_total{route=%q,class=%q} %d\n", key[:i], key[i+1:], snap.Responses[key])
+	}
+	buf.WriteString("# HELP go_bench_panics_total Handler panics recovered into 500 responses.\n")
+	buf.WriteString("# TYPE go_bench_panics_total counter\n")
+	fmt.Fprintf(&buf, "go_bench_panics_total %d\n", snap.Panics)
+	if responseCache != nil {
+		buf.WriteString("# HELP go_bench_response_cache_requests_total Response cache lookups, by result.\n")
+		buf.WriteString("# TYPE go_bench_response_cache_requests_total counter\n")
+		fmt.Fprintf(&buf, "go_bench_response_cache_requests_total{result=\"hit\"} %d\n", snap.CacheHits)
+		fmt.Fprintf(&buf, "go_bench_response_cache_requests_total{result=\"miss\"} %d\n", snap.CacheMisses)
+	}
+	if byteAccounting {
+		buf.WriteString("# HELP go_bench_socket_bytes_total Bytes read from and written to client sockets, framing included.\n")
+		buf.WriteString("# TYPE go_bench_socket_bytes_total counter\n")
+		fmt.Fprintf(&buf, "go_bench_socket_bytes_total{direction=\"read\"} %d\n", snap.SocketBytesRead)
+		fmt.Fprintf(&buf, "go_bench_socket_bytes_total{direction=\"written\"} %d\n", snap.SocketBytesWritten)
+	}
+	buf.WriteString("# HELP go_bench_flaky_up Whether the last /flaky response was in the healthy window.\n")
+	buf.WriteString("# TYPE go_bench_flaky_up gauge\n")
+	fmt.Fprintf(&buf, "go_bench_flaky_up %d\n", flakyUp.Load())
+	buf.WriteString("# HELP go_bench_flaky_responses_total /flaky responses, by window state.\n")
+	buf.WriteString("# TYPE go_bench_flaky_responses_total counter\n")
+	fmt.Fprintf(&buf, "go_bench_flaky_responses_total{state=\"up\"} %d\n", snap.FlakyUpResponses)
+	fmt.Fprintf(&buf, "go_bench_flaky_responses_total{state=\"down\"} %d\n", snap.FlakyDownResponses)
+	if coalesceCompute {
+		buf.WriteString("# HELP go_bench_compute_coalesced_total /compute requests answered from a concurrent identical computation.\n")
+		buf.WriteString("# TYPE go_bench_compute_coalesced_total counter\n")
+		fmt.Fprintf(&buf, "go_bench_compute_coalesced_total %d\n", snap.ComputeCoalesced)
+	}
+	buf.WriteString("# HELP go_bench_hash_bytes_total Request body bytes hashed by /hash.\n")
+	buf.WriteString("# TYPE go_bench_hash_bytes_total counter\n")
+	fmt.Fprintf(&buf, "go_bench_hash_bytes_total %d\n", snap.HashBytes)
+	if writeErrorRate > 0 {
+		buf.WriteString("# HELP go_bench_write_errors_injected_total Responses cut short by --inject-write-errors.\n")
+		buf.WriteString("# TYPE go_bench_write_errors_injected_total counter\n")
+		fmt.Fprintf(&buf, "go_bench_write_errors_injected_total %d\n", snap.WriteErrors)
+	}
+	if len(snap.Accepts) > 0 {
+		buf.WriteString("# HELP go_bench_accepts_total Connections accepted, by accept loop.\n")
+		buf.WriteString("# TYPE go_bench_accepts_total counter\n")
+		for i, n := range snap.Accepts {
+			fmt.Fprintf(&buf, "go_bench_accepts_total{loop=\"%d\"} %d\n", i, n)
+		}
+		buf.WriteString("# HELP go_bench_accept_loop_busy_seconds_total Time the accept loops spent handing off connections, outside Accept.\n")
+		buf.WriteString("# TYPE go_bench_accept_loop_busy_seconds_total counter\n")
+		fmt.Fprintf(&buf, "go_bench_accept_loop_busy_seconds_total %g\n", time.Duration(snap.AcceptBusyNs).Seconds())
+		p50, p99, count := acceptWait.quantiles()
+		buf.WriteString("# HELP go_bench_accept_wait_seconds Time blocked in Accept, over the last samples; near zero means connections queue for a busy loop.\n")
+		buf.WriteString("# TYPE go_bench_accept_wait_seconds summary\n")
+		fmt.Fprintf(&buf, "go_bench_accept_wait_seconds{quantile=\"0.5\"} %g\n", p50.Seconds())
+		fmt.Fprintf(&buf, "go_bench_accept_wait_seconds{quantile=\"0.99\"} %g\n", p99.Seconds())
+		fmt.Fprintf(&buf, "go_bench_accept_wait_seconds_count %d\n", count)
+	}
+	if recorder != nil {
+		buf.WriteString("# HELP go_bench_record_dropped_total Requests left out of the --record file because its queue was full.\n")
+		buf.WriteString("# TYPE go_bench_record_dropped_total counter\n")
+		fmt.Fprintf(&buf, "go_bench_record_dropped_total %d\n", snap.RecordDropped)
+	}
+	if memHighWatermark > 0 {
+		degraded := 0
+		if memDegraded.Load() {
+			degraded = 1
+		}
+		buf.WriteString("# HELP go_bench_degraded Whether memory pressure has the server shedding expensive routes.\n")
+		buf.WriteString("# TYPE go_bench_degraded gauge\n")
+		fmt.Fprintf(&buf, "go_bench_degraded %d\n", degraded)
+		buf.WriteString("# HELP go_bench_degraded_rejected_total Requests refused with 503 while degraded.\n")
+		buf.WriteString("# TYPE go_bench_degraded_rejected_total counter\n")
+		fmt.Fprintf(&buf, "go_bench_degraded_rejected_total %d\n", snap.DegradedRejected)
+	}
+	if wsPingInterval > 0 {
+		p50, p99, count := wsPongLatency.quantiles()
+		buf.WriteString("# HELP go_bench_ws_pong_latency_seconds Round trip of server pings on /ws-ping, over the last samples.\n")
+		buf.WriteString("# TYPE go_bench_ws_pong_latency_seconds summary\n")
+		fmt.Fprintf(&buf, "go_bench_ws_pong_latency_seconds{quantile=\"0.5\"} %g\n", p50.Seconds())
+		fmt.Fprintf(&buf, "go_bench_ws_pong_latency_seconds{quantile=\"0.99\"} %g\n", p99.Seconds())
+		fmt.Fprintf(&buf, "go_bench_ws_pong_latency_seconds_count %d\n", count)
+	}
+	// ReadMemStats briefly stops the world; once per scrape is negligible.
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	buf.WriteString("# HELP go_bench_heap_alloc_bytes Bytes of allocated heap objects.\n")
+	buf.WriteString("# TYPE go_bench_heap_alloc_bytes gauge\n")
+	fmt.Fprintf(&buf, "go_bench_heap_alloc_bytes %d\n", ms.HeapAlloc)
+	buf.WriteString("# HELP go_bench_next_gc_bytes Heap size target of the next GC cycle.\n")
+	buf.WriteString("# TYPE go_bench_next_gc_bytes gauge\n")
+	fmt.Fprintf(&buf, "go_bench_next_gc_bytes %d\n", ms.NextGC)
+	buf.WriteString("# HELP go_bench_gc_pause_ns_total Cumulative stop-the-world GC pause time.\n")
+	buf.WriteString("# TYPE go_bench_gc_pause_ns_total counter\n")
+	fmt.Fprintf(&buf, "go_bench_gc_pause_ns_total %d\n", ms.PauseTotalNs)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// handleResetMetrics zeroes every counter atomically and returns the values
+// they held, so a harness can separate warm-up from the measured phase.
+func handleResetMetrics(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(takeMetricsSnapshot(true))
+	if err != nil {
+		http.Error(w, "Failed to encode metrics", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// newAdminMux builds the handler of the optional --admin-port listener, which
+// hosts endpoints that must stay off the benchmarked port.
+func newAdminMux(server *http.Server, port int) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/env", newEnvHandler(server, port))
+	mux.HandleFunc("POST /admin/reset-sequence", handleResetSequence)
+	mux.HandleFunc("POST /admin/reset-metrics", handleResetMetrics)
+	mux.HandleFunc("/gc", handleGC)
+	mux.HandleFunc("POST /admin/profile/cpu", handleCPUProfile)
+	mux.HandleFunc("GET /admin/profile/heap", handleHeapProfile)
+	return mux
+}
+
+// newEnvHandler reports the fully resolved server configuration so a harness
+// can record it alongside benchmark results. TLS key paths are redacted.
+func newEnvHandler(server *http.Server, port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type envResponse struct {
+			Port               int    `json:"port"`
+			AdminPort          int    `json:"admin_port"`
+			Threads            int    `json:"threads"`
+			GOMAXPROCS         int    `json:"gomaxprocs"`
+			ReadTimeout        string `json:"read_timeout"`
+			ReadHeaderTimeout  string `json:"read_header_timeout"`
+			WriteTimeout       string `json:"write_timeout"`
+			IdleTimeout        string `json:"idle_timeout"`
+			MaxHeaderBytes     int    `json:"max_header_bytes"`
+			H2                 bool   `json:"h2"`
+			TLS                bool   `json:"tls"`
+			TLSCert            string `json:"tls_cert,omitempty"`
+			TLSKey             string `json:"tls_key,omitempty"`
+			TLSSessionTickets  bool   `json:"tls_session_tickets"`
+			StaticDir          string `json:"static_dir,omitempty"`
+			EmbeddedStatic     bool   `json:"embedded_static"`
+			Routes             int    `json:"routes"`
+			PatternRoutes      int    `json:"pattern_routes"`
+			Metrics            bool   `json:"metrics"`
+			FlushAfterWrite    bool   `json:"flush_after_write"`
+			MaxRequestsPerConn int    `json:"max_requests_per_conn"`
+			ResponseBuffer     int    `json:"response_buffer_size"`
+			ConfigFile         string `json:"config_file,omitempty"`
+			Seed               *int64 `json:"seed"`
+			GoVersion          string `json:"go_version"`
+		}
+		resp := envResponse{
+			Port:               port,
+			AdminPort:          adminPort,
+			Threads:            numThreads,
+			GOMAXPROCS:         runtime.GOMAXPROCS(0),
+			ReadTimeout:        server.ReadTimeout.String(),
+			ReadHeaderTimeout:  server.ReadHeaderTimeout.String(),
+			WriteTimeout:       server.WriteTimeout.String(),
+			IdleTimeout:        server.IdleTimeout.String(),
+			MaxHeaderBytes:     server.MaxHeaderBytes,
+			H2:                 h2Enabled,
+			TLS:                tlsEnabled,
+			TLSCert:            certFile,
+			TLSSessionTickets:  tlsSessionTickets,
+			StaticDir:          staticDir,
+			EmbeddedStatic:     staticDir == "" && embeddedStatic,
+			Routes:             routeCount,
+			PatternRoutes:      patternRouteCount,
+			Metrics:            metricsEnabled,
+			FlushAfterWrite:    flushAfterWrite,
+			MaxRequestsPerConn: maxRequestsPerConn,
+			ResponseBuffer:     responseBufferSize,
+			ConfigFile:         configFile,
+			GoVersion:          runtime.Version(),
+		}
+		if keyFile != "" {
+			resp.TLSKey = "[redacted]"
+		}
+		if seededRand != nil {
+			resp.Seed = &seed
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// overridableMethods lists the methods a POST may be rewritten to.
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	http.MethodPatch:  true,
+}
+
+// withMethodOverride lets GET/POST-only clients reach method-aware routes: a
+// POST carrying X-HTTP-Method-Override is dispatched as the given method.
+func withMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && r.Method == http.MethodPost {
+			method := strings.ToUpper(strings.TrimSpace(override))
+			if !overridableMethods[method] {
+				http.Error(w, "Unsupported X-HTTP-Method-Override", http.StatusBadRequest)
+				return
+			}
+			r.Method = method
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// paddingValue backs every X-Padding header: values are slices of one
+// --max-header-bytes string, built on first use.
+var (
+	paddingOnce  sync.Once
+	paddingValue string
+)
+
+// withPadding adds an X-Padding header of pad bytes to the response of any
+// route, to push a client's header parsing to a target size without the full
+// /headers generator. A pad above --max-header-bytes is answered with 400.
+func withPadding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" {
+			if v := queryValues(r).Get("pad"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 || n > maxHeaderBytes {
+					http.Error(w, fmt.Sprintf("pad must be in [0,%d]", maxHeaderBytes), http.StatusBadRequest)
+					return
+				}
+				paddingOnce.Do(func() { paddingValue = strings.Repeat("p", maxHeaderBytes) })
+				w.Header()["X-Padding"] = []string{paddingValue[:n]}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRecovery turns handler panics into a clean 500 carrying the request ID.
+// Without it net/http logs the panic and closes the connection, which skews
+// keep-alive statistics. http.ErrAbortHandler keeps its abort semantics.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			addCounter(&panicCount, 1)
+			id := requestID(r)
+			slog.Error("panic serving request", "method", r.Method, "path", r.URL.Path, "request_id", id, "panic", rec)
+			panicStackOnce.Do(func() {
+				slog.Error("first panic stack", "stack", string(debug.Stack()))
+			})
+			w.Header().Set("X-Request-ID", id)
+			http.Error(w, "Internal Server Error (request "+id+")", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errInjectedWrite is returned by writes failed on purpose by withWriteErrors.
+var errInjectedWrite = errors.New("injected write error")
+
+// maxInjectedWriteCut bounds the bytes a failing response writes first.
+const maxInjectedWriteCut = 64 * 1024
+
+// withWriteErrors fails the response writes of a fraction rate of requests
+// (--inject-write-errors), as a connection dropping mid-response would: the
+// first n bytes, n uniform in [0,64KB), go out and every write from there on
+// returns errInjectedWrite. Once the handler returns the connection is
+// aborted, so even a chunked response stays visibly truncated on the client.
+// It sits right around the router, below withRecovery, so handlers see the
+// errors on their own writes.
+func withWriteErrors(next http.Handler, rate float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fw := &failingWriter{ResponseWriter: w, remaining: rand.Intn(maxInjectedWriteCut)}
+		next.ServeHTTP(fw, r)
+		if !fw.failed {
+			return
+		}
+		addCounter(&writeErrorsInjected, 1)
+		slog.Debug("injected write error", "method", r.Method, "path", r.URL.Path, "written", fw.written)
+		panic(http.ErrAbortHandler)
+	})
+}
+
+// failingWriter passes through the first remaining bytes, then fails.
+type failingWriter struct {
+	http.ResponseWriter
+	remaining int
+	written   int
+	failed    bool
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.failed {
+		return 0, errInjectedWrite
+	}
+	if len(p) <= fw.remaining {
+		n, err := fw.ResponseWriter.Write(p)
+		fw.remaining -= n
+		fw.written += n
+		return n, err
+	}
+	n, _ := fw.ResponseWriter.Write(p[:fw.remaining])
+	fw.written += n
+	fw.failed = true
+	return n, errInjectedWrite
+}
+
+func (fw *failingWriter) Unwrap() http.ResponseWriter { return fw.ResponseWriter }
+
+// withReadiness answers every request but the readinessExempt ones with 503
+// and Retry-After while the server is not ready (notReady), so benchmarks
+// never measure a cold start. It is installed only when startup has work to
+// finish in the background, such as --preload-static; the listener accepts
+// meanwhile, so TCP-level benchmarks are unaffected.
+func withReadiness(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := notReady.Load(); reason != nil && !readinessExempt[r.URL.Path] {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Not ready: "+*reason, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readinessExempt are the health, metrics and introspection routes, which
+// monitoring must reach during a cold start too.
+var readinessExempt = map[string]bool{
+	"/readyz":      true,
+	"/status":      true,
+	"/health/deep": true,
+	"/metrics":     true,
+	"/version":     true,
+	"/_routes":     true,
+}
+
+// degradedBodySize is the smallest /body size shed while degraded.
+const degradedBodySize = 64 * 1024
+
+// monitorMemory reads the heap size every interval for updateMemDegraded.
+// ReadMemStats stops the world for a moment, hence an interval rather than a
+// check per request.
+func monitorMemory(high, low uint64, interval time.Duration) {
+	var ms runtime.MemStats
+	for range time.Tick(interval) {
+		runtime.ReadMemStats(&ms)
+		updateMemDegraded(ms.HeapAlloc, high, low)
+	}
+}
+
+// updateMemDegraded sets memDegraded once heap passes high and clears it only
+// when heap falls below low again, so a heap hovering around one threshold
+// does not flap.
+func updateMemDegraded(heap, high, low uint64) {
+	switch {
+	case !memDegraded.Load() && heap > high:
+		memDegraded.Store(true)
+		slog.Warn("memory pressure, shedding expensive routes", "heap_alloc", heap, "high_watermark", high)
+	case memDegraded.Load() && heap < low:
+		memDegraded.Store(false)
+		slog.Info("memory pressure over, serving every route", "heap_alloc", heap, "low_watermark", low)
+	}
+}
+
+// expensiveRequest reports whether r is one shed while degraded: /compute,
+// /upload and /body of degradedBodySize bytes or more.
+func expensiveRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/compute", "/upload":
+		return true
+	case "/body":
+		return getQueryInt(r, "size", 1024) >= degradedBodySize
+	}
+	return false
+}
+
+// withMemoryShedding answers expensive requests with 503 and Retry-After
+// while memDegraded is set (--mem-high-watermark). Everything else, /ping
+// and the health probes included, is served as usual.
+func withMemoryShedding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if memDegraded.Load() && expensiveRequest(r) {
+			addCounter(&degradedRejected, 1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service degraded: memory pressure", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the client's X-Request-ID, or a server-generated one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	return "go-" + strconv.FormatUint(requestIDCounter.Add(1), 10)
+}
+
+// withChaos injects failures requested through the `_fail` query parameter:
+//
+//	_fail=timeout   sleep past the request deadline (or WriteTimeout)
+//	_fail=500       respond 500 without running the handler
+//	_fail=panic     panic, recovered by withRecovery like a handler panic
+//	_fail=slow=MS   add MS milliseconds of latency, then run the handler
+//
+// It is only installed with --chaos.
+func withChaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fail := queryValues(r).Get("_fail")
+		switch {
+		case fail == "":
+		case fail == "timeout":
+			sleep := writeTimeout + time.Second
+			if deadline, ok := r.Context().Deadline(); ok {
+				sleep = time.Until(deadline) + 100*time.Millisecond
+			}
+			// Keep sleeping after a TimeoutHandler cancels the context: the
+			// point is to overrun the deadline, not to honor it.
+			time.Sleep(sleep)
+			http.Error(w, "Chaos: deadline overrun", http.StatusGatewayTimeout)
+			return
+		case fail == "500":
+			http.Error(w, "Chaos: injected failure", http.StatusInternalServerError)
+			return
+		case fail == "panic":
+			// withChaos sits outside withRecovery, so the panic is raised
+			// inside a wrapper of its own to be counted and logged.
+			withRecovery(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				panic("chaos: injected panic")
+			})).ServeHTTP(w, r)
+			return
+		case strings.HasPrefix(fail, "slow="):
+			ms, err := strconv.Atoi(strings.TrimPrefix(fail, "slow="))
+			if err != nil || ms < 0 {
+				http.Error(w, "Invalid _fail=slow value", http.StatusBadRequest)
+				return
+			}
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		default:
+			http.Error(w, "Unknown _fail mode", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cachedResponse is a complete response stored by withResponseCache.
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// lruCache is a mutex-guarded LRU of cached responses.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front = most recently used, values are *cachedResponse
+	entries  map[string]*list.Element
+	hits     atomic.Int64
+	misses   atomic.Int64
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedResponse)
+	if now.After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *lruCache) put(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// cacheableStatus reports whether a status may be served from the cache.
+func cacheableStatus(code int) bool {
+	switch code {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// recordQueueSize bounds the requests waiting to be written by --record.
+const recordQueueSize = 4096
+
+// recordedRequest is one line of the --record file, newline-delimited JSON:
+//
+//	{"time":"2024-05-01T12:00:00.123456789Z","remote_addr":"127.0.0.1:51234",
+//	 "method":"POST","target":"/upload?x=1","proto":"HTTP/1.1","host":"localhost:8080",
+//	 "headers":{"Content-Type":["text/plain"]},"body":"aGVsbG8=","body_size":5}
+//
+// target is the request-target as sent and headers are as received, before
+// any middleware rewrote them. body is base64 and holds what the handler
+// read, so a body the handler ignored is recorded empty. Only the first
+// --record-body-max bytes (default 64KB) are kept: body_size counts all of
+// them and body_truncated marks the cut.
+type recordedRequest struct {
+	Time          time.Time           `json:"time"`
+	RemoteAddr    string              `json:"remote_addr"`
+	Method        string              `json:"method"`
+	Target        string              `json:"target"`
+	Proto         string              `json:"proto"`
+	Host          string              `json:"host"`
+	Headers       map[string][]string `json:"headers"`
+	Body          []byte              `json:"body,omitempty"`
+	BodySize      int64               `json:"body_size"`
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+}
+
+// requestRecorder writes recordedRequests from a single goroutine through a
+// buffered writer, flushing whenever its queue runs empty. Handing over a
+// record never blocks: when the queue is full the record is dropped and
+// counted, so a slow disk cannot stall the benchmark.
+type requestRecorder struct {
+	records chan *recordedRequest
+	bodyMax int
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newRequestRecorder(w io.WriteCloser, queue, bodyMax int) *requestRecorder {
+	rr := &requestRecorder{
+		records: make(chan *recordedRequest, queue),
+		bodyMax: bodyMax,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go rr.run(w)
+	return rr
+}
+
+func (rr *requestRecorder) run(w io.WriteCloser) {
+	defer close(rr.done)
+	defer w.Close()
+	bw := bufio.NewWriterSize(w, 64*1024)
+	enc := json.NewEncoder(bw)
+	write := func(rec *recordedRequest) {
+		if err := enc.Encode(rec); err != nil {
+			slog.Warn("record write failed", "err", err)
+		}
+	}
+	for {
+		select {
+		case rec := <-rr.records:
+			write(rec)
+			if len(rr.records) == 0 {
+				bw.Flush()
+			}
+		case <-rr.stop:
+			for {
+				select {
+				case rec := <-rr.records:
+					write(rec)
+				default:
+					bw.Flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (rr *requestRecorder) record(rec *recordedRequest) {
+	select {
+	case rr.records <- rec:
+	default:
+		addCounter(&recordDropped, 1)
+	}
+}
+
+// close writes out the queued records and closes the file. Records handed
+// over afterwards are never written.
+func (rr *requestRecorder) close() {
+	close(rr.stop)
+	<-rr.done
+}
+
+// captureBody keeps the first max bytes read through it and counts the rest.
+type captureBody struct {
+	io.ReadCloser
+	max  int
+	buf  []byte
+	size int64
+}
+
+func (cb *captureBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if keep := min(n, cb.max-len(cb.buf)); keep > 0 {
+		cb.buf = append(cb.buf, p[:keep]...)
+	}
+	cb.size += int64(n)
+	return n, err
+}
+
+// withRecording hands every request to rr once it has been served (--record).
+// The body is captured as the handler reads it rather than up front, so
+// recording neither changes when the body is read nor sends an early
+// 100 Continue.
+func withRecording(next http.Handler, rr *requestRecorder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &recordedRequest{
+			Time:       time.Now(),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Target:     r.RequestURI,
+			Proto:      r.Proto,
+			Host:       r.Host,
+			Headers:    r.Header.Clone(),
+		}
+		var cb *captureBody
+		if r.Body != nil && r.Body != http.NoBody {
+			cb = &captureBody{ReadCloser: r.Body, max: rr.bodyMax}
+			r.Body = cb
+		}
+		next.ServeHTTP(w, r)
+		if cb != nil {
+			rec.Body, rec.BodySize = cb.buf, cb.size
+			rec.BodyTruncated = cb.size > int64(len(cb.buf))
+		}
+		rr.record(rec)
+	})
+}
+
+// withResponseCache serves GET requests to cacheableRoutes from an in-memory
+// LRU keyed by method, path and query, isolating handler cost from serving
+// cost. Responses larger than --response-cache-max-entry or with uncacheable
+// status codes are passed through without being stored. Headers already set
+// by outer middleware take precedence over cached ones.
+func withResponseCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !cacheableRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery
+		now := time.Now()
+		if entry, ok := responseCache.get(key, now); ok {
+			addCounter(&responseCache.hits, 1)
+			for name, values := range entry.header {
+				if _, exists := w.Header()[name]; !exists {
+					w.Header()[name] = values
+				}
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(entry.status)
+			_, _ = w.Write(entry.body)
+			return
+		}
+		addCounter(&responseCache.misses, 1)
+		w.Header().Set("X-Cache", "MISS")
+		// Outer wrappers may already have set per-connection fields such as
+		// X-Handshake-Ms; only what the handler adds belongs in the entry.
+		preset := make(map[string]bool, len(w.Header()))
+		for name := range w.Header() {
+			preset[name] = true
+		}
+		cr := &cacheRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cr, r)
+		if cr.overflow || !cacheableStatus(cr.status) {
+			return
+		}
+		header := make(http.Header, len(w.Header()))
+		for name, values := range w.Header() {
+			if !preset[name] {
+				header[name] = slices.Clone(values)
+			}
+		}
+		header.Del("Connection")
+		responseCache.put(&cachedResponse{key: key, status: cr.status, header: header, body: cr.body, expires: now.Add(responseCacheTTL)})
+	})
+}
+
+// cacheRecorder passes a response through while keeping a copy of its body,
+// up to --response-cache-max-entry bytes.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     []byte
+	overflow bool
+}
+
+func (cr *cacheRecorder) WriteHeader(code int) {
+	if code >= 200 {
+		cr.status = code
+	}
+	cr.ResponseWriter.WriteHeader(code)
+}
+
+func (cr *cacheRecorder) Write(p []byte) (int, error) {
+	if !cr.overflow {
+		if len(cr.body)+len(p) > responseCacheMaxEntry {
+			cr.overflow, cr.body = true, nil
+		} else {
+			cr.body = append(cr.body, p...)
+		}
+	}
+	return cr.ResponseWriter.Write(p)
+}
+
+func (cr *cacheRecorder) Flush() {
+	_ = http.NewResponseController(cr.ResponseWriter).Flush()
+}
+
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
+
+// listHeaders are the request fields defined with list syntax (RFC 9110
+// section 5.6.1), whose field lines may be joined with ", " without changing
+// their meaning (section 5.3).
+var listHeaders = map[string]bool{
+	"Accept":            true,
+	"Accept-Charset":    true,
+	"Accept-Encoding":   true,
+	"Accept-Language":   true,
+	"Cache-Control":     true,
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Expect":            true,
+	"If-Match":          true,
+	"If-None-Match":     true,
+	"Pragma":            true,
+	"Prefer":            true,
+	"TE":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Via":               true,
+}
+
+// singletonHeaders are request fields that admit a single value, so more than
+// one field line makes the request invalid.
+//
+// Content-Length and Host are left out because net/http settles them before
+// any handler runs: it answers 400 to a repeated Host or to Content-Length
+// lines with differing values, and merges Content-Length lines repeating one
+// value into one, so such a request is served with no way to tell (RFC 9110
+// section 8.6 allows either). Catching that case would take a connection
+// level parser ahead of net/http.
+var singletonHeaders = map[string]bool{
+	"Authorization":       true,
+	"Content-Type":        true,
+	"Date":                true,
+	"From":                true,
+	"If-Modified-Since":   true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Max-Forwards":        true,
+	"Proxy-Authorization": true,
+	"Range":               true,
+	"Referer":             true,
+	"User-Agent":          true,
+}
+
+// normalizeHeader returns a copy of h in which every list-based field has its
+// lines comma-merged into one value and Cookie lines are joined with "; "
+// (RFC 9113 section 8.2.3 splits them, RFC 6265 section 5.4 wants one).
+// Other fields keep their lines as received, since merging is only defined for
+// lists. A singleton field with more than one line is an error.
+func normalizeHeader(h http.Header) (http.Header, error) {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		switch {
+		case len(values) < 2:
+			out[name] = slices.Clone(values)
+		case singletonHeaders[name]:
+			return nil, fmt.Errorf("repeated %s header", name)
+		case name == "Cookie":
+			out[name] = []string{strings.Join(values, "; ")}
+		case listHeaders[name]:
+			out[name] = []string{headerValue(h, name)}
+		default:
+			out[name] = slices.Clone(values)
+		}
+	}
+	return out, nil
+}
+
+// headerValue returns the combined value of a list-based request field, for
+// negotiation that must see every field line rather than just the first.
+// Empty list elements are dropped, as RFC 9110 section 5.6.1 allows.
+func headerValue(h http.Header, name string) string {
+	values := h.Values(name)
+	if len(values) < 2 {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// withMaxHeaderValueSize rejects requests carrying any single header value
+// longer than limit bytes with 431, before any handler can reflect it.
+// MaxHeaderBytes only bounds the header section as a whole.
+func withMaxHeaderValueSize(next http.Handler, limit int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.Header {
+			for _, value := range values {
+				if len(value) > limit {
+					w.Header().Set("Connection", "close")
+					http.Error(w, "Request Header Fields Too Large: "+name, http.StatusRequestHeaderFieldsTooLarge)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenTCP opens the main listener. net.ListenConfig.Control runs before
+// listen(2), when Go always passes the kernel's somaxconn, so --backlog instead
+// calls listen(2) again on the bound socket: Linux and the BSDs update the
+// queue length of a listening socket in place. Where that fails the listener
+// silently keeps the default backlog. --tcp-fastopen is set from Control; a
+// failure there is kept in tcpFastOpenErr rather than failing the listen.
+// With --accept-loops above 1 Control also sets SO_REUSEPORT, without which
+// the second listener could not bind.
+func listenTCP(addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tcpFastOpenQueue > 0 || acceptLoops > 1 || ipVersion == "dual" {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			if ipVersion == "dual" {
+				if err := clearV6Only(c); err != nil {
+					return fmt.Errorf("--ip-version dual: %w", err)
+				}
+			}
+			if acceptLoops > 1 {
+				if err := enableReusePort(c); err != nil {
+					return fmt.Errorf("--accept-loops: %w", err)
+				}
+			}
+			if tcpFastOpenQueue > 0 {
+				tcpFastOpenErr = enableTCPFastOpen(c, tcpFastOpenQueue)
+			}
+			return nil
+		}
+	}
+	ln, err := lc.Listen(context.Background(), listenNetwork(), addr)
+	if err != nil || listenBacklog <= 0 {
+		return ln, err
+	}
+	if tl, ok := ln.(*net.TCPListener); ok {
+		if raw, err := tl.SyscallConn(); err == nil {
+			raw.Control(func(fd uintptr) {
+				syscall.Listen(int(fd), listenBacklog)
+			})
+		}
+	}
+	return ln, nil
+}
+
+// resolveListenHost returns the address the main listener binds for an
+// --ip-version: host, the --listen-addr, when given, else 127.0.0.1 for 4, ::1
+// for 6 and the :: wildcard for dual. host must be an IP literal of the
+// version's family; dual-stack only exists on ::, where one IPv6 socket also
+// takes IPv4 connections as v4-mapped addresses.
+func resolveListenHost(version, host string) (string, error) {
+	defaults := map[string]string{"4": "127.0.0.1", "6": "::1", "dual": "::"}
+	def, ok := defaults[version]
+	if !ok {
+		return "", fmt.Errorf("unknown --ip-version %q (use 4, 6 or dual)", version)
+	}
+	if host == "" {
+		return def, nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", fmt.Errorf("--listen-addr %q is not an IP address", host)
+	}
+	switch {
+	case version == "4" && !addr.Is4():
+		return "", fmt.Errorf("--listen-addr %s is not an IPv4 address", host)
+	case version == "6" && (!addr.Is6() || addr.Is4In6()):
+		return "", fmt.Errorf("--listen-addr %s is not an IPv6 address", host)
+	case version == "dual" && addr != netip.IPv6Unspecified():
+		return "", fmt.Errorf("--listen-addr %s cannot be dual-stack, only :: is", host)
+	}
+	return addr.String(), nil
+}
+
+// listenNetwork returns the net.Listen network of --ip-version. Go sets
+// IPV6_V6ONLY on tcp6 sockets, so 6 never accepts IPv4; dual uses tcp and
+// clears IPV6_V6ONLY itself rather than rely on Go's choice for wildcards.
+func listenNetwork() string {
+	switch ipVersion {
+	case "6":
+		return "tcp6"
+	case "dual":
+		return "tcp"
+	}
+	return "tcp4"
+}
+
+// clearV6Only lets an IPv6 socket also accept IPv4 connections.
+func clearV6Only(c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// tcpFastOpenLinux and soReusePortLinux are TCP_FASTOPEN and SO_REUSEPORT on
+// Linux, which the syscall package does not define on every architecture.
+const (
+	tcpFastOpenLinux = 0x17
+	soReusePortLinux = 0xf
+)
+
+// enableReusePort sets SO_REUSEPORT so several listeners bind one port and
+// the kernel spreads incoming connections over them. Only Linux is supported.
+func enableReusePort(c syscall.RawConn) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("SO_REUSEPORT unsupported on %s", runtime.GOOS)
+	}
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePortLinux, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// tcpFastOpenErr records why --tcp-fastopen could not be enabled, if it could
+// not.
+var tcpFastOpenErr error
+
+// enableTCPFastOpen sets TCP_FASTOPEN with a pending-SYN queue of qlen on a
+// socket about to listen, letting clients with a Fast Open cookie send the
+// request in their SYN and save a round trip. Only Linux is supported.
+func enableTCPFastOpen(c syscall.RawConn, qlen int) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("unsupported on %s", runtime.GOOS)
+	}
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenLinux, qlen)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// logTCPFastOpen reports at startup whether --tcp-fastopen took effect. The
+// socket option alone is not enough on Linux: net.ipv4.tcp_fastopen must also
+// have its server bit (0x2) set, and it defaults to client-only (1).
+func logTCPFastOpen(err error) {
+	if err != nil {
+		slog.Warn("tcp fast open not enabled", "err", err)
+		return
+	}
+	data, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		slog.Info("tcp fast open enabled", "queue", tcpFastOpenQueue)
+		return
+	}
+	mode, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	if mode&0x2 == 0 {
+		slog.Warn("tcp fast open set on the listener but disabled for servers by the kernel; set net.ipv4.tcp_fastopen=3",
+			"net.ipv4.tcp_fastopen", mode)
+		return
+	}
+	slog.Info("tcp fast open enabled", "queue", tcpFastOpenQueue, "net.ipv4.tcp_fastopen", mode)
+}
+
+// acceptStatsListener feeds the accept metrics of one accept loop (--metrics).
+// net/http calls Accept from a single goroutine per listener, so returned
+// needs no lock.
+type acceptStatsListener struct {
+	net.Listener
+	loop     int
+	returned time.Time
+}
+
+func (l *acceptStatsListener) Accept() (net.Conn, error) {
+	start := time.Now()
+	if !l.returned.IsZero() {
+		addCounter(&acceptBusyNs, int64(start.Sub(l.returned)))
+	}
+	c, err := l.Listener.Accept()
+	l.returned = time.Now()
+	acceptWait.add(l.returned.Sub(start))
+	if err == nil {
+		addCounter(&acceptCounts[l.loop], 1)
+	}
+	return c, err
+}
+
+// rampListener throttles Accept to a fixed rate until a deadline after
+// startup (--accept-ramp, --accept-ramp-rate), then accepts freely. Waiting
+// happens before Accept, so pending connections queue in the kernel backlog
+// as they would on a server still coming up. With --accept-loops the loops
+// share one limiter.
+type rampListener struct {
+	net.Listener
+	until   time.Time
+	limiter *rate.Limiter
+}
+
+func (l *rampListener) Accept() (net.Conn, error) {
+	if remaining := time.Until(l.until); remaining > 0 {
+		// Never wait past the end of the ramp.
+		time.Sleep(min(l.limiter.Reserve().Delay(), remaining))
+	}
+	return l.Listener.Accept()
+}
+
+// proxyHeaderTimeout bounds how long a peer may take to send its PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature opens every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener requires a PROXY protocol v1 or v2 header on every
+// connection (--proxy-protocol) and reports the source address it carries as
+// RemoteAddr, so r.RemoteAddr is the real client behind a load balancer.
+// Headers are read off the accept loop: a slow or silent peer cannot stall
+// other connections. Connections with a missing or malformed header are
+// closed.
+type proxyProtoListener struct {
+	net.Listener
+	timeout   time.Duration
+	conns     chan net.Conn
+	err       chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyProtoListener(ln net.Listener, timeout time.Duration) *proxyProtoListener {
+	l := &proxyProtoListener{
+		Listener: ln,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop retries failed accepts with a backoff from 5ms to 1s, as
+// net/http's Serve does, so a transient EMFILE does not end the listener. It
+// stops only once the listener is closed.
+func (l *proxyProtoListener) acceptLoop() {
+	var delay time.Duration
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.err <- err
+				return
+			}
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			slog.Warn("proxy protocol accept failed, retrying", "error", err, "delay", delay)
+			select {
+			case <-time.After(delay):
+			case <-l.done:
+			}
+			continue
+		}
+		delay = 0
+		go func() {
+			pc, err := readProxyHeader(c, l.timeout)
+			if err != nil {
+				slog.Debug("proxy protocol", "remote", c.RemoteAddr().String(), "error", err)
+				c.Close()
+				return
+			}
+			select {
+			case l.conns <- pc:
+			case <-l.done:
+				pc.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		l.err <- err // keep reporting it to later callers
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close also releases the connections whose header was read but that no
+// Accept has taken yet.
+func (l *proxyProtoListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxyProtoConn serves reads from the reader that consumed the PROXY header,
+// so bytes buffered past it are not lost.
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *proxyProtoConn) NetConn() net.Conn { return c.Conn }
+
+// readProxyHeader consumes the PROXY header at the start of c. A v1
+// "UNKNOWN" or v2 LOCAL header (health checks from the proxy itself) keeps
+// the connection's own address.
+func readProxyHeader(c net.Conn, timeout time.Duration) (*proxyProtoConn, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+	pc := &proxyProtoConn{Conn: c, r: bufio.NewReader(c), remote: c.RemoteAddr()}
+	sig, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		err = pc.readV2()
+	} else {
+		err = pc.readV1()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 parses "PROXY TCP4|TCP6 <src> <dst> <srcport> <dstport>\r\n",
+// at most 107 bytes.
+func (c *proxyProtoConn) readV1() error {
+	const maxV1Header = 107
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1Header {
+			return errors.New("v1 header too long")
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errors.New("missing PROXY header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("unsupported v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return errors.New("malformed v1 header")
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port)))
+	return nil
+}
+
+// readV2 parses the binary header: signature, version/command, family and
+// protocol, payload length, then the addresses. TLVs after the addresses are
+// skipped.
+func (c *proxyProtoConn) readV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return fmt.Errorf("reading v2 header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return fmt.Errorf("reading v2 addresses: %w", err)
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("unsupported v2 command %d", hdr[12]&0x0f)
+	}
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		// UDP and unix sockets carry no usable TCP peer address.
+		return nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return errors.New("truncated v2 addresses")
+	}
+	ip, _ := netip.AddrFromSlice(payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port))
+	return nil
+}
+
+// effectiveBacklog reports the accept queue length the kernel applies for a
+// requested backlog: Linux silently clamps it to net.core.somaxconn. Other
+// platforms are reported as requested.
+func effectiveBacklog(requested int) int {
+	data, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return requested
+	}
+	if limit, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && limit < requested {
+		return limit
+	}
+	return requested
+}
+
+// teGzipMarker is the header teGzipConn substitutes for a "gzip, chunked"
+// Transfer-Encoding; withTransferGzip consumes it. Client-sent copies are
+// stripped so it cannot be spoofed.
+const teGzipMarker = "X-Bench-Transfer-Coding"
+
+// teGzipListener lets clients send "Transfer-Encoding: gzip, chunked"
+// (--te-gzip), which net/http rejects with 501 before any handler runs.
+type teGzipListener struct {
+	net.Listener
+}
+
+func (l teGzipListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &teGzipConn{Conn: c}, nil
+}
+
+// States of the teGzipConn request framing tracker.
+const (
+	teStateHeaders = iota
+	teStateBody
+	teStateChunkSize
+	teStateChunkData
+	teStateTrailer
+	teStatePassthrough
+)
+
+// teGzipConn tracks HTTP/1 request framing on the bytes net/http reads so it
+// can find every header block, and rewrites a "gzip, chunked"
+// Transfer-Encoding to "chunked" plus teGzipMarker. Bodies are forwarded
+// untouched. Anything it does not understand (HTTP/2 prior knowledge,
+// upgrades, malformed framing) switches it to passthrough, leaving net/http to
+// reject or handle the bytes as usual.
+type teGzipConn struct {
+	net.Conn
+	in        []byte // read from the socket, not yet processed
+	out       []byte // processed, not yet returned by Read
+	state     int
+	remaining int64 // bytes left in a Content-Length body or chunk (with its CRLF)
+	afterBody int   // state to enter once the current request body ends
+	err       error // returned once c.in is drained as far as possible
+	buf       [4096]byte
+}
+
+func (c *teGzipConn) Read(p []byte) (int, error) {
+	for {
+		if len(c.out) > 0 {
+			n := copy(p, c.out)
+			c.out = c.out[n:]
+			return n, nil
+		}
+		if c.state == teStatePassthrough && len(c.in) == 0 && c.err == nil {
+			return c.Conn.Read(p)
+		}
+		if c.process() {
+			continue
+		}
+		if err := c.err; err != nil {
+			// Deadline errors are transient: net/http uses them to interrupt
+			// its background read and then keeps reading.
+			c.err = nil
+			return 0, err
+		}
+		n, err := c.Conn.Read(c.buf[:])
+		c.in = append(c.in, c.buf[:n]...)
+		c.err = err
+	}
+}
+
+// NetConn returns the wrapped connection.
+func (c *teGzipConn) NetConn() net.Conn { return c.Conn }
+
+// process moves as much of c.in to c.out as the framing allows and reports
+// whether it made progress.
+func (c *teGzipConn) process() bool {
+	switch c.state {
+	case teStateHeaders:
+		// net/http skips stray CRLFs after a POST body; forward them as is.
+		if n := len(c.in) - len(bytes.TrimLeft(c.in, "\r\n")); n > 0 {
+			c.out, c.in = c.in[:n], c.in[n:]
+			return true
+		}
+		end := headerBlockEnd(c.in)
+		if end < 0 {
+			if len(c.in) > 512*1024 || (c.err != nil && len(c.in) > 0) {
+				c.state = teStatePassthrough
+				return true
+			}
+			return false
+		}
+		block := c.in[:end]
+		c.in = c.in[end:]
+		c.out = c.rewriteHeaders(block)
+		return true
+	case teStateBody, teStateChunkData:
+		n := int64(len(c.in))
+		if n == 0 {
+			return false
+		}
+		if n > c.remaining {
+			n = c.remaining
+		}
+		c.out, c.in = c.in[:n], c.in[n:]
+		if c.remaining -= n; c.remaining == 0 {
+			if c.state == teStateBody {
+				c.state = c.afterBody
+			} else {
+				c.state = teStateChunkSize
+			}
+		}
+		return true
+	case teStateChunkSize, teStateTrailer:
+		eol := bytes.IndexByte(c.in, '\n')
+		if eol < 0 {
+			if len(c.in) > 4096 || (c.err != nil && len(c.in) > 0) {
+				c.state = teStatePassthrough
+				return true
+			}
+			return false
+		}
+		line := c.in[:eol+1]
+		c.out, c.in = line, c.in[eol+1:]
+		if c.state == teStateTrailer {
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				c.state = c.afterBody
+			}
+			return true
+		}
+		size, ok := parseChunkSize(line)
+		switch {
+		case !ok:
+			c.state = teStatePassthrough
+		case size == 0:
+			c.state = teStateTrailer
+		default:
+			c.state, c.remaining = teStateChunkData, size+2
+		}
+		return true
+	case teStatePassthrough:
+		if len(c.in) == 0 {
+			return false
+		}
+		c.out, c.in = c.in, nil
+		return true
+	}
+	return false
+}
+
+// headerBlockEnd returns the length of the header block at the start of b,
+// up to and including the blank line that ends it, or -1 if b holds no blank
+// line yet. Lines may end in a bare LF, as net/http accepts.
+func headerBlockEnd(b []byte) int {
+	for off := 0; ; {
+		eol := bytes.IndexByte(b[off:], '\n')
+		if eol < 0 {
+			return -1
+		}
+		line := b[off : off+eol]
+		off += eol + 1
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return off
+		}
+	}
+}
+
+// parseChunkSize parses a chunk-size line exactly as net/http does: it must
+// end in CRLF with no other CR, any extension after ';' is ignored, trailing
+// whitespace is trimmed, and the rest must be 1 to 16 hex digits. Sizes too
+// large to track are refused, so the tracker never reads a chunk differently
+// from net/http.
+func parseChunkSize(line []byte) (int64, bool) {
+	if i := bytes.IndexByte(line, '\r'); i < 0 || i != len(line)-2 {
+		return 0, false
+	}
+	line = line[:len(line)-2]
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimRight(line, " \t")
+	if len(line) == 0 || len(line) > 16 {
+		return 0, false
+	}
+	var n uint64
+	for _, ch := range line {
+		switch {
+		case '0' <= ch && ch <= '9':
+			ch -= '0'
+		case 'a' <= ch && ch <= 'f':
+			ch -= 'a' - 10
+		case 'A' <= ch && ch <= 'F':
+			ch -= 'A' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | uint64(ch)
+	}
+	if n > 1<<62 {
+		return 0, false
+	}
+	return int64(n), true
+}
+
+// rewriteHeaders returns the header block to hand to net/http and sets the
+// state for the body that follows it. It reads the fields the way net/http
+// will: folded lines are joined to the previous field, and Transfer-Encoding
+// is ignored on HTTP/1.0 requests.
+func (c *teGzipConn) rewriteHeaders(block []byte) []byte {
+	lines := strings.Split(string(block), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	lines = lines[:len(lines)-2] // the blank line and what follows its LF
+	c.state, c.afterBody = teStateHeaders, teStateHeaders
+	requestLine := lines[0]
+	if strings.HasPrefix(requestLine, "PRI * HTTP/2") || strings.HasPrefix(requestLine, "CONNECT ") {
+		c.state = teStatePassthrough
+		return block
+	}
+	http10 := strings.HasSuffix(requestLine, " HTTP/1.0")
+	if !http10 && !strings.HasSuffix(requestLine, " HTTP/1.1") {
+		c.state = teStatePassthrough
+		return block
+	}
+	var fields []string
+	for _, line := range lines[1:] {
+		if len(fields) > 0 && line != "" && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		fields = append(fields, line)
+	}
+	var codings []string
+	var contentLength string
+	rewrite := false
+	kept := []string{requestLine}
+	var teLines []string
+	for _, field := range fields {
+		name, value, _ := strings.Cut(field, ":")
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			if !http10 {
+				for _, coding := range strings.Split(value, ",") {
+					codings = append(codings, strings.ToLower(strings.TrimSpace(coding)))
+				}
+			}
+			teLines = append(teLines, field)
+			continue
+		case strings.EqualFold(name, "Content-Length"):
+			contentLength = value
+		case strings.EqualFold(name, "Upgrade"):
+			c.afterBody = teStatePassthrough
+		case strings.EqualFold(name, teGzipMarker):
+			rewrite = true
+			continue
+		}
+		kept = append(kept, field)
+	}
+	gzipChunked := len(codings) == 2 && (codings[0] == "gzip" || codings[0] == "x-gzip") && codings[1] == "chunked"
+	switch {
+	case gzipChunked && contentLength != "":
+		// Both framings at once is how requests are smuggled (RFC 9112
+		// section 6.1): leave net/http to refuse the coding, which also
+		// closes the connection.
+		c.state = teStatePassthrough
+	case gzipChunked:
+		rewrite = true
+		teLines = []string{"Transfer-Encoding: chunked", teGzipMarker + ": gzip"}
+		c.state = teStateChunkSize
+	case len(codings) == 1 && codings[0] == "chunked":
+		// Chunked overrides any Content-Length, as in net/http.
+		c.state = teStateChunkSize
+	case len(codings) > 0:
+		c.state = teStatePassthrough
+	case contentLength != "":
+		n, err := strconv.ParseUint(contentLength, 10, 63)
+		if err != nil {
+			c.state = teStatePassthrough
+		} else if n > 0 {
+			c.state, c.remaining = teStateBody, int64(n)
+		}
+	}
+	if c.state == teStateHeaders {
+		c.state = c.afterBody
+	}
+	if !rewrite {
+		return block
+	}
+	kept = append(kept, teLines...)
+	return []byte(strings.Join(kept, "\r\n") + "\r\n\r\n")
+}
+
+// withTransferGzip decodes request bodies that teGzipConn marked as sent with
+// a gzip transfer coding, so handlers read plain bytes.
+func withTransferGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(teGzipMarker) != "gzip" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(teGzipMarker)
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip transfer coding", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		r.TransferEncoding = []string{"gzip", "chunked"}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{gz, r.Body}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Socket byte totals across all connections of the main listener (--byte-accounting).
+var (
+	socketBytesRead    atomic.Int64
+	socketBytesWritten atomic.Int64
+)
+
+// countingListener wraps accepted connections in countingConn. It sits below
+// TLS, so the totals are on-the-wire bytes including headers, chunk framing and
+// TLS records. Wrapping also hides *net.TCPConn's ReadFrom, so static files
+// are copied through userspace instead of sendfile.
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{c}, nil
+}
+
+// countingConn adds every Read and Write to the socket byte totals.
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	addCounter(&socketBytesRead, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	addCounter(&socketBytesWritten, int64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c countingConn) NetConn() net.Conn { return c.Conn }
+
+// setupTime is the connection cost reported in X-Handshake-Ms: accept to the
+// first request over TLS, where that span is dominated by the handshake, and
+// accept to the first byte received on cleartext connections.
+func (ci *connInfo) setupTime() time.Duration {
+	if ci.reader != nil {
+		if first := ci.reader.firstByte.Load(); first != 0 {
+			return time.Unix(0, first).Sub(ci.accepted)
+		}
+	}
+	return time.Since(ci.accepted)
+}
+
+// firstByteListener records when each connection receives its first byte
+// (--handshake-timing on cleartext listeners).
+type firstByteListener struct {
+	net.Listener
+}
+
+func (l firstByteListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &firstByteConn{Conn: c}, nil
+}
+
+type firstByteConn struct {
+	net.Conn
+	firstByte atomic.Int64 // UnixNano, 0 until the first byte arrives
+}
+
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.firstByte.Load() == 0 {
+		c.firstByte.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// findConn unwraps c through the NetConn methods of the listener wrappers,
+// returning the zero T (nil) when no T is underneath.
+func findConn[T net.Conn](c net.Conn) T {
+	for {
+		if conn, ok := c.(T); ok {
+			return conn
+		}
+		inner, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			var zero T
+			return zero
+		}
+		c = inner.NetConn()
+	}
+}
+
+// h2PriorityListener wraps cleartext HTTP/2 connections in an h2PriorityTap
+// (--h2-priority-frames).
+type h2PriorityListener struct{ net.Listener }
+
+func (l h2PriorityListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &h2PriorityTap{Conn: c}, nil
+}
+
+// maxPrioritySignals bounds the signals an h2PriorityTap keeps, the most
+// recent winning.
+const maxPrioritySignals = 32
+
+// h2Preface opens every HTTP/2 connection, after the HTTP/1.1 request of an
+// Upgrade: h2c.
+var h2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// h2PriorityTap scans the frames a client sends for priority signals, which
+// net/http never hands to handlers: the RFC 7540 priority of HEADERS frames
+// and PRIORITY frames, and RFC 9218 PRIORITY_UPDATE frames. Frame payloads
+// are skipped rather than buffered, except for the few bytes those carry.
+//
+// The preface is looked for where it can be only: at the start of the
+// connection, or right after the head of a first HTTP/1.1 request, the
+// Upgrade: h2c one. Anywhere else the connection is not HTTP/2 and the tap
+// gives up, so it never buffers what plain HTTP/1.1 clients send.
+type h2PriorityTap struct {
+	net.Conn
+
+	// Read side only, touched by the goroutine reading the connection.
+	matched   int    // preface bytes matched so far
+	inHead    bool   // in the head of the first HTTP/1.1 request
+	afterHead bool   // that head is done, the preface must follow
+	headLen   int    // bytes of that head seen so far
+	emptyLine bool   // the head bytes so far end a line, bar a CR
+	started   bool   // preface found, frames follow
+	off       bool   // preface not where it must be: not HTTP/2
+	hdr       []byte // partial frame header
+	frame     []byte // collected payload prefix of the current frame
+	want      int    // payload bytes still to collect into frame
+	skip      int    // payload bytes still to skip
+
+	mu      sync.Mutex
+	signals []string
+}
+
+func (t *h2PriorityTap) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	if n > 0 && !t.off {
+		t.scan(p[:n])
+	}
+	return n, err
+}
+
+func (t *h2PriorityTap) NetConn() net.Conn { return t.Conn }
+
+// maxUpgradeHead bounds the HTTP/1.1 request head an h2PriorityTap reads
+// through before giving up on the preface.
+const maxUpgradeHead = 64 * 1024
+
+func (t *h2PriorityTap) scan(b []byte) {
+	if !t.started {
+		if b = t.findPreface(b); !t.started {
+			return
+		}
+	}
+	for len(b) > 0 {
+		switch {
+		case t.want > 0:
+			n := min(t.want, len(b))
+			t.frame = append(t.frame, b[:n]...)
+			t.want -= n
+			b = b[n:]
+			if t.want == 0 {
+				t.parseFrame()
+			}
+		case t.skip > 0:
+			n := min(t.skip, len(b))
+			t.skip -= n
+			b = b[n:]
+		default:
+			n := min(9-len(t.hdr), len(b))
+			t.hdr = append(t.hdr, b[:n]...)
+			b = b[n:]
+			if len(t.hdr) < 9 {
+				continue
+			}
+			length := int(t.hdr[0])<<16 | int(t.hdr[1])<<8 | int(t.hdr[2])
+			collect := 0
+			switch t.hdr[3] {
+			case 0x1, 0x2: // HEADERS, PRIORITY: pad length and 5 priority bytes at most
+				collect = min(length, 6)
+			case 0x10: // PRIORITY_UPDATE: stream ID and the Priority field value
+				collect = min(length, 4+256)
+			}
+			t.frame, t.want, t.skip = t.frame[:0], collect, length-collect
+			if collect == 0 {
+				t.hdr = t.hdr[:0]
+			}
+		}
+	}
+}
+
+// findPreface consumes b up to the end of the preface, and returns the frame
+// bytes after it once started is set.
+func (t *h2PriorityTap) findPreface(b []byte) []byte {
+	for len(b) > 0 && !t.off {
+		if t.inHead {
+			i := t.skipHead(b)
+			if i < 0 {
+				return nil
+			}
+			b = b[i:]
+			continue
+		}
+		n := min(len(b), len(h2Preface)-t.matched)
+		if !bytes.Equal(b[:n], h2Preface[t.matched:t.matched+n]) {
+			if t.matched > 0 || t.afterHead {
+				t.off = true
+			} else {
+				t.inHead = true // an HTTP/1.1 request, perhaps an h2c upgrade
+			}
+			continue
+		}
+		t.matched += n
+		b = b[n:]
+		if t.matched == len(h2Preface) {
+			t.started = true
+			return b
+		}
+	}
+	return nil
+}
+
+// skipHead returns the offset in b just past the end of the request head,
+// the first empty line, or -1 when b ends within the head.
+func (t *h2PriorityTap) skipHead(b []byte) int {
+	for i, c := range b {
+		switch c {
+		case '\n':
+			if t.emptyLine {
+				t.inHead, t.afterHead = false, true
+				return i + 1
+			}
+			t.emptyLine = true
+		case '\r':
+		default:
+			t.emptyLine = false
+		}
+	}
+	if t.headLen += len(b); t.headLen > maxUpgradeHead {
+		t.off = true
+	}
+	return -1
+}
+
+// parseFrame records the priority signal of the collected frame, if any.
+func (t *h2PriorityTap) parseFrame() {
+	typ, flags := t.hdr[3], t.hdr[4]
+	stream := binary.BigEndian.Uint32(t.hdr[5:9]) & 0x7fffffff
+	t.hdr = t.hdr[:0]
+	p := t.frame
+	var signal string
+	switch typ {
+	case 0x1: // HEADERS
+		if flags&0x20 == 0 { // PRIORITY flag
+			return
+		}
+		if flags&0x8 != 0 { // PADDED: skip the pad length
+			p = p[1:]
+		}
+		if len(p) < 5 {
+			return
+		}
+		signal = rfc7540Priority(stream, "headers", p)
+	case 0x2:
+		if len(p) < 5 {
+			return
+		}
+		signal = rfc7540Priority(stream, "priority", p)
+	case 0x10:
+		if len(p) < 4 {
+			return
+		}
+		signal = fmt.Sprintf("stream=%d src=priority_update value=%q",
+			binary.BigEndian.Uint32(p[:4])&0x7fffffff, p[4:])
+	}
+	t.mu.Lock()
+	if len(t.signals) == maxPrioritySignals {
+		t.signals = t.signals[1:]
+	}
+	t.signals = append(t.signals, signal)
+	t.mu.Unlock()
+}
+
+// rfc7540Priority formats the exclusive bit, stream dependency and weight of
+// an RFC 7540 priority block.
+func rfc7540Priority(stream uint32, src string, p []byte) string {
+	dep := binary.BigEndian.Uint32(p[:4])
+	return fmt.Sprintf("stream=%d src=%s dep=%d weight=%d exclusive=%t",
+		stream, src, dep&0x7fffffff, int(p[4])+1, dep&0x80000000 != 0)
+}
+
+// prioritySignals returns the signals seen so far, oldest first.
+func (t *h2PriorityTap) prioritySignals() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.signals)
+}
+
+// maxPrioritySize bounds the size of /priority.
+const maxPrioritySize = 64 << 20
+
+// handlePriority serves size random bytes (default 64KB) and reports the
+// priority signals of the request, so resources of different sizes fetched
+// concurrently with different priorities can be compared:
+//
+//   - X-Priority-Urgency and X-Priority-Incremental: the RFC 9218 Priority
+//     request header, parsed (defaults u=3, not incremental);
+//   - X-H2-Priority-Signals: with --h2-priority-frames on cleartext --h2,
+//     every frame-level signal received on the connection so far, as
+//     "stream=N src=headers|priority dep=N weight=N exclusive=B" or
+//     "stream=N src=priority_update value=...", joined by "; ".
+//
+// Go's HTTP/2 server gives handlers neither their stream ID nor the frame
+// priorities, hence reporting the whole connection's signals. Nor does it
+// act on them: x/net/http2 ignores RFC 7540 priorities (deprecated by RFC
+// 9113) and, built with Go before 1.27, schedules streams round-robin
+// whatever the client sends; its RFC 9218 scheduler is only the default from
+// Go 1.27. The reported signals show what a client asked for, not what this
+// server honored.
+func handlePriority(w http.ResponseWriter, r *http.Request) {
+	size := getQueryInt(r, "size", 64*1024)
+	if size < 0 || size > maxPrioritySize {
+		http.Error(w, fmt.Sprintf("size must be in [0,%d]", maxPrioritySize), http.StatusBadRequest)
+		return
+	}
+	urgency, incremental := 3, false
+	for _, member := range strings.Split(headerValue(r.Header, "Priority"), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+		switch key {
+		case "u":
+			if u, err := strconv.Atoi(value); err == nil && u >= 0 && u <= 7 {
+				urgency = u
+			}
+		case "i":
+			incremental = value == "" || value == "?1"
+		}
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("X-Priority-Urgency", strconv.Itoa(urgency))
+	h.Set("X-Priority-Incremental", strconv.FormatBool(incremental))
+	if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && ci.priority != nil {
+		h.Set("X-H2-Priority-Signals", strings.Join(ci.priority.prioritySignals(), "; "))
+	}
+	writeBody(w, []byte(randomString(size)))
+}
+
+// timeout408Response is written straight to the connection when the request
+// line or headers do not arrive before ReadHeaderTimeout.
+const timeout408Response = "HTTP/1.1 408 Request Timeout\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 16\r\n" +
+	"Connection: close\r\n\r\n" +
+	"Request Timeout\n"
+
+// timeout408Listener wraps accepted connections so that header read timeouts
+// answer 408 instead of net/http's silent close (--timeout-408).
+type timeout408Listener struct {
+	net.Listener
+}
+
+func (l timeout408Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &timeout408Conn{Conn: c}, nil
+}
+
+// timeout408Conn records the http.ConnState reported by trackTimeout408State.
+// net/http only moves a connection to StateActive once the headers are parsed,
+// so a deadline hit in StateNew or StateIdle means the request line or headers
+// were slow or absent; body timeouts are left to withBodyReadTimeout. Once the
+// 408 is out, later writes are dropped: a partial request line is handed to the
+// parser without the timeout error and would otherwise be followed by a 400.
+type timeout408Conn struct {
+	net.Conn
+	state atomic.Int32
+	sent  atomic.Bool
+}
+
+func (c *timeout408Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		state := http.ConnState(c.state.Load())
+		if (state == http.StateNew || state == http.StateIdle) && c.sent.CompareAndSwap(false, true) {
+			c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+			io.WriteString(c.Conn, timeout408Response)
+		}
+	}
+	return n, err
+}
+
+func (c *timeout408Conn) Write(p []byte) (int, error) {
+	if c.sent.Load() {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// NetConn returns the wrapped connection.
+func (c *timeout408Conn) NetConn() net.Conn { return c.Conn }
+
+// trackTimeout408State is the server ConnState hook paired with timeout408Listener.
+func trackTimeout408State(c net.Conn, state http.ConnState) {
+	if tc, ok := c.(*timeout408Conn); ok {
+		tc.state.Store(int32(state))
+	}
+}
+
+// withBodyReadTimeout bounds the request body read with a ResponseController
+// deadline and answers 408 when it expires, whatever the route handler then
+// tries to write.
+func withBodyReadTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 && len(r.TransferEncoding) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tw := &timeoutWriter{ResponseWriter: w}
+		r.Body = &deadlineBody{ReadCloser: r.Body, onTimeout: tw.timeout}
+		next.ServeHTTP(tw, r)
+	})
+}
+
+// deadlineBody reports a read deadline expiry to its timeoutWriter.
+type deadlineBody struct {
+	io.ReadCloser
+	onTimeout func()
+}
+
+func (db *deadlineBody) Read(p []byte) (int, error) {
+	n, err := db.ReadCloser.Read(p)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		db.onTimeout()
+	}
+	return n, err
+}
+
+// timeoutWriter sends 408 on the first body timeout, unless the handler has
+// already started its response, and then drops whatever the handler writes.
+type timeoutWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) timeout() {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.timedOut = true
+	tw.ResponseWriter.Header().Set("Connection", "close")
+	http.Error(tw.ResponseWriter, "Request Timeout", http.StatusRequestTimeout)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	if tw.timedOut {
+		return len(p), nil
+	}
+	tw.wroteHeader = true
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// workerJob is a request handed from its connection goroutine to the pool.
+type workerJob struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	done     chan struct{}
+	panicked bool
+	panicVal any
+}
+
+// withWorkerPool runs next on a fixed set of worker goroutines fed through a
+// bounded queue (--worker-pool, --worker-queue), approximating a thread-pool
+// server. net/http still owns one goroutine per connection; it parks until a
+// worker has finished the request, so only handler execution is bounded.
+// Requests arriving to a full queue get 503 immediately.
+func withWorkerPool(next http.Handler, workers, queue int) http.Handler {
+	jobs := make(chan *workerJob, queue)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				runWorkerJob(next, job)
+			}
+		}()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job := &workerJob{w: w, r: r, done: make(chan struct{})}
+		select {
+		case jobs <- job:
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable (worker queue full)", http.StatusServiceUnavailable)
+			return
+		}
+		<-job.done
+		if job.panicked {
+			// Re-panic on the connection goroutine so net/http aborts the
+			// response (http.ErrAbortHandler) instead of the worker dying.
+			panic(job.panicVal)
+		}
+	})
+}
+
+// runWorkerJob serves one queued request, skipping clients that went away
+// while it waited.
+func runWorkerJob(next http.Handler, job *workerJob) {
+	defer close(job.done)
+	defer func() {
+		if rec := recover(); rec != nil {
+			job.panicked, job.panicVal = true, rec
+		}
+	}()
+	if job.r.Context().Err() != nil {
+		return
+	}
+	next.ServeHTTP(job.w, job.r)
+}
+
+// withQueryCache parses the query string once per request and stores it in the
+// request context (--query-parse-once). Without it every queryValues call
+// re-parses r.URL.RawQuery into a fresh map.
+func withQueryCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), queryKey{}, r.URL.Query())))
+	})
+}
+
+// queryValues returns the parsed query, reusing the withQueryCache copy if any.
+// Callers must not modify the result.
+func queryValues(r *http.Request) url.Values {
+	if q, ok := r.Context().Value(queryKey{}).(url.Values); ok {
+		return q
+	}
+	return r.URL.Query()
+}
+
+// withConnTracking counts the requests served on each connection. With
+// --max-requests-per-conn, the request reaching the limit is answered with
+// Connection: close so the client must reconnect (HTTP/1.x only; HTTP/2 has no
+// per-response way to end the connection). With --handshake-timing, the first
+// response on a connection carries its setup time in X-Handshake-Ms.
+func withConnTracking(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok {
+			n := ci.requests.Add(1)
+			if maxRequestsPerConn > 0 && n >= int64(maxRequestsPerConn) && r.ProtoMajor == 1 {
+				w.Header().Set("Connection", "close")
+			}
+			if handshakeTiming && n == 1 {
+				w.Header().Set("X-Handshake-Ms", strconv.FormatFloat(ci.setupTime().Seconds()*1000, 'f', 3, 64))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleInspect reports protocol and TLS negotiation details of the connection
+// the request arrived on.
+func handleInspect(w http.ResponseWriter, r *http.Request) {
+	type inspectResponse struct {
+		Proto              string `json:"proto"`
+		TLS                bool   `json:"tls"`
+		TLSVersion         string `json:"tls_version,omitempty"`
+		CipherSuite        string `json:"cipher_suite,omitempty"`
+		ServerName         string `json:"server_name,omitempty"`
+		ALPN               string `json:"alpn,omitempty"`
+		Resumed            bool   `json:"resumed"`
+		ConnectionReused   bool   `json:"connection_reused"`
+		ConnectionRequests int64  `json:"connection_requests"`
+		RemoteAddr         string `json:"remote_addr"`
+	}
+	resp := inspectResponse{Proto: r.Proto, RemoteAddr: r.RemoteAddr}
+	if r.TLS != nil {
+		resp.TLS = true
+		resp.TLSVersion = tls.VersionName(r.TLS.Version)
+		resp.CipherSuite = tls.CipherSuiteName(r.TLS.CipherSuite)
+		resp.ServerName = r.TLS.ServerName
+		resp.ALPN = r.TLS.NegotiatedProtocol
+		resp.Resumed = r.TLS.DidResume
+	}
+	if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok {
+		resp.ConnectionRequests = ci.requests.Load()
+		resp.ConnectionReused = resp.ConnectionRequests > 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleConnInfo reports which listener served the request: the address the
+// connection landed on and its network, next to the client address. With
+// --proxy-protocol, remote_addr is the client named by the PROXY header and
+// peer_addr the proxy that connected.
+func handleConnInfo(w http.ResponseWriter, r *http.Request) {
+	type connInfoResponse struct {
+		RemoteAddr    string `json:"remote_addr"`
+		LocalAddr     string `json:"local_addr"`
+		Network       string `json:"network"`
+		ProxyProtocol bool   `json:"proxy_protocol"`
+		PeerAddr      string `json:"peer_addr,omitempty"`
+	}
+	resp := connInfoResponse{RemoteAddr: r.RemoteAddr}
+	if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok {
+		resp.LocalAddr, resp.Network = ci.local.String(), ci.local.Network()
+		if ci.proxy != nil {
+			resp.ProxyProtocol = true
+			resp.PeerAddr = ci.proxy.Conn.RemoteAddr().String()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeBody sends a fully built 200 response body with predictable framing:
+// an exact Content-Length up to --chunked-threshold bytes (always, when the
+// threshold is 0), and above it headers flushed up front and the body streamed
+// in threshold-sized chunks. HTTP/2 has no chunked coding; there the large
+// case simply omits content-length and streams DATA frames.
+func writeBody(w http.ResponseWriter, data []byte) {
+	if chunkedThreshold <= 0 || len(data) <= chunkedThreshold {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+	for len(data) > 0 {
+		n := min(chunkedThreshold, len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			return
+		}
+		data = data[n:]
+		if len(data) > 0 && rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// handleReadyz reports readiness: 200 once startup finished, 503 with the
+// reason before.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	if reason := notReady.Load(); reason != nil {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "not ready: "+*reason+"\n")
+		return
+	}
+	io.WriteString(w, "ready\n")
+}
+
+func handlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("pong"))
+}
+
+// unrepeatableHeaders are the framing and hop-by-hop fields /headers refuses
+// to repeat: several random values make the response malformed, and
+// Content-Type would be overwritten anyway.
+var unrepeatableHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// handleHeaders generates `count` response headers of `size` random bytes,
+// named X-Bench-Header-N, or all named `repeat` (e.g. Set-Cookie) when given,
+// producing one header line per value.
+func handleHeaders(w http.ResponseWriter, r *http.Request) {
+	count := getQueryInt(r, "count", 10)
+	size := getQueryInt(r, "size", 64)
+	repeat := queryValues(r).Get("repeat")
+	if repeat != "" && !httpguts.ValidHeaderFieldName(repeat) {
+		http.Error(w, "Invalid repeat header name", http.StatusBadRequest)
+		return
+	}
+	if unrepeatableHeaders[http.CanonicalHeaderKey(repeat)] {
+		http.Error(w, "repeat cannot name a framing or hop-by-hop header", http.StatusBadRequest)
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		value := randomString(size)
+		if repeat != "" {
+			w.Header().Add(repeat, value)
+			continue
+		}
+		name := fmt.Sprintf("X-Bench-Header-%d", i)
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Generated %d headers", count)
+}
+
+func handleUppercase(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range data {
+		b := data[i]
+		if 'a' <= b && b <= 'z' {
+			data[i] = b - ('a' - 'A')
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	writeBody(w, data)
+}
+
+// handleUpload consumes a POST or PUT body of at most --max-upload-size bytes
+// and reports how many it received. A declared Content-Length over the limit
+// is rejected with 413 before the first body read, so an Expect: 100-continue
+// client never gets 100 Continue and never sends the body; net/http then
+// closes the connection instead of draining it. Unsized bodies are cut off
+// with 413 once they cross the limit.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ContentLength > maxUploadSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	n, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf := strconv.AppendInt([]byte(`{"received":`), n, 10)
+	writeBody(w, append(buf, "}\n"...))
+}
+
+// schemaError is one /validate-schema failure, located by JSON pointer in
+// both the instance and the schema.
+type schemaError struct {
+	InstanceLocation string `json:"instance_location"`
+	KeywordLocation  string `json:"keyword_location,omitempty"`
+	Error            string `json:"error"`
+}
+
+// handleSchema validates the POST body against bodySchema. Valid documents get
+// 200 {"valid":true}; invalid ones, malformed JSON included, get 400 with the
+// flat list of validation errors.
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type Response struct {
+		Valid  bool          `json:"valid"`
+		Errors []schemaError `json:"errors,omitempty"`
+	}
+	resp := Response{Valid: true}
+	doc, err := jsonschema.UnmarshalJSON(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		resp = Response{Errors: []schemaError{{Error: "invalid JSON: " + err.Error()}}}
+	} else if err = bodySchema.Validate(doc); err != nil {
+		resp.Valid = false
+		var verr *jsonschema.ValidationError
+		if errors.As(err, &verr) {
+			for _, unit := range verr.BasicOutput().Errors {
+				if unit.Error != nil {
+					resp.Errors = append(resp.Errors, schemaError{unit.InstanceLocation, unit.KeywordLocation, unit.Error.String()})
+				}
+			}
+		}
+		if len(resp.Errors) == 0 {
+			resp.Errors = []schemaError{{Error: err.Error()}}
+		}
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	data = append(data, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Valid {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(data)
+		return
+	}
+	writeBody(w, data)
+}
+
+// newHasher returns a fresh hash for a /hash algorithm name.
+func newHasher(algo string) (hash.Hash, bool) {
+	switch algo {
+	case "sha256":
+		return sha256.New(), true
+	case "sha1":
+		return sha1.New(), true
+	case "blake2b":
+		h, _ := blake2b.New256(nil) // only fails for an oversized key
+		return h, true
+	case "crc32":
+		return crc32.NewIEEE(), true
+	}
+	return nil, false
+}
+
+// hashProgress is the io.Writer in front of the /hash hasher that adds each
+// chunk to hashBytes.
+type hashProgress struct {
+	hash.Hash
+}
+
+func (hp hashProgress) Write(p []byte) (int, error) {
+	addCounter(&hashBytes, int64(len(p)))
+	return hp.Hash.Write(p)
+}
+
+// handleHashUpload streams the request body of any size through the
+// --hash-algo hash (or the `algo` query parameter) with io.Copy, in constant
+// memory, and replies {"algo":...,"bytes":N,"digest":hex}. blake2b is
+// BLAKE2b-256.
+func handleHashUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	algo := queryValues(r).Get("algo")
+	if algo == "" {
+		algo = hashAlgo
+	}
+	h, ok := newHasher(algo)
+	if !ok {
+		http.Error(w, "Unsupported algo (use sha256, sha1, blake2b or crc32)", http.StatusBadRequest)
+		return
+	}
+	n, err := io.Copy(hashProgress{h}, r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	buf := make([]byte, 0, 64+2*h.Size())
+	buf = append(buf, `{"algo":"`...)
+	buf = append(buf, algo...)
+	buf = append(buf, `","bytes":`...)
+	buf = strconv.AppendInt(buf, n, 10)
+	buf = append(buf, `,"digest":"`...)
+	buf = hex.AppendEncode(buf, h.Sum(nil))
+	buf = append(buf, "\"}\n"...)
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, buf)
+}
+
+// maxRedirectChain bounds the n of /redirect?n=.
+const maxRedirectChain = 100
+
+// handleRedirect redirects with ?code (301, 302 (default), 303, 307 or 308).
+// ?n=N answers with a chain of N internal hops ending in a 200, for client
+// redirect-following cost. ?to=URL redirects once to an absolute external
+// URL, for cross-origin redirect handling; only http and https targets with a
+// host are accepted, so file:, javascript: and relative targets get 400.
+func handleRedirect(w http.ResponseWriter, r *http.Request) {
+	q := queryValues(r)
+	code := getQueryInt(r, "code", http.StatusFound)
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		http.Error(w, "code must be 301, 302, 303, 307 or 308", http.StatusBadRequest)
+		return
+	}
+	if to := q.Get("to"); to != "" {
+		target, err := url.Parse(to)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			http.Error(w, "to must be an absolute http or https URL", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, target.String(), code)
+		return
+	}
+	n := getQueryInt(r, "n", 1)
+	if n < 0 || n > maxRedirectChain {
+		http.Error(w, fmt.Sprintf("n must be in [0,%d]", maxRedirectChain), http.StatusBadRequest)
+		return
+	}
+	if n == 0 {
+		w.Header().Set("Content-Type", "text/plain")
+		writeBody(w, []byte("redirect chain done"))
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/redirect?n=%d&code=%d", n-1, code), code)
+}
+
+// handleEchoBody writes the request body back verbatim while mirroring its
+// framing: a Content-Length request gets a Content-Length response, a chunked
+// (or otherwise unsized) request gets a streamed, chunked response.
+func handleEchoBody(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	chunked := r.ContentLength < 0
+	for _, te := range r.TransferEncoding {
+		if te == "chunked" {
+			chunked = true
+		}
+	}
+	if !chunked {
+		w.Header().Set("X-Request-Framing", "content-length")
+		w.Header().Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		_, _ = io.Copy(w, r.Body)
+		return
+	}
+
+	// Committing the headers before the handler returns prevents net/http from
+	// computing a Content-Length, so HTTP/1.1 responses are sent chunked.
+	// Full duplex keeps the request body readable after the headers are sent.
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+	w.Header().Set("X-Request-Framing", "chunked")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleSlowBody reads the request body under a per-request deadline of
+// `timeout_ms` (default 2000). A client trickling the body past the deadline
+// gets 408 and the connection is closed, which the connection-wide
+// ReadTimeout/WriteTimeout alone cannot express.
+func handleSlowBody(w http.ResponseWriter, r *http.Request) {
+	timeout := time.Duration(getQueryInt(r, "timeout_ms", 2000)) * time.Millisecond
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		http.Error(w, "Read deadlines unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+			return
+		}
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"bytes":%d,"elapsed_ms":%d}`, n, time.Since(start).Milliseconds())
+}
+
+// handleEncodingPassthrough returns the POST body exactly as received, still
+// compressed, with the request's Content-Encoding and Content-Type: the
+// no-decode counterpart of /body-codec for comparing ingest strategies. The
+// body is held in memory, up to --max-upload-size, so the reply always carries
+// its exact Content-Length.
+func handleEncodingPassthrough(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	if encodings := r.Header.Values("Content-Encoding"); len(encodings) > 0 {
+		h["Content-Encoding"] = encodings
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
+
+// handleBodyCodec adds one to every byte of the body, decoding a gzip
+// Content-Encoding (a gzip Transfer-Encoding is already removed by
+// withTransferGzip). The reply is gzip-compressed as a transfer coding when
+// an HTTP/1.1 client sends "TE: gzip", otherwise as a content coding when it
+// accepts one.
+func handleBodyCodec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reader io.ReadCloser = r.Body
+	if strings.Contains(headerValue(r.Header, "Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		reader = gz
+		defer gz.Close()
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusInternalServerError)
+		return
+	}
+	for i := range data {
+		data[i] = data[i] + 1
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if teGzip && r.ProtoAtLeast(1, 1) && r.ProtoMajor == 1 && strings.Contains(headerValue(r.Header, "TE"), "gzip") {
+		// Without a Content-Length net/http chunks the body and sends its
+		// own "Transfer-Encoding: chunked" line after this one, which is
+		// equivalent to "Transfer-Encoding: gzip, chunked".
+		w.Header().Set("Transfer-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write(data)
+		_ = gz.Close()
+		return
+	}
+	if parseAcceptEncoding(headerValue(r.Header, "Accept-Encoding"))&encodingGzip != 0 {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			_ = gz.Close()
+			http.Error(w, "Compression failed", http.StatusInternalServerError)
+			return
+		}
+		if err := gz.Close(); err != nil {
+			http.Error(w, "Compression failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		writeBody(w, buf.Bytes())
+		return
+	}
+	writeBody(w, data)
+}
+
+// handleDecompress inflates a gzip or deflate (zlib) request body as it
+// arrives, without keeping it, and reports its sizes. It stops with 400
+// "Suspected bomb" as soon as the output passes --max-decompressed-size or
+// --max-ratio times the compressed bytes read so far, so a small body cannot
+// make it inflate gigabytes: the checks run per 32KB of output, not after
+// the fact.
+func handleDecompress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	in := &countingReader{r: r.Body}
+	var dec io.Reader
+	var err error
+	switch coding := strings.ToLower(strings.TrimSpace(headerValue(r.Header, "Content-Encoding"))); coding {
+	case "gzip", "x-gzip":
+		dec, err = gzip.NewReader(in)
+	case "deflate":
+		dec, err = zlib.NewReader(in)
+	default:
+		http.Error(w, "Content-Encoding must be gzip or deflate", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid compressed body", http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	var out int64
+	for {
+		n, err := dec.Read(buf)
+		out += int64(n)
+		if out > maxDecompressedSize {
+			http.Error(w, fmt.Sprintf("Suspected bomb: output exceeds %d bytes", maxDecompressedSize), http.StatusBadRequest)
+			return
+		}
+		if out > int64(maxDecompressRatio)*in.n {
+			http.Error(w, fmt.Sprintf("Suspected bomb: ratio exceeds %d:1", maxDecompressRatio), http.StatusBadRequest)
+			return
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid compressed body", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"compressed_bytes":%d,"decompressed_bytes":%d,"ratio":%.2f}`,
+		in.n, out, float64(out)/float64(max(in.n, 1)))
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// acceptedEncodings is the set of content codings a client accepts.
+type acceptedEncodings uint8
+
+const (
+	encodingGzip acceptedEncodings = 1 << iota
+	encodingDeflate
+	encodingBrotli
+	encodingZstd
+
+	allEncodings = encodingGzip | encodingDeflate | encodingBrotli | encodingZstd
+)
+
+// parseAcceptEncoding returns the codings an Accept-Encoding value accepts.
+// The exact strings sent by browsers and common clients are recognized by a
+// string switch; anything else goes through parseAcceptEncodingFull.
+func parseAcceptEncoding(value string) acceptedEncodings {
+	switch value {
+	case "gzip, deflate, br, zstd":
+		return allEncodings
+	case "gzip, deflate, br":
+		return encodingGzip | encodingDeflate | encodingBrotli
+	case "gzip, deflate", "gzip,deflate", "deflate, gzip":
+		return encodingGzip | encodingDeflate
+	case "br, gzip", "gzip, br":
+		return encodingGzip | encodingBrotli
+	case "gzip":
+		return encodingGzip
+	case "", "identity":
+		return 0
+	}
+	return parseAcceptEncodingFull(value)
+}
+
+// parseAcceptEncodingFull parses a comma-separated list of codings with
+// optional q-values. q=0 rejects a coding; "*" accepts every coding not
+// listed explicitly.
+func parseAcceptEncodingFull(value string) acceptedEncodings {
+	var accepted, listed acceptedEncodings
+	wildcard := false
+	for _, part := range strings.Split(value, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		rejected := false
+		for _, param := range strings.Split(params, ";") {
+			name, q, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(name, "q") {
+				f, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+				rejected = err != nil || f <= 0
+			}
+		}
+		var enc acceptedEncodings
+		switch coding {
+		case "gzip", "x-gzip":
+			enc = encodingGzip
+		case "deflate":
+			enc = encodingDeflate
+		case "br":
+			enc = encodingBrotli
+		case "zstd":
+			enc = encodingZstd
+		case "*":
+			wildcard = !rejected
+			continue
+		default:
+			continue
+		}
+		listed |= enc
+		if !rejected {
+			accepted |= enc
+		}
+	}
+	if wildcard {
+		accepted |= allEncodings &^ listed
+	}
+	return accepted
+}
+
+// handleTee streams the request body back while hashing it through an
+// io.TeeReader, then sends the SHA-256 as the X-Body-SHA256 trailer. Memory
+// stays bounded by the copy buffer whatever the body size.
+func handleTee(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", "X-Body-SHA256")
+	w.WriteHeader(http.StatusOK)
+
+	h := sha256.New()
+	body := io.TeeReader(r.Body, h)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+	w.Header().Set("X-Body-SHA256", hex.EncodeToString(h.Sum(nil)))
+}
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// wsAcceptGUID is appended to Sec-WebSocket-Key to derive Sec-WebSocket-Accept.
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// handleWSPing upgrades to WebSocket and echoes every data frame as soon as
+// it arrives, so a client that sends a timestamp measures round-trip latency.
+// Client pings get pongs. With --ws-ping-interval the server also pings with
+// its own timestamp and records pong latency, exported at /metrics.
+//
+// This is a minimal RFC 6455 endpoint over HTTP/1.1: no extensions or
+// subprotocols, frames echoed one by one rather than reassembled, and frames
+// above --ws-max-frame closed with 1009. Unmasked frames and fragmented or
+// oversized control frames are closed with 1002.
+func handleWSPing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.ProtoMajor != 1 ||
+		!httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade") ||
+		!httpguts.HeaderValuesContainsToken(r.Header["Upgrade"], "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	// The server's read and write timeouts do not apply to the upgraded
+	// connection.
+	_ = conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	ws := &wsConn{conn: conn, r: brw.Reader}
+	if wsPingInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go ws.pingLoop(wsPingInterval, done)
+	}
+	for {
+		op, fin, payload, err := ws.readFrame(wsMaxFrame)
+		if err != nil {
+			switch {
+			case errors.Is(err, errWSFrameTooLarge):
+				ws.writeFrame(wsOpClose, true, binary.BigEndian.AppendUint16(nil, 1009))
+			case errors.Is(err, errWSProtocol):
+				ws.writeFrame(wsOpClose, true, binary.BigEndian.AppendUint16(nil, 1002))
+			}
+			return
+		}
+		switch op {
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			err = ws.writeFrame(op, fin, payload)
+		case wsOpPing:
+			err = ws.writeFrame(wsOpPong, true, payload)
+		case wsOpPong:
+			// Unsolicited pongs and pongs to forgotten pings carry no
+			// round trip.
+			if len(payload) == 8 && ws.answerPing(binary.BigEndian.Uint64(payload)) {
+				sent := int64(binary.BigEndian.Uint64(payload))
+				wsPongLatency.add(time.Duration(time.Now().UnixNano() - sent))
+			}
+		case wsOpClose:
+			// Echo the status code, as RFC 6455 section 5.5.1 suggests.
+			ws.writeFrame(wsOpClose, true, payload[:min(len(payload), 2)])
+			return
+		default:
+			ws.writeFrame(wsOpClose, true, binary.BigEndian.AppendUint16(nil, 1002))
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var (
+	errWSFrameTooLarge = errors.New("websocket frame too large")
+	errWSProtocol      = errors.New("websocket protocol error")
+)
+
+// wsConn is a server-side WebSocket connection. Reads happen on the handler
+// goroutine only; writes are serialized by mu because pingLoop also writes.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+
+	pingMu sync.Mutex
+	pings  [8]uint64 // payloads of the last pings sent, 0 once answered
+	next   int
+}
+
+// readFrame reads one client frame and unmasks its payload. Clients must mask
+// every frame, and control frames must be final and at most 125 bytes (RFC
+// 6455 sections 5.1 and 5.5); other frames fail with errWSProtocol.
+func (ws *wsConn) readFrame(maxPayload int) (op byte, fin bool, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(ws.r, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0f
+	n := uint64(head[1] & 0x7f)
+	masked := head[1]&0x80 != 0
+	if !masked || op&0x8 != 0 && (!fin || n > 125) {
+		return 0, false, nil, errWSProtocol
+	}
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > uint64(maxPayload) {
+		return 0, false, nil, errWSFrameTooLarge
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+	return op, fin, payload, nil
+}
+
+// writeFrame sends one unmasked frame, as servers must.
+func (ws *wsConn) writeFrame(op byte, fin bool, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	frame = append(frame, b0)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	frame = append(frame, payload...)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// pingLoop pings every interval with the send time in UnixNano as payload,
+// which the handler reads back from the pong.
+func (ws *wsConn) pingLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sent := uint64(time.Now().UnixNano())
+			ws.pingMu.Lock()
+			ws.pings[ws.next] = sent
+			ws.next = (ws.next + 1) % len(ws.pings)
+			ws.pingMu.Unlock()
+			if ws.writeFrame(wsOpPing, true, binary.BigEndian.AppendUint64(nil, sent)) != nil {
+				return
+			}
+		}
+	}
+}
+
+// answerPing reports whether sent is the payload of an outstanding ping, and
+// marks that ping answered.
+func (ws *wsConn) answerPing(sent uint64) bool {
+	ws.pingMu.Lock()
+	defer ws.pingMu.Unlock()
+	for i, p := range ws.pings {
+		if p != 0 && p == sent {
+			ws.pings[i] = 0
+			return true
+		}
+	}
+	return false
+}
+
+// wsPongLatency holds the most recent /ws-ping pong round trips.
+var wsPongLatency latencyWindow
+
+// latencyWindow keeps the last len(samples) durations for quantile reporting.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [4096]time.Duration
+	next    int
+	total   int64
+}
+
+func (lw *latencyWindow) add(d time.Duration) {
+	lw.mu.Lock()
+	lw.samples[lw.next] = d
+	lw.next = (lw.next + 1) % len(lw.samples)
+	lw.total++
+	lw.mu.Unlock()
+}
+
+// reset empties the window and its sample count.
+func (lw *latencyWindow) reset() {
+	lw.mu.Lock()
+	lw.next, lw.total = 0, 0
+	lw.mu.Unlock()
+}
+
+// quantiles returns the median and p99 of the window and the number of
+// samples ever added.
+func (lw *latencyWindow) quantiles() (p50, p99 time.Duration, total int64) {
+	lw.mu.Lock()
+	n := min(int(lw.total), len(lw.samples))
+	sorted := slices.Clone(lw.samples[:n])
+	total = lw.total
+	lw.mu.Unlock()
+	if n == 0 {
+		return 0, 0, total
+	}
+	slices.Sort(sorted)
+	return sorted[n/2], sorted[(n*99)/100], total
+}
+
+// fanoutClient issues the /fanout upstream calls. main sizes its idle pool to
+// --max-fanout so a full fan-out to one host reuses connections.
+var fanoutClient = &http.Client{}
+
+// newFanoutTransport returns the upstream transport. A positive dialDelay
+// (--upstream-dial-delay) is slept before every new connection, simulating
+// slow DNS or connect without a slow upstream; pooled connections skip it.
+func newFanoutTransport(maxConns int, dialDelay time.Duration) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = maxConns
+	t.MaxIdleConnsPerHost = maxConns
+	if dialDelay > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			timer := time.NewTimer(dialDelay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return t
+}
+
+// fanoutCall is the outcome of one /fanout upstream request.
+type fanoutCall struct {
+	Status    int    `json:"status"`
+	Bytes     int64  `json:"bytes"`
+	LatencyUs int64  `json:"latency_us"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleFanout issues n concurrent GETs to upstream through an errgroup, each
+// bounded by timeout (default --fanout-timeout), and reports every call's
+// status and latency once all have returned. A failed call is recorded in the
+// summary rather than cancelling its siblings.
+func handleFanout(w http.ResponseWriter, r *http.Request) {
+	q := queryValues(r)
+	n := getQueryInt(r, "n", 5)
+	if n < 1 || n > maxFanout {
+		http.Error(w, fmt.Sprintf("n must be in [1,%d]", maxFanout), http.StatusBadRequest)
+		return
+	}
+	upstream, err := url.Parse(q.Get("upstream"))
+	if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+		http.Error(w, "upstream must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	timeout := fanoutTimeout
+	if v := q.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	calls := make([]fanoutCall, n)
+	start := time.Now()
+	var g errgroup.Group
+	for i := range calls {
+		g.Go(func() error {
+			calls[i] = fanoutGet(r.Context(), upstream.String(), timeout)
+			return nil
+		})
+	}
+	g.Wait()
+	elapsed := time.Since(start)
+
+	type Response struct {
+		Upstream  string       `json:"upstream"`
+		N         int          `json:"n"`
+		OK        int          `json:"ok"`
+		Failed    int          `json:"failed"`
+		ElapsedUs int64        `json:"elapsed_us"`
+		Calls     []fanoutCall `json:"calls"`
+	}
+	resp := Response{Upstream: upstream.String(), N: n, ElapsedUs: elapsed.Microseconds(), Calls: calls}
+	for _, c := range calls {
+		if c.Error == "" && c.Status < 400 {
+			resp.OK++
+		} else {
+			resp.Failed++
+		}
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, append(data, '\n'))
+}
+
+// fanoutGet performs one upstream GET, draining the body so the connection
+// goes back to the idle pool.
+func fanoutGet(ctx context.Context, upstream string, timeout time.Duration) fanoutCall {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	var call fanoutCall
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = fanoutClient.Do(req); err == nil {
+			call.Status = resp.StatusCode
+			call.Bytes, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	call.LatencyUs = time.Since(start).Microseconds()
+	return call
+}
+
+// healthCheck is one /health/deep sub-check; run returns nil when healthy.
+type healthCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// healthChecks are the checks /health/deep runs, set up by main from the flags.
+var healthChecks []healthCheck
+
+// defaultHealthChecks registers the checks that apply to this configuration:
+// static-writable with --static, upstream with --upstream and heap with
+// --health-max-heap.
+func defaultHealthChecks() []healthCheck {
+	var checks []healthCheck
+	if staticDir != "" {
+		checks = append(checks, healthCheck{"static-writable", func(ctx context.Context) error {
+			f, err := os.CreateTemp(staticDir, ".health-*")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			return os.Remove(f.Name())
+		}})
+	}
+	if healthUpstream != "" {
+		checks = append(checks, healthCheck{"upstream", func(ctx context.Context) error {
+			call := fanoutGet(ctx, healthUpstream, healthTimeout)
+			if call.Error != "" {
+				return errors.New(call.Error)
+			}
+			if call.Status >= 500 {
+				return fmt.Errorf("status %d", call.Status)
+			}
+			return nil
+		}})
+	}
+	if healthMaxHeap > 0 {
+		checks = append(checks, healthCheck{"heap", func(ctx context.Context) error {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > uint64(healthMaxHeap) {
+				return fmt.Errorf("heap %d bytes over the %d byte threshold", ms.HeapAlloc, healthMaxHeap)
+			}
+			return nil
+		}})
+	}
+	return checks
+}
+
+// healthResult is the outcome of one sub-check in the /health/deep body.
+type healthResult struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationUs int64  `json:"duration_us"`
+}
+
+// The last /health/deep run, reused for --health-cache-ttl. healthMu only
+// guards the cache; probes arriving while the checks run share that run
+// through healthRuns instead of starting their own.
+var (
+	healthMu      sync.Mutex
+	healthResults []healthResult
+	healthRanAt   time.Time
+	healthRuns    singleflight.Group
+)
+
+// handleHealthDeep runs healthChecks concurrently, each bounded by
+// --health-timeout, and answers 200 with the per-check results, or 503 when
+// any check failed. Results are cached for --health-cache-ttl so probes do not
+// add per-request cost.
+func handleHealthDeep(w http.ResponseWriter, r *http.Request) {
+	results := cachedHealthResults()
+
+	type Response struct {
+		Status string         `json:"status"`
+		Checks []healthResult `json:"checks"`
+	}
+	resp := Response{Status: "ok", Checks: results}
+	for _, res := range results {
+		if !res.OK {
+			resp.Status = "fail"
+		}
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// cachedHealthResults returns the cached results while they are fresh, and
+// otherwise runs healthChecks once for all concurrent callers.
+func cachedHealthResults() []healthResult {
+	healthMu.Lock()
+	results, ranAt := healthResults, healthRanAt
+	healthMu.Unlock()
+	if results != nil && time.Since(ranAt) < healthCacheTTL {
+		return results
+	}
+	v, _, _ := healthRuns.Do("", func() (any, error) {
+		results := runHealthChecks(healthChecks, healthTimeout)
+		healthMu.Lock()
+		healthResults, healthRanAt = results, time.Now()
+		healthMu.Unlock()
+		return results, nil
+	})
+	return v.([]healthResult)
+}
+
+func runHealthChecks(checks []healthCheck, timeout time.Duration) []healthResult {
+	results := make([]healthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			// A check that ignores ctx is abandoned at the deadline rather
+			// than holding up the probe.
+			done := make(chan error, 1)
+			go func() { done <- check.run(ctx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			results[i] = healthResult{Name: check.name, OK: err == nil, DurationUs: time.Since(start).Microseconds()}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// servingRouter is the router the main listener dispatches through, listed
+// by /_routes.
+var servingRouter *router
+
+// handleRoutes lists every route of the main router as JSON, so a harness
+// can discover the endpoints rather than hard-code them: the template
+// (metrics' route label), kind and methods of each, in lookup order. It is
+// served on the admin port when there is one, on the main port otherwise.
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servingRouter.routes())
+}
+
+// batchHandler serves /batch and /consistency sub-requests: the router
+// behind withRecovery, without the connection-level middleware the enclosing
+// request already went through.
+var batchHandler http.Handler
+
+// batchRequest and batchResult are the /batch array elements. Bodies are
+// strings, so binary payloads do not survive the round trip.
+type batchRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Body   string `json:"body"`
+}
+
+type batchResult struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+// handleBatch decodes a JSON array of at most --max-batch-size sub-requests,
+// runs them in order against batchHandler through httptest.ResponseRecorder,
+// and returns their results in the same order. All sub-requests share a
+// --batch-timeout deadline; those still pending when it expires get 504
+// without being dispatched.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reqs []batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, "Body must be a JSON array of {method, path, body}", http.StatusBadRequest)
+		return
+	}
+	if len(reqs) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("batch size must be at most %d", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	// A fresh context keeps the outer request's values (cached query,
+	// tracing span) away from the sub-requests while still following its
+	// cancellation.
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+	defer context.AfterFunc(r.Context(), cancel)()
+
+	results := make([]batchResult, len(reqs))
+	for i, sub := range reqs {
+		results[i] = runBatchRequest(ctx, r, sub)
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, append(data, '\n'))
+}
+
+func runBatchRequest(ctx context.Context, parent *http.Request, sub batchRequest) batchResult {
+	if ctx.Err() != nil {
+		return batchResult{Status: http.StatusGatewayTimeout, Body: "batch deadline exceeded"}
+	}
+	method := sub.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !strings.HasPrefix(sub.Path, "/") || !httpguts.ValidHeaderFieldName(method) {
+		return batchResult{Status: http.StatusBadRequest, Body: "sub-request needs a method and an absolute path"}
+	}
+	target, err := url.ParseRequestURI(sub.Path)
+	if err != nil {
+		return batchResult{Status: http.StatusBadRequest, Body: "invalid path"}
+	}
+	if target.Path == "/batch" {
+		return batchResult{Status: http.StatusBadRequest, Body: "nested /batch is not supported"}
+	}
+	req, err := newSubRequest(ctx, parent, method, sub.Path, strings.NewReader(sub.Body))
+	if err != nil {
+		return batchResult{Status: http.StatusBadRequest, Body: "invalid path"}
+	}
+	rec := httptest.NewRecorder()
+	batchHandler.ServeHTTP(rec, req)
+	return batchResult{Status: rec.Code, Body: rec.Body.String()}
+}
+
+// newSubRequest builds a server-side request for target, as net/http would
+// have parsed it off parent's connection. Unlike httptest.NewRequest it
+// returns an error rather than panicking on a target that could not appear
+// in a request line, such as one with a space.
+func newSubRequest(ctx context.Context, parent *http.Request, method, target string, body io.Reader) (*http.Request, error) {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] == 0x7f {
+			return nil, fmt.Errorf("invalid byte %q in request target", target[i])
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = target
+	req.RemoteAddr = parent.RemoteAddr
+	req.Host = parent.Host
+	return req, nil
+}
+
+// consistencyHeaders are the response headers /consistency requires HEAD and
+// GET to agree on (RFC 9110 section 9.3.2).
+var consistencyHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Encoding", "Content-Language",
+	"Content-Range", "Accept-Ranges", "Cache-Control", "Expires", "ETag",
+	"Last-Modified", "Vary",
+}
+
+// handleConsistency serves /consistency?path=/json%3Fitems%3D5 by running
+// the target as a GET and as a HEAD internally, with the caller's request
+// headers, and reporting the status and consistencyHeaders differences. The
+// Content-Length net/http would add to an unsized response is filled in
+// first: a HEAD handler that writes nothing gets none, which is the bug this
+// catches. Handlers generating random content may legitimately differ in
+// ETag.
+func handleConsistency(w http.ResponseWriter, r *http.Request) {
+	path := queryValues(r).Get("path")
+	target, err := url.ParseRequestURI(path)
+	if err != nil || !strings.HasPrefix(path, "/") {
+		http.Error(w, "path must be an absolute path", http.StatusBadRequest)
+		return
+	}
+	if target.Path == "/consistency" || target.Path == "/batch" {
+		http.Error(w, "path must not be /consistency or /batch", http.StatusBadRequest)
+		return
+	}
+	getReq, err := newSubRequest(r.Context(), r, http.MethodGet, path, nil)
+	if err != nil {
+		http.Error(w, "path must be a valid request target", http.StatusBadRequest)
+		return
+	}
+	headReq := getReq.Clone(r.Context())
+	headReq.Method = http.MethodHead
+	run := func(req *http.Request) *httptest.ResponseRecorder {
+		method := req.Method
+		for name, values := range r.Header {
+			if name != "Content-Length" && name != "Content-Type" && name != "Transfer-Encoding" {
+				req.Header[name] = values
+			}
+		}
+		rec := httptest.NewRecorder()
+		batchHandler.ServeHTTP(rec, req)
+		// As net/http's chunkWriter does for a handler that returned without
+		// flushing or declaring a length.
+		h := rec.Header()
+		bodyAllowed := rec.Code >= 200 && rec.Code != http.StatusNoContent && rec.Code != http.StatusNotModified
+		if h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" && h.Get("Trailer") == "" &&
+			!rec.Flushed && bodyAllowed && (method != http.MethodHead || rec.Body.Len() > 0) {
+			h.Set("Content-Length", strconv.Itoa(rec.Body.Len()))
+		}
+		return rec
+	}
+	get, head := run(getReq), run(headReq)
+
+	type headerDiff struct {
+		Header string   `json:"header"`
+		GET    []string `json:"get"`
+		HEAD   []string `json:"head"`
+	}
+	type consistencyResponse struct {
+		Path       string       `json:"path"`
+		Consistent bool         `json:"consistent"`
+		GETStatus  int          `json:"get_status"`
+		HEADStatus int          `json:"head_status"`
+		Diff       []headerDiff `json:"diff"`
+	}
+	resp := consistencyResponse{Path: path, GETStatus: get.Code, HEADStatus: head.Code, Diff: []headerDiff{}}
+	for _, name := range consistencyHeaders {
+		g, h := get.Header().Values(name), head.Header().Values(name)
+		if !slices.Equal(g, h) {
+			resp.Diff = append(resp.Diff, headerDiff{Header: name, GET: g, HEAD: h})
+		}
+	}
+	resp.Consistent = get.Code == head.Code && len(resp.Diff) == 0
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGzipStream streams `chunks` source chunks of `size` bytes, compressing
+// them incrementally: the gzip writer and the connection are flushed after each
+// chunk so the client can decompress progressively. Unlike handleBodyCodec,
+// nothing is buffered before sending.
+func handleGzipStream(w http.ResponseWriter, r *http.Request) {
+	chunks := getQueryInt(r, "chunks", 16)
+	size := getQueryInt(r, "size", 4096)
+	delayMs := getQueryInt(r, "ms", 0)
+	if chunks < 0 || size < 0 {
+		http.Error(w, "Invalid chunks or size", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	for i := 0; i < chunks; i++ {
+		if _, err := gz.Write([]byte(randomString(size))); err != nil {
+			return
+		}
+		if err := gz.Flush(); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if delayMs > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Duration(delayMs) * time.Millisecond):
+			}
+		}
+	}
+}
+
+// maxCountdown bounds the n of /countdown.
+const maxCountdown = 10000
+
+// handleCountdown streams the lines "n", "n-1", ... "1", "done", each flushed
+// on its own. The gap before each line shrinks linearly from ms (default
+// 1000) down to ms/n, so the stream starts slow and speeds up towards the
+// end: a non-uniform pattern for exercising adaptive client read timeouts.
+// It stops as soon as the client goes away.
+func handleCountdown(w http.ResponseWriter, r *http.Request) {
+	n := getQueryInt(r, "n", 10)
+	delayMs := getQueryInt(r, "ms", 1000)
+	if n < 1 || n > maxCountdown || delayMs < 0 {
+		http.Error(w, fmt.Sprintf("n must be in [1,%d] and ms >= 0", maxCountdown), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	line := make([]byte, 0, 8)
+	for k := n; k >= 0; k-- {
+		if k < n {
+			// Gaps run ms*n/n, ms*(n-1)/n, ... ms/n.
+			gap := time.Duration(delayMs) * time.Millisecond * time.Duration(k+1) / time.Duration(n)
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(gap):
+			}
+		}
+		if k > 0 {
+			line = append(strconv.AppendInt(line[:0], int64(k), 10), '\n')
+		} else {
+			line = append(line[:0], "done\n"...)
+		}
+		if _, err := w.Write(line); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// crockfordBase32 is the ULID alphabet.
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// handleID returns `count` (at most --max-id-count) identifiers of the given
+// `type` as a JSON array: uuid4 (122 random bits), uuid7 or ulid (48-bit
+// millisecond timestamp plus random bits). Every ID costs one crypto/rand read.
+func handleID(w http.ResponseWriter, r *http.Request) {
+	count := getQueryInt(r, "count", 1)
+	if count < 1 || count > maxIDCount {
+		http.Error(w, fmt.Sprintf("count must be in [1,%d]", maxIDCount), http.StatusBadRequest)
+		return
+	}
+	var gen func([]byte) []byte
+	switch queryValues(r).Get("type") {
+	case "", "uuid4":
+		gen = appendUUIDv4
+	case "uuid7":
+		gen = appendUUIDv7
+	case "ulid":
+		gen = appendULID
+	default:
+		http.Error(w, "Unsupported type (use uuid4, uuid7 or ulid)", http.StatusBadRequest)
+		return
+	}
+	buf := make([]byte, 0, count*39+2)
+	buf = append(buf, '[')
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, '"')
+		buf = gen(buf)
+		buf = append(buf, '"')
+	}
+	buf = append(buf, ']')
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, buf)
+}
+
+func appendUUIDv4(dst []byte) []byte {
+	var u [16]byte
+	cryptorand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return appendUUID(dst, u)
+}
+
+func appendUUIDv7(dst []byte) []byte {
+	var u [16]byte
+	putMillis48(u[:6], time.Now().UnixMilli())
+	cryptorand.Read(u[6:])
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+	return appendUUID(dst, u)
+}
+
+// appendUUID formats u in the canonical 8-4-4-4-12 hex form.
+func appendUUID(dst []byte, u [16]byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	for i, b := range u {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			dst = append(dst, '-')
+		}
+		dst = append(dst, hexDigits[b>>4], hexDigits[b&0x0f])
+	}
+	return dst
+}
+
+// appendULID encodes a 48-bit timestamp and 80 random bits as 26 Crockford
+// base32 characters, five bits at a time from the most significant end.
+func appendULID(dst []byte) []byte {
+	var u [16]byte
+	putMillis48(u[:6], time.Now().UnixMilli())
+	cryptorand.Read(u[6:])
+	// 128 bits into 26 characters: the first carries the top 3 bits.
+	hi := uint64(u[0])<<56 | uint64(u[1])<<48 | uint64(u[2])<<40 | uint64(u[3])<<32 |
+		uint64(u[4])<<24 | uint64(u[5])<<16 | uint64(u[6])<<8 | uint64(u[7])
+	lo := uint64(u[8])<<56 | uint64(u[9])<<48 | uint64(u[10])<<40 | uint64(u[11])<<32 |
+		uint64(u[12])<<24 | uint64(u[13])<<16 | uint64(u[14])<<8 | uint64(u[15])
+	for i := 25; i >= 0; i-- {
+		shift := uint(i * 5)
+		var v uint64
+		switch {
+		case shift >= 64:
+			v = hi >> (shift - 64)
+		case shift > 59:
+			v = lo>>shift | hi<<(64-shift)
+		default:
+			v = lo >> shift
+		}
+		dst = append(dst, crockfordBase32[v&0x1f])
+	}
+	return dst
+}
+
+// putMillis48 writes the low 48 bits of ms big-endian into b.
+func putMillis48(b []byte, ms int64) {
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+func handleCompute(w http.ResponseWriter, r *http.Request) {
+	complexity := getQueryInt(r, "complexity", 30)
+	hashIters := getQueryInt(r, "hash_iters", 1000)
+
+	fibResult, hashResult := computeResults(complexity, hashIters)
+
+	w.Header().Set("X-Fib-Result", strconv.FormatUint(fibResult, 10))
+	w.Header().Set("X-Hash-Result", strconv.FormatUint(hashResult, 10))
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "fib(%d)=%d, hash=%d", complexity, fibResult, hashResult)
+}
+
+// handleMandelbrot computes escape-time iteration counts over a width x height
+// grid of the fixed region [-2,1] x [-1.5,1.5] and returns their checksum, a
+// tunable CPU load whose result the compiler cannot discard. Dimensions are
+// capped by --max-mandelbrot-size and iter by --max-mandelbrot-iter.
+func handleMandelbrot(w http.ResponseWriter, r *http.Request) {
+	width := getQueryInt(r, "width", 256)
+	height := getQueryInt(r, "height", 256)
+	iter := getQueryInt(r, "iter", 256)
+	if width < 1 || width > maxMandelbrotSize || height < 1 || height > maxMandelbrotSize {
+		http.Error(w, fmt.Sprintf("width and height must be in [1,%d]", maxMandelbrotSize), http.StatusBadRequest)
+		return
+	}
+	if iter < 1 || iter > maxMandelbrotIter {
+		http.Error(w, fmt.Sprintf("iter must be in [1,%d]", maxMandelbrotIter), http.StatusBadRequest)
+		return
+	}
+	checksum := mandelbrotChecksum(width, height, iter)
+
+	w.Header().Set("X-Mandelbrot-Checksum", strconv.FormatUint(checksum, 10))
+	w.Header().Set("Content-Type", "text/plain")
+	writeBody(w, fmt.Appendf(nil, "mandelbrot(%dx%d, iter=%d)=%d", width, height, iter, checksum))
+}
+
+// computeResults runs the /compute workload, or with --coalesce joins an
+// in-flight computation with the same parameters.
+func computeResults(complexity, hashIters int) (fib, hash uint64) {
+	run := func() [2]uint64 {
+		return [2]uint64{fibonacci(complexity), computeHash(fmt.Sprintf("benchmark-data-%d", complexity), hashIters)}
+	}
+	if !coalesceCompute {
+		res := run()
+		return res[0], res[1]
+	}
+	ran := false
+	key := strconv.Itoa(complexity) + ":" + strconv.Itoa(hashIters)
+	v, _, _ := computeGroup.Do(key, func() (any, error) {
+		ran = true
+		return run(), nil
+	})
+	if !ran {
+		addCounter(&computeCoalesced, 1)
+	}
+	res := v.([2]uint64)
+	return res[0], res[1]
+}
+
+func handleJSON(w http.ResponseWriter, r *http.Request) {
+	items := getQueryInt(r, "items", 10)
+
+	type Item struct {
+		ID    int    `json:"id"`
+		Name  string `json:"name"`
+		Value int    `json:"value"`
+	}
+	type Response struct {
+		Items []Item `json:"items"`
+	}
+
+	resp := Response{Items: make([]Item, items)}
+	for i := 0; i < items; i++ {
+		resp.Items[i] = Item{
+			ID:    i,
+			Name:  fmt.Sprintf("item-%d", i),
+			Value: i * 100,
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// Trailing newline, as json.Encoder writes it.
+	writeBody(w, append(data, '\n'))
+}
+
+// maxSlowJSONItems bounds the items of /slow-json.
+const maxSlowJSONItems = 1000000
+
+// handleSlowJSON streams a JSON array of items elements, hashing work rounds
+// of FNV-1a before each one, like a server producing rows of a scan as it
+// goes. It flushes every flush elements (default 10) and reports the
+// production rate in the X-Elements-Per-Second trailer.
+func handleSlowJSON(w http.ResponseWriter, r *http.Request) {
+	items := getQueryInt(r, "items", 100)
+	work := getQueryInt(r, "work", 1000)
+	flushEvery := getQueryInt(r, "flush", 10)
+	if items < 0 || items > maxSlowJSONItems || work < 0 || flushEvery < 1 {
+		http.Error(w, fmt.Sprintf("items must be in [0,%d], work >= 0 and flush >= 1", maxSlowJSONItems), http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", "X-Elements-Per-Second")
+	w.WriteHeader(http.StatusOK)
+
+	start := time.Now()
+	buf := make([]byte, 0, 64)
+	seed := make([]byte, 0, 20)
+	for i := 0; i < items; i++ {
+		seed = strconv.AppendInt(seed[:0], int64(i), 10)
+		hash := computeHash(string(seed), work)
+		buf = buf[:0]
+		if i == 0 {
+			buf = append(buf, '[')
+		} else {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"id":`...)
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, `,"hash":`...)
+		buf = strconv.AppendUint(buf, hash, 10)
+		buf = append(buf, '}')
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+		if (i+1)%flushEvery == 0 {
+			_ = rc.Flush()
+		}
+	}
+	if items == 0 {
+		io.WriteString(w, "[")
+	}
+	io.WriteString(w, "]\n")
+	rate := float64(items) / time.Since(start).Seconds()
+	w.Header().Set("X-Elements-Per-Second", strconv.FormatFloat(rate, 'f', 1, 64))
+}
+
+// maxNDJSONLines bounds the lines of /ndjson.
+const maxNDJSONLines = 100000000
+
+// handleNDJSON streams lines newline-delimited JSON objects (default 100),
+// the /json items one per line, flushing every flush lines (default 10).
+// Each line is built in one reused buffer, so memory stays constant however
+// many lines are sent.
+func handleNDJSON(w http.ResponseWriter, r *http.Request) {
+	lines := getQueryInt(r, "lines", 100)
+	flushEvery := getQueryInt(r, "flush", 10)
+	if lines < 0 || lines > maxNDJSONLines || flushEvery < 1 {
+		http.Error(w, fmt.Sprintf("lines must be in [0,%d] and flush >= 1", maxNDJSONLines), http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	buf := make([]byte, 0, 64)
+	for i := 0; i < lines; i++ {
+		buf = append(buf[:0], `{"id":`...)
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, `,"name":"item-`...)
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, `","value":`...)
+		buf = strconv.AppendInt(buf, int64(i)*100, 10)
+		buf = append(buf, "}\n"...)
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+		if (i+1)%flushEvery == 0 && rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// itemListDesc describes the protobuf equivalent of the /json payload:
+//
+//	message Item { int32 id = 1; string name = 2; int32 value = 3; }
+//	message ItemList { repeated Item items = 1; }
+//
+// It is built at startup so no generated code or protoc step is required.
+var itemListDesc = mustBuildItemListDescriptor()
+
+func mustBuildItemListDescriptor() protoreflect.MessageDescriptor {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+	items := field("items", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	items.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	items.TypeName = proto.String(".bench.Item")
+
+	fileDesc, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("bench.proto"),
+		Package: proto.String("bench"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Item"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+					field("name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("value", 3, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+				},
+			},
+			{
+				Name:  proto.String("ItemList"),
+				Field: []*descriptorpb.FieldDescriptorProto{items},
+			},
+		},
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return fileDesc.Messages().ByName("ItemList")
+}
+
+// maxProtobufItems bounds the items of a /protobuf GET, which is built and
+// marshaled in memory.
+const maxProtobufItems = 1000000
+
+// handleProtobuf is the binary-serialization counterpart of /json.
+// GET marshals an ItemList with `items` entries; POST unmarshals the body and
+// reports how many items and populated fields it contained.
+func handleProtobuf(w http.ResponseWriter, r *http.Request) {
+	itemDesc := itemListDesc.Fields().ByName("items").Message()
+	itemFields := itemDesc.Fields()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		items := getQueryInt(r, "items", 10)
+		if items < 0 || items > maxProtobufItems {
+			http.Error(w, fmt.Sprintf("items must be in [0,%d]", maxProtobufItems), http.StatusBadRequest)
+			return
+		}
+		msg := dynamicpb.NewMessage(itemListDesc)
+		list := msg.Mutable(itemListDesc.Fields().ByName("items")).List()
+		for i := 0; i < items; i++ {
+			item := dynamicpb.NewMessage(itemDesc)
+			item.Set(itemFields.ByName("id"), protoreflect.ValueOfInt32(int32(i)))
+			item.Set(itemFields.ByName("name"), protoreflect.ValueOfString(fmt.Sprintf("item-%d", i)))
+			item.Set(itemFields.ByName("value"), protoreflect.ValueOfInt32(int32(i*100)))
+			list.Append(protoreflect.ValueOfMessage(item))
+		}
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			http.Error(w, "Marshal failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		writeBody(w, data)
+	case http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusInternalServerError)
+			return
+		}
+		msg := dynamicpb.NewMessage(itemListDesc)
+		if err := proto.Unmarshal(data, msg); err != nil {
+			http.Error(w, "Invalid protobuf body", http.StatusBadRequest)
+			return
+		}
+		list := msg.Get(itemListDesc.Fields().ByName("items")).List()
+		fields := 0
+		for i := 0; i < list.Len(); i++ {
+			list.Get(i).Message().Range(func(protoreflect.FieldDescriptor, protoreflect.Value) bool {
+				fields++
+				return true
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"items":%d,"fields":%d}`, list.Len(), fields)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// maxXMLItems bounds the items of a /xml GET, as maxSlowJSONItems does for
+// /slow-json.
+const maxXMLItems = 1000000
+
+// handleXML is the XML counterpart of /json and /protobuf. GET serializes
+// the same items with encoding/xml, one element at a time, so nothing beyond
+// the encoder's buffer is held:
+//
+//	<items><item><id>0</id><name>item-0</name><value>0</value></item>...</items>
+//
+// POST decodes such a document as a token stream and reports how many items
+// and item fields it held.
+func handleXML(w http.ResponseWriter, r *http.Request) {
+	type Item struct {
+		XMLName xml.Name `xml:"item"`
+		ID      int      `xml:"id"`
+		Name    string   `xml:"name"`
+		Value   int      `xml:"value"`
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		items := getQueryInt(r, "items", 10)
+		if items < 0 || items > maxXMLItems {
+			http.Error(w, fmt.Sprintf("items must be in [0,%d]", maxXMLItems), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, xml.Header)
+		enc := xml.NewEncoder(w)
+		root := xml.StartElement{Name: xml.Name{Local: "items"}}
+		if err := enc.EncodeToken(root); err != nil {
+			return
+		}
+		for i := 0; i < items; i++ {
+			if err := enc.Encode(Item{ID: i, Name: fmt.Sprintf("item-%d", i), Value: i * 100}); err != nil {
+				return
+			}
+		}
+		if enc.EncodeToken(root.End()) != nil || enc.Close() != nil {
+			return
+		}
+		io.WriteString(w, "\n")
+	case http.MethodPost:
+		dec := xml.NewDecoder(r.Body)
+		items, fields, depth := 0, 0, 0
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, "Invalid XML body", http.StatusBadRequest)
+				return
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				depth++
+				if depth == 2 && t.Name.Local == "item" {
+					items++
+				} else if depth == 3 {
+					fields++
+				}
+			case xml.EndElement:
+				depth--
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"items":%d,"fields":%d}`, items, fields)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEarlyHints sends a 103 Early Hints response carrying Link preload
+// headers, optionally waits `ms` milliseconds, then sends the final 200.
+func handleEarlyHints(w http.ResponseWriter, r *http.Request) {
+	delayMs := getQueryInt(r, "ms", 0)
+
+	w.Header().Add("Link", "</style.css>; rel=preload; as=style")
+	w.Header().Add("Link", "</app.js>; rel=preload; as=script")
+	w.WriteHeader(http.StatusEarlyHints)
+	if delayMs > 0 {
+		time.Sleep(time.Duration(delayMs) * time.Millisecond)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`<!DOCTYPE html><html><head><link rel="stylesheet" href="/style.css"><script src="/app.js"></script></head><body>early hints</body></html>`))
+}
+
+// handleFlaky simulates a flapping dependency: based on wall-clock time it
+// cycles between an `up_ms` window answering 200 and a `down_ms` window
+// answering 503, so clients can exercise their circuit breakers.
+func handleFlaky(w http.ResponseWriter, r *http.Request) {
+	upMs := int64(getQueryInt(r, "up_ms", 1000))
+	downMs := int64(getQueryInt(r, "down_ms", 1000))
+	if upMs < 0 || downMs < 0 || upMs+downMs == 0 {
+		http.Error(w, "Invalid up_ms or down_ms", http.StatusBadRequest)
+		return
+	}
+
+	pos := time.Now().UnixMilli() % (upMs + downMs)
+	w.Header().Set("Content-Type", "text/plain")
+	if pos < upMs {
+		flakyUp.Store(1)
+		addCounter(&flakyUpResponses, 1)
+		w.Header().Set("X-Flaky-State", "up")
+		w.Header().Set("X-Flaky-Remaining-Ms", strconv.FormatInt(upMs-pos, 10))
+		w.Write([]byte("up"))
+		return
+	}
+	flakyUp.Store(0)
+	addCounter(&flakyDownResponses, 1)
+	w.Header().Set("X-Flaky-State", "down")
+	w.Header().Set("X-Flaky-Remaining-Ms", strconv.FormatInt(upMs+downMs-pos, 10))
+	w.Header().Set("Retry-After", strconv.FormatInt((upMs+downMs-pos+999)/1000, 10))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("down"))
+}
+
+// maxQueryRows caps the `count` variable accepted by /query.
+const maxQueryRows = 10000
+
+// handleQuery benchmarks decoding a GraphQL-style POST body
+// {"query":"{ items { id name value } }","variables":{"count":10}} and encoding
+// a canned response: `count` rows, each carrying every field selected in the
+// innermost selection set. It is not a GraphQL engine.
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Query     string         `json:"query"`
+		Variables map[string]any `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Malformed JSON body", http.StatusBadRequest)
+		return
+	}
+	fields, err := parseQueryFields(req.Query)
+	if err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows := 10
+	if v, ok := req.Variables["count"]; ok {
+		count, ok := v.(float64)
+		if !ok || count < 0 || count > maxQueryRows || count != float64(int(count)) {
+			http.Error(w, "Invalid count variable", http.StatusBadRequest)
+			return
+		}
+		rows = int(count)
+	}
+
+	items := make([]map[string]string, rows)
+	for i := range items {
+		item := make(map[string]string, len(fields))
+		for _, field := range fields {
+			item[field] = fmt.Sprintf("%s-%d", field, i)
+		}
+		items[i] = item
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"items": items}})
+}
+
+// parseQueryFields validates brace balance and returns the field names of the
+// innermost selection set, e.g. [id name value] for "{ items { id name value } }".
+func parseQueryFields(query string) ([]string, error) {
+	depth, maxDepth, start := 0, 0, -1
+	var inner string
+	for i, c := range query {
+		switch c {
+		case '{':
+			depth++
+			if depth > maxDepth {
+				maxDepth, start = depth, i+1
+			}
+		case '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("unbalanced braces")
+			}
+			if depth == maxDepth && start >= 0 {
+				inner, start = query[start:i], -1
+			}
+			depth--
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced braces")
+	}
+	fields := strings.FieldsFunc(inner, func(c rune) bool {
+		return c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9')
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return fields, nil
+}
+
+// Caps for /csv parameters.
+const (
+	maxCSVRows = 1000000
+	maxCSVCols = 256
+)
+
+// handleCSV streams a header row plus `rows` data rows of `cols` columns,
+// flushing every 1000 rows.
+func handleCSV(w http.ResponseWriter, r *http.Request) {
+	rows := getQueryInt(r, "rows", 1000)
+	cols := getQueryInt(r, "cols", 8)
+	if rows < 0 || rows > maxCSVRows || cols <= 0 || cols > maxCSVCols {
+		http.Error(w, fmt.Sprintf("rows must be in [0,%d] and cols in [1,%d]", maxCSVRows, maxCSVCols), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="data.csv"`)
+	rc := http.NewResponseController(w)
+	cw := csv.NewWriter(w)
+	record := make([]string, cols)
+	for c := range record {
+		record[c] = fmt.Sprintf("col%d", c)
+	}
+	if err := cw.Write(record); err != nil {
+		return
+	}
+	for i := 0; i < rows; i++ {
+		for c := range record {
+			record[c] = strconv.Itoa(i*cols + c)
+		}
+		if err := cw.Write(record); err != nil {
+			return
+		}
+		if (i+1)%1000 == 0 {
+			cw.Flush()
+			if cw.Error() != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+	cw.Flush()
+}
+
+// Caps for /multipart-mixed parameters.
+const (
+	maxMultipartParts    = 10000
+	maxMultipartPartSize = 1 << 20
+)
+
+// multipartPartTypes are cycled through so each part carries its own Content-Type.
+var multipartPartTypes = []string{"text/plain; charset=utf-8", "application/json", "application/octet-stream"}
+
+// handleMultipartDownload streams a multipart/mixed body of `parts` parts, each
+// holding `size` random bytes, through a multipart.Writer.
+func handleMultipartDownload(w http.ResponseWriter, r *http.Request) {
+	parts := getQueryInt(r, "parts", 4)
+	size := getQueryInt(r, "size", 1024)
+	if parts < 0 || parts > maxMultipartParts || size < 0 || size > maxMultipartPartSize {
+		http.Error(w, fmt.Sprintf("parts must be in [0,%d] and size in [0,%d]", maxMultipartParts, maxMultipartPartSize), http.StatusBadRequest)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	for i := 0; i < parts; i++ {
+		contentType := multipartPartTypes[i%len(multipartPartTypes)]
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", contentType)
+		header.Set("Content-ID", fmt.Sprintf("<part-%d>", i))
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return
+		}
+		payload := randomString(size)
+		if contentType == "application/json" {
+			payload = `{"part":` + strconv.Itoa(i) + `,"data":"` + payload + `"}`
+		}
+		if _, err := io.WriteString(pw, payload); err != nil {
+			return
+		}
+	}
+	_ = mw.Close()
+}
+
+// handleParams returns every query parameter as JSON with sorted keys,
+// keeping all values of repeated keys in order. X-Params-Count reports the
+// number of values parsed.
+func handleParams(w http.ResponseWriter, r *http.Request) {
+	q := queryValues(r)
+	count := 0
+	for _, values := range q {
+		count += len(values)
+	}
+	// encoding/json emits map keys in sorted order.
+	data, err := json.Marshal(q)
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Params-Count", strconv.Itoa(count))
+	writeBody(w, data)
+}
+
+// handleSequence returns a globally monotonic, lock-free counter so clients
+// can check they saw every response exactly once under concurrency.
+func handleSequence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"sequence":%d}`, sequenceCounter.Add(1))
+}
+
+// handleResetSequence zeroes the /sequence counter and reports its last value.
+func handleResetSequence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"previous":%d}`, sequenceCounter.Swap(0))
+}
+
+// handleGC reports heap and GC statistics; a POST first runs a blocking
+// runtime.GC(), for A/B experiments on collection timing. The memory limit is
+// the one in effect, whether from --soft-mem-limit or GOMEMLIMIT.
+func handleGC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		runtime.GC()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	type Response struct {
+		HeapAlloc    uint64 `json:"heap_alloc"`
+		HeapInuse    uint64 `json:"heap_inuse"`
+		HeapSys      uint64 `json:"heap_sys"`
+		NextGC       uint64 `json:"next_gc"`
+		NumGC        uint32 `json:"num_gc"`
+		NumForcedGC  uint32 `json:"num_forced_gc"`
+		PauseTotalNs uint64 `json:"pause_total_ns"`
+		MemoryLimit  int64  `json:"memory_limit"`
+		Collected    bool   `json:"collected"`
+	}
+	body, err := json.Marshal(Response{
+		HeapAlloc:    ms.HeapAlloc,
+		HeapInuse:    ms.HeapInuse,
+		HeapSys:      ms.HeapSys,
+		NextGC:       ms.NextGC,
+		NumGC:        ms.NumGC,
+		NumForcedGC:  ms.NumForcedGC,
+		PauseTotalNs: ms.PauseTotalNs,
+		MemoryLimit:  debug.SetMemoryLimit(-1),
+		Collected:    r.Method == http.MethodPost,
+	})
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// cpuProfileMu allows one /admin/profile/cpu session at a time.
+var cpuProfileMu sync.Mutex
+
+// maxCPUProfileSeconds bounds the ?seconds of /admin/profile/cpu.
+const maxCPUProfileSeconds = 300
+
+// handleCPUProfile records a CPU profile for ?seconds (default 5) and returns
+// it as a pprof attachment. A second request while one is running, or while
+// another profiler such as net/http/pprof holds the CPU profile, gets 409.
+// The profile is cut short if the client goes away.
+func handleCPUProfile(w http.ResponseWriter, r *http.Request) {
+	seconds := getQueryInt(r, "seconds", 5)
+	if seconds < 1 || seconds > maxCPUProfileSeconds {
+		http.Error(w, fmt.Sprintf("seconds must be in [1,%d]", maxCPUProfileSeconds), http.StatusBadRequest)
+		return
+	}
+	if !cpuProfileMu.TryLock() {
+		http.Error(w, "CPU profile already running", http.StatusConflict)
+		return
+	}
+	defer cpuProfileMu.Unlock()
+
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		http.Error(w, "CPU profile already running: "+err.Error(), http.StatusConflict)
+		return
+	}
+	timer := time.NewTimer(time.Duration(seconds) * time.Second)
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		timer.Stop()
+	}
+	pprof.StopCPUProfile()
+	writeProfile(w, "cpu.pprof", buf.Bytes())
+}
+
+// handleHeapProfile returns a heap profile snapshot as a pprof attachment;
+// ?gc=1 runs a collection first so the in-use figures are current.
+func handleHeapProfile(w http.ResponseWriter, r *http.Request) {
+	if queryValues(r).Get("gc") == "1" {
+		runtime.GC()
+	}
+	var buf bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&buf, 0); err != nil {
+		http.Error(w, "Failed to write heap profile", http.StatusInternalServerError)
+		return
+	}
+	writeProfile(w, "heap.pprof", buf.Bytes())
+}
+
+func writeProfile(w http.ResponseWriter, filename string, data []byte) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
+
+// encodingSample is non-ASCII text representable in every /encoding charset.
+const encodingSample = "Grüße aus Köln: café, naïve, façade, señor, ½ déjà vu\n"
+
+// handleEncoding returns encodingSample encoded in the requested `charset`
+// (utf-8, latin-1 or utf-16) with a matching Content-Type charset parameter,
+// to test client decoding.
+func handleEncoding(w http.ResponseWriter, r *http.Request) {
+	requested := strings.ToLower(queryValues(r).Get("charset"))
+	var enc encoding.Encoding
+	var name string
+	switch requested {
+	case "", "utf-8", "utf8":
+		enc, name = unicode.UTF8, "utf-8"
+	case "latin-1", "latin1", "iso-8859-1":
+		enc, name = charmap.ISO8859_1, "iso-8859-1"
+	case "utf-16", "utf16":
+		enc, name = unicode.UTF16(unicode.BigEndian, unicode.UseBOM), "utf-16"
+	default:
+		http.Error(w, "Unsupported charset (use utf-8, latin-1 or utf-16)", http.StatusBadRequest)
+		return
+	}
+	body, err := enc.NewEncoder().Bytes([]byte(encodingSample))
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset="+name)
+	writeBody(w, body)
+}
+
+// supportedLocales are the /locale tags, the first being the default; the
+// greetings are in the same order.
+var (
+	supportedLocales = []language.Tag{language.English, language.French, language.German, language.Spanish, language.Japanese, language.BrazilianPortuguese}
+	localeGreetings  = []string{"Hello", "Bonjour", "Hallo", "Hola", "こんにちは", "Olá"}
+	localeMatcher    = language.NewMatcher(supportedLocales)
+)
+
+// handleLocale negotiates Accept-Language (q-values included) against
+// supportedLocales and returns the matched tag with its greeting as JSON,
+// falling back to the default locale when nothing matches.
+func handleLocale(w http.ResponseWriter, r *http.Request) {
+	index := 0
+	if accept := headerValue(r.Header, "Accept-Language"); accept != "" {
+		if prefs, _, err := language.ParseAcceptLanguage(accept); err == nil && len(prefs) > 0 {
+			if _, i, confidence := localeMatcher.Match(prefs...); confidence != language.No {
+				index = i
+			}
+		}
+	}
+	tag := supportedLocales[index].String()
+	body, _ := json.Marshal(struct {
+		Locale   string `json:"locale"`
+		Greeting string `json:"greeting"`
+	}{tag, localeGreetings[index]})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Language", tag)
+	w.Header().Set("Vary", "Accept-Language")
+	writeBody(w, body)
+}
+
+// handleTime returns one time.Now() reading as JSON in the requested `format`
+// (rfc3339, unix, unixnano or http), appended into a single buffer. Numeric
+// formats are JSON numbers; the query is only parsed when present.
+func handleTime(w http.ResponseWriter, r *http.Request) {
+	format := "rfc3339"
+	if r.URL.RawQuery != "" {
+		if f := queryValues(r).Get("format"); f != "" {
+			format = f
+		}
+	}
+	now := time.Now()
+	buf := make([]byte, 0, 96)
+	buf = append(buf, `{"format":"`...)
+	buf = append(buf, format...)
+	buf = append(buf, `","time":`...)
+	switch format {
+	case "rfc3339":
+		buf = append(buf, '"')
+		buf = now.AppendFormat(buf, time.RFC3339Nano)
+		buf = append(buf, '"')
+	case "unix":
+		buf = strconv.AppendInt(buf, now.Unix(), 10)
+	case "unixnano":
+		buf = strconv.AppendInt(buf, now.UnixNano(), 10)
+	case "http":
+		buf = append(buf, '"')
+		buf = now.UTC().AppendFormat(buf, http.TimeFormat)
+		buf = append(buf, '"')
+	default:
+		http.Error(w, "Unsupported format (use rfc3339, unix, unixnano or http)", http.StatusBadRequest)
+		return
+	}
+	buf = append(buf, '}')
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	writeBody(w, buf)
+}
 
-// Pattern route matchers
-var userPostPattern = regexp.MustCompile(`^/users/([^/]+)/posts/([^/]+)$`)
-var apiPattern = regexp.MustCompile(`^/api/v1/resources/([^/]+)/items/([^/]+)/actions/([^/]+)$`)
+func handleDelay(w http.ResponseWriter, r *http.Request) {
+	delayMs := getQueryInt(r, "ms", 10)
+	time.Sleep(time.Duration(delayMs) * time.Millisecond)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Delayed %d ms", delayMs)
+}
 
-func main() {
-	port := getPort()
-	numThreads = getThreads()
-	staticDir = getStaticDir()
-	routeCount = getRouteCount()
-	h2Enabled = hasFlag("--h2")
-	tlsEnabled = hasFlag("--tls")
-	certFile = getFlagValue("--cert")
-	keyFile = getFlagValue("--key")
+// maxBudgetOps bounds the ops of /latency-budget.
+const maxBudgetOps = 10000
 
-	// Limit Go scheduler parallelism to the requested count.
-	// GOMAXPROCS only limits goroutine parallelism; Go's runtime creates
-	// additional OS threads for sysmon, GC workers, and goroutines blocked in
-	// syscalls (e.g. file I/O). These typically add 3-5 threads on top of
-	// GOMAXPROCS. We intentionally do not hard-cap runtime threads because too
-	// small limits can trigger fatal "thread exhaustion" under load.
-	if numThreads > 0 {
-		// reserve ~2 slot for sysmon + GC/netpoller
-		procs := numThreads - 2
-		if procs < 1 {
-			procs = 1
+// handleLatencyBudget runs ops sequential sub-operations (default 10), each
+// sleeping ms milliseconds (default 20) then hashing work rounds of FNV-1a
+// (default 1000), all under one --latency-budget deadline carried by the
+// request context. Sleeps are cut short by the deadline and it is checked
+// between steps, so a sub-operation already hashing always finishes: the
+// overshoot_ms of the reply measures that granularity. It answers 200 when
+// every sub-operation completed and 206 with the results so far when the
+// budget ran out.
+func handleLatencyBudget(w http.ResponseWriter, r *http.Request) {
+	ops := getQueryInt(r, "ops", 10)
+	sleepMs := getQueryInt(r, "ms", 20)
+	work := getQueryInt(r, "work", 1000)
+	if ops < 0 || ops > maxBudgetOps || sleepMs < 0 || work < 0 {
+		http.Error(w, fmt.Sprintf("ops must be in [0,%d], ms and work >= 0", maxBudgetOps), http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), latencyBudget)
+	defer cancel()
+
+	results := make([]uint64, 0, ops)
+	sleep := time.NewTimer(time.Duration(sleepMs) * time.Millisecond)
+	defer sleep.Stop()
+	for i := 0; i < ops; i++ {
+		if i > 0 {
+			sleep.Reset(time.Duration(sleepMs) * time.Millisecond)
 		}
-		runtime.GOMAXPROCS(procs)
+		select {
+		case <-ctx.Done():
+		case <-sleep.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, computeHash("budget-op-"+strconv.Itoa(i), work))
 	}
 
-	// Build a deterministic router: literal route map + top-level handler
-	literalRoutes := make(map[string]http.HandlerFunc)
-
-	// Register literal endpoints
-	literalRoutes["/ping"] = handlePing
-	literalRoutes["/headers"] = handleHeaders
-	literalRoutes["/uppercase"] = handleUppercase
-	literalRoutes["/body-codec"] = handleBodyCodec
-	literalRoutes["/compute"] = handleCompute
-	literalRoutes["/json"] = handleJSON
-	literalRoutes["/delay"] = handleDelay
-	literalRoutes["/body"] = handleBody
-	literalRoutes["/status"] = handleStatus
+	type budgetResponse struct {
+		Ops         int      `json:"ops"`
+		Completed   int      `json:"completed"`
+		BudgetMs    float64  `json:"budget_ms"`
+		ElapsedMs   float64  `json:"elapsed_ms"`
+		OvershootMs float64  `json:"overshoot_ms"`
+		Results     []uint64 `json:"results"`
+	}
+	elapsed := time.Since(start)
+	resp := budgetResponse{
+		Ops:       ops,
+		Completed: len(results),
+		BudgetMs:  float64(latencyBudget.Microseconds()) / 1000,
+		ElapsedMs: float64(elapsed.Microseconds()) / 1000,
+		Results:   results,
+	}
+	status := http.StatusOK
+	if len(results) < ops {
+		status = http.StatusPartialContent
+		resp.OvershootMs = float64((elapsed - latencyBudget).Microseconds()) / 1000
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
 
-	if staticDir != "" {
-		// serve static via path /
-		literalRoutes["/"] = handleStatic
+func handleBody(w http.ResponseWriter, r *http.Request) {
+	size := getQueryInt(r, "size", 1024)
+	w.Header().Set("Content-Type", "text/plain")
+	writeBody(w, []byte(randomString(size)))
+}
+
+// maxRangeSize caps /range; its content is a prefix of one rangeData buffer.
+const maxRangeSize = 16 << 20
+
+// rangeModTime is the fixed Last-Modified of /range, so If-Range and
+// If-Modified-Since behave the same on every run.
+var rangeModTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	rangeDataOnce sync.Once
+	rangeData     []byte
+)
+
+// handleRangeDownload serves the first `size` bytes of a buffer generated once
+// from --seed through http.ServeContent, which handles Range, If-Range and
+// conditional requests against the fixed ModTime and an ETag naming the
+// seed and size.
+func handleRangeDownload(w http.ResponseWriter, r *http.Request) {
+	size := getQueryInt(r, "size", 1024*1024)
+	if size < 0 || size > maxRangeSize {
+		http.Error(w, fmt.Sprintf("size must be in [0,%d]", maxRangeSize), http.StatusBadRequest)
+		return
 	}
+	rangeDataOnce.Do(func() {
+		rangeData = make([]byte, maxRangeSize)
+		rand.New(rand.NewSource(seed)).Read(rangeData)
+	})
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fmt.Sprintf(`"range-%d-%d"`, seed, size))
+	http.ServeContent(w, r, "", rangeModTime, bytes.NewReader(rangeData[:size]))
+}
 
-	if routeCount > 0 {
-		for i := 0; i < routeCount; i++ {
-			idx := i // capture
-			path := fmt.Sprintf("/r%d", i)
-			literalRoutes[path] = func(w http.ResponseWriter, r *http.Request) {
-				w.Header().Set("Content-Type", "text/plain")
-				w.Write([]byte(fmt.Sprintf("route %d", idx)))
-			}
+// handleDownload streams `size` random bytes as an attachment named
+// `filename`, with an accurate Content-Length.
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	size := getQueryInt(r, "size", 1024*1024)
+	if size < 0 {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+	// Strip CR/LF so the filename cannot inject header lines; FormatMediaType
+	// then takes care of quoting and non-ASCII names.
+	filename := strings.NewReplacer("\r", "", "\n", "").Replace(queryValues(r).Get("filename"))
+	if filename == "" {
+		filename = "download.bin"
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	if disposition == "" {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	buf := make([]byte, 32*1024)
+	for size > 0 {
+		n := min(size, len(buf))
+		rng.Read(buf[:n])
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
 		}
+		size -= n
 	}
+}
 
-	// Top-level handler: check exact literal match first, then pattern routes, then static prefix
-	topHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
+// handleBackpressure writes `size` bytes in `chunk`-byte writes to observe a
+// slow consumer: once the socket buffers fill, Write blocks. Each chunk gets
+// its own --write-deadline (replacing the server-wide WriteTimeout), so a
+// stuck client fails the write and net/http closes the connection instead of
+// pinning the goroutine.
+func handleBackpressure(w http.ResponseWriter, r *http.Request) {
+	size := getQueryInt(r, "size", 64*1024*1024)
+	chunk := getQueryInt(r, "chunk", 64*1024)
+	if size < 0 || chunk <= 0 {
+		http.Error(w, "Invalid size or chunk", http.StatusBadRequest)
+		return
+	}
 
-		// Exact literal match
-		if h, ok := literalRoutes[path]; ok {
-			h(w, r)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	rc := http.NewResponseController(w)
+	buf := []byte(randomString(min(chunk, size)))
+	var blocked time.Duration
+	for written := 0; written < size; {
+		if err := rc.SetWriteDeadline(time.Now().Add(chunkWriteDeadline)); err != nil {
+			slog.Warn("/backpressure: write deadlines unsupported", "err", err)
 			return
 		}
+		n := min(len(buf), size-written)
+		start := time.Now()
+		if _, err := w.Write(buf[:n]); err != nil {
+			slog.Info("/backpressure: client stalled", "written", written, "size", size, "err", err)
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			slog.Info("/backpressure: client stalled", "written", written, "size", size, "err", err)
+			return
+		}
+		blocked += time.Since(start)
+		written += n
+	}
+	slog.Debug("/backpressure: done", "bytes", size, "blocked", blocked)
+}
+
+// handleThrottle writes size random bytes (default 1MB) paced to about kbps
+// kilobytes (1000 bytes) per second (default 100) by a token bucket, like a
+// server behind a slow link. Bytes go out in flushed chunks of a tenth of a
+// second's worth (at most 16KB), each with its own --write-deadline as in
+// /backpressure, so long transfers outlive the server-wide WriteTimeout. It
+// stops when the client disconnects and reports the achieved rate in the
+// X-Achieved-Kbps trailer.
+func handleThrottle(w http.ResponseWriter, r *http.Request) {
+	size := getQueryInt(r, "size", 1024*1024)
+	kbps := getQueryInt(r, "kbps", 100)
+	if size < 0 || kbps <= 0 {
+		http.Error(w, "size must be >= 0 and kbps > 0", http.StatusBadRequest)
+		return
+	}
+	bytesPerSec := kbps * 1000
+	chunk := min(max(bytesPerSec/10, 1), 16*1024)
+	limiter := rate.NewLimiter(rate.Limit(bytesPerSec), chunk)
 
-		// If static prefix registered, handle /... when literalRoutes has /static/
-		if staticDir != "" {
-			handleStatic(w, r)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", "X-Achieved-Kbps")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	buf := []byte(randomString(min(chunk, size)))
+	start := time.Now()
+	for written := 0; written < size; {
+		n := min(len(buf), size-written)
+		if err := limiter.WaitN(r.Context(), n); err != nil {
+			return
+		}
+		if chunkWriteDeadline > 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(chunkWriteDeadline))
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
 			return
 		}
+		written += n
+	}
+	achieved := float64(size) / 1000 / time.Since(start).Seconds()
+	w.Header().Set("X-Achieved-Kbps", strconv.FormatFloat(achieved, 'f', 1, 64))
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"server":"go","threads":%d,"h2":%t,"tls":%t,"status":"ok"}`, numThreads, h2Enabled, tlsEnabled)
+}
 
-		// Pattern routes
-		if userPostPattern.MatchString(path) {
-			handleUserPost(w, r)
+// handleCustomStatus answers with the status line "HTTP/1.1 <code> <reason>"
+// (/custom-status?code=200&reason=Groovy). net/http always writes the
+// standard reason phrase for a code, so the handler hijacks the connection
+// and writes the whole response itself. Once hijacked the connection is out
+// of net/http's hands, so the response carries "Connection: close" and the
+// connection is closed after it. HTTP/2 has no reason phrase at all; there
+// the code is sent normally and the reason is dropped.
+func handleCustomStatus(w http.ResponseWriter, r *http.Request) {
+	code := getQueryInt(r, "code", http.StatusOK)
+	reason := queryValues(r).Get("reason")
+	if code < 200 || code > 599 {
+		http.Error(w, "code must be in [200,599]", http.StatusBadRequest)
+		return
+	}
+	// reason-phrase = *( HTAB / SP / VCHAR / obs-text ) (RFC 9112 section 4).
+	for i := 0; i < len(reason); i++ {
+		if c := reason[i]; c != '\t' && (c < ' ' || c == 0x7f) {
+			http.Error(w, "Invalid reason phrase", http.StatusBadRequest)
 			return
 		}
-		if apiPattern.MatchString(path) {
-			handleApiPattern(w, r)
+	}
+	body := reason + "\n"
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		body = ""
+	}
+	if r.ProtoMajor != 1 {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(brw, "HTTP/1.1 %03d %s\r\nDate: %s\r\nContent-Type: text/plain\r\nConnection: close\r\n",
+		code, reason, time.Now().UTC().Format(http.TimeFormat))
+	if body != "" {
+		fmt.Fprintf(brw, "Content-Length: %d\r\n", len(body))
+	}
+	brw.WriteString("\r\n")
+	if r.Method != http.MethodHead {
+		brw.WriteString(body)
+	}
+	brw.Flush()
+}
+
+// /resource/{key} limits: bytes per value and keys stored.
+const (
+	maxResourceSize = 1 << 20
+	maxResourceKeys = 10000
+)
+
+// resourceEntry is one immutable version of a /resource value; writers swap
+// in a new entry rather than modifying one.
+type resourceEntry struct {
+	value       []byte
+	etag        string
+	contentType string
+}
+
+// resourceStore holds the /resource values by key; resourceCount tracks its
+// size and resourceVersion numbers the versions, each one's ETag.
+var (
+	resourceStore   sync.Map // key -> *resourceEntry
+	resourceCount   atomic.Int64
+	resourceVersion atomic.Uint64
+)
+
+// reserveResourceKey takes one of the maxResourceKeys slots for a new key,
+// reporting false when none is left. The slot is taken before the key is
+// stored, so concurrent creators cannot overshoot the limit between a check
+// and the store.
+func reserveResourceKey() bool {
+	for {
+		n := resourceCount.Load()
+		if n >= maxResourceKeys {
+			return false
+		}
+		if resourceCount.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// etagMatches reports whether an If-Match or If-None-Match list names etag,
+// "*" matching any. strong excludes weak tags, as If-Match requires.
+func etagMatches(list, etag string, strong bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if !strong {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// resourcePreconditions evaluates If-Match and If-None-Match against cur, nil
+// when the key does not exist.
+func resourcePreconditions(r *http.Request, cur *resourceEntry) bool {
+	if im := headerValue(r.Header, "If-Match"); im != "" && (cur == nil || !etagMatches(im, cur.etag, true)) {
+		return false
+	}
+	if inm := headerValue(r.Header, "If-None-Match"); inm != "" && cur != nil && etagMatches(inm, cur.etag, false) {
+		return false
+	}
+	return true
+}
+
+// handleResource is a small in-memory key-value store at /resource/{key}
+// with ETag-based optimistic concurrency, the one stateful resource here:
+//
+//   - GET and HEAD return the value with its Content-Type and ETag, through
+//     http.ServeContent (conditional GETs and ranges included), or 404;
+//   - PUT stores the body (at most 1MB, at most 10000 keys, else 413 or 507)
+//     and answers 201 when it created the key, 204 otherwise, with the new
+//     ETag; If-Match must name the current ETag and If-None-Match: * asks
+//     for creation only, or the write is refused with 412;
+//   - DELETE removes the key, under the same If-Match rule, or 404.
+//
+// Writes swap entries with sync.Map's compare-and-swap, so of two writers
+// holding the same ETag exactly one succeeds and the other gets 412.
+func handleResource(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/resource/")
+	if key == "" || strings.Contains(key, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	load := func() *resourceEntry {
+		if v, ok := resourceStore.Load(key); ok {
+			return v.(*resourceEntry)
+		}
+		return nil
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		cur := load()
+		if cur == nil {
+			http.NotFound(w, r)
 			return
 		}
+		w.Header().Set("Content-Type", cur.contentType)
+		w.Header().Set("ETag", cur.etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(cur.value))
 
-		// Fallback: check if a literal route was registered with trailing slash matching
-		// (e.g., /static/ may be registered). Try prefix matches in the literalRoutes map.
-		for lit, h := range literalRoutes {
-			if strings.HasSuffix(lit, "/") && strings.HasPrefix(path, lit) {
-				h(w, r)
+	case http.MethodPut:
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxResourceSize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		next := &resourceEntry{
+			value:       value,
+			etag:        fmt.Sprintf(`"v%d"`, resourceVersion.Add(1)),
+			contentType: contentType,
+		}
+		for {
+			cur := load()
+			if !resourcePreconditions(r, cur) {
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+			if cur == nil {
+				if !reserveResourceKey() {
+					http.Error(w, "Resource store full", http.StatusInsufficientStorage)
+					return
+				}
+				if _, loaded := resourceStore.LoadOrStore(key, next); loaded {
+					resourceCount.Add(-1)
+					continue // created concurrently: evaluate again
+				}
+				w.Header().Set("ETag", next.etag)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			if resourceStore.CompareAndSwap(key, cur, next) {
+				w.Header().Set("ETag", next.etag)
+				w.WriteHeader(http.StatusNoContent)
 				return
 			}
 		}
 
-		http.NotFound(w, r)
-	})
+	case http.MethodDelete:
+		for {
+			cur := load()
+			if cur == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if !resourcePreconditions(r, cur) {
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+			if resourceStore.CompareAndDelete(key, cur) {
+				resourceCount.Add(-1)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
 
-	// Wrap handler for h2c (HTTP/2 cleartext) if requested
-	var handler http.Handler = topHandler
-	if h2Enabled && !tlsEnabled {
-		h2s := &http2.Server{}
-		handler = h2c.NewHandler(topHandler, h2s)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
+}
 
-	server := &http.Server{
-		Addr:           fmt.Sprintf("127.0.0.1:%d", port),
-		Handler:        handler,
-		ReadTimeout:    30 * time.Second,
-		WriteTimeout:   30 * time.Second,
-		MaxHeaderBytes: 256 * 1024, // 256KB headers for stress tests
-	}
+// maxReflectSpec bounds the request body of /reflect-status-from-body.
+const maxReflectSpec = 64 * 1024
 
-	// For TLS with HTTP/2, configure TLS and use http2.ConfigureServer
-	if tlsEnabled && h2Enabled {
-		http2.ConfigureServer(server, &http2.Server{})
+// handleReflectStatus answers with the response a POSTed JSON spec
+// describes, for clients to script any response without a new route:
+//
+//	{"status":201,"headers":{"X-Foo":"bar"},"body":"hi"}
+//
+// status defaults to 200 and must be in [200,599]. Header names and values
+// must be valid field names and values, so CR, LF and NUL cannot inject
+// header lines; Content-Length and Transfer-Encoding are refused, net/http
+// framing the body itself. A body with a status that forbids one (204, 304)
+// is refused too. Any invalid spec gets 400.
+func handleReflectStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-
-	protocol := "http/1.1"
-	if h2Enabled {
-		if tlsEnabled {
-			protocol = "h2-tls"
-		} else {
-			protocol = "h2c"
+	var spec struct {
+		Status  int               `json:"status"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReflectSpec)).Decode(&spec); err != nil {
+		http.Error(w, `Body must be {"status":N,"headers":{...},"body":"..."}`, http.StatusBadRequest)
+		return
+	}
+	if spec.Status == 0 {
+		spec.Status = http.StatusOK
+	}
+	if spec.Status < 200 || spec.Status > 599 {
+		http.Error(w, "status must be in [200,599]", http.StatusBadRequest)
+		return
+	}
+	if spec.Body != "" && (spec.Status == http.StatusNoContent || spec.Status == http.StatusNotModified) {
+		http.Error(w, fmt.Sprintf("status %d cannot have a body", spec.Status), http.StatusBadRequest)
+		return
+	}
+	for name, value := range spec.Headers {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			http.Error(w, fmt.Sprintf("invalid header %q", name), http.StatusBadRequest)
+			return
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Transfer-Encoding":
+			http.Error(w, fmt.Sprintf("header %q is set by the server", name), http.StatusBadRequest)
+			return
 		}
 	}
-	fmt.Printf("go benchmark server starting on port %d with %d threads [%s]\n", port, numThreads, protocol)
-	if staticDir != "" {
-		fmt.Printf("Static files: %s\n", staticDir)
+	for name, value := range spec.Headers {
+		w.Header().Set(name, value)
 	}
-	if routeCount > 0 {
-		fmt.Printf("Routes: %d literal + pattern routes\n", routeCount)
+	w.WriteHeader(spec.Status)
+	io.WriteString(w, spec.Body)
+}
+
+// lateHeaderWriter keeps a copy of the response headers as they were when
+// the status was written, explicitly or by the first Write, so the ones set
+// afterwards, which net/http silently drops, can be reported.
+type lateHeaderWriter struct {
+	http.ResponseWriter
+	sent http.Header
+}
+
+func (lw *lateHeaderWriter) WriteHeader(code int) {
+	if lw.sent == nil && code >= 200 {
+		lw.sent = lw.Header().Clone()
 	}
-	var err error
-	if tlsEnabled && certFile != "" && keyFile != "" {
-		err = server.ListenAndServeTLS(certFile, keyFile)
-	} else {
-		err = server.ListenAndServe()
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *lateHeaderWriter) Write(p []byte) (int, error) {
+	if lw.sent == nil {
+		lw.sent = lw.Header().Clone()
 	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
-		os.Exit(1)
+	return lw.ResponseWriter.Write(p)
+}
+
+func (lw *lateHeaderWriter) Flush() {
+	if lw.sent == nil {
+		lw.sent = lw.Header().Clone()
 	}
+	_ = http.NewResponseController(lw.ResponseWriter).Flush()
 }
 
-func handlePing(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("pong"))
+func (lw *lateHeaderWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
 }
 
-func handleHeaders(w http.ResponseWriter, r *http.Request) {
-	count := getQueryInt(r, "count", 10)
-	size := getQueryInt(r, "size", 64)
+// late returns the sorted names of the headers added or changed since the
+// status was written. Trailers, declared in Trailer or with the
+// http.TrailerPrefix, are meant to be set then and are left out.
+func (lw *lateHeaderWriter) late() []string {
+	if lw.sent == nil {
+		return nil
+	}
+	var names []string
+	for name, values := range lw.Header() {
+		if strings.HasPrefix(name, http.TrailerPrefix) ||
+			httpguts.HeaderValuesContainsToken(lw.sent["Trailer"], name) {
+			continue
+		}
+		if !slices.Equal(values, lw.sent[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
 
-	for i := 0; i < count; i++ {
-		name := fmt.Sprintf("X-Bench-Header-%d", i)
-		value := randomString(size)
-		w.Header().Set(name, value)
+// handlePartialWriteFlush shows a common handler mistake: headers set after
+// the body has started. It sets X-Before-Write, writes and flushes (unless
+// flush=0) a first line, then sets X-After-Write and switches Content-Type
+// to application/json before a second line. net/http sends the headers with
+// the first Write, flushed or not, so the client sees X-Before-Write and
+// text/plain only, the later changes being dropped without an error; under
+// HTTP/2 likewise. The handler logs the dropped headers: a warning the first
+// time, at debug level after that, since load tests hit it on every request.
+func handlePartialWriteFlush(w http.ResponseWriter, r *http.Request) {
+	lw := &lateHeaderWriter{ResponseWriter: w}
+	h := lw.Header()
+	h.Set("Content-Type", "text/plain")
+	h.Set("X-Before-Write", "sent")
+	io.WriteString(lw, "part 1: the headers go out with this first write\n")
+	if queryValues(r).Get("flush") != "0" {
+		lw.Flush()
+	}
+	h.Set("X-After-Write", "dropped")
+	h.Set("Content-Type", "application/json")
+	io.WriteString(lw, "part 2: X-After-Write and the new Content-Type were dropped\n")
+	if late := lw.late(); len(late) > 0 {
+		level := slog.LevelDebug
+		lateHeadersWarnOnce.Do(func() { level = slog.LevelWarn })
+		slog.Log(r.Context(), level, "headers set after the first write were dropped", "path", r.URL.Path, "headers", late)
 	}
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "Generated %d headers", count)
 }
 
-func handleUppercase(w http.ResponseWriter, r *http.Request) {
-	data, err := io.ReadAll(r.Body)
+// lateHeadersWarnOnce limits the /partial-write-flush warning to the first
+// request.
+var lateHeadersWarnOnce sync.Once
+
+// maxCloseRaceDelay bounds the us of /connection-close-race.
+const maxCloseRaceDelay = 10 * time.Second
+
+// handleConnectionCloseRace answers 200 "ok" and then closes the socket us
+// microseconds later (default 0), reproducing a server dropping a connection
+// just as the client reuses it. The connection is hijacked so the close
+// happens at that exact point rather than whenever net/http gets to it. A
+// follow-up request written meanwhile is never read, and closing with it
+// unread makes the kernel answer with a reset, as in the real race. The
+// response announces "Connection: close" unless announce=0, which makes it
+// look reusable: the case a client's retry-on-closed-idle-connection logic
+// has to handle.
+func handleConnectionCloseRace(w http.ResponseWriter, r *http.Request) {
+	delay := time.Duration(getQueryInt(r, "us", 0)) * time.Microsecond
+	if delay < 0 || delay > maxCloseRaceDelay {
+		http.Error(w, fmt.Sprintf("us must be in [0,%d]", maxCloseRaceDelay.Microseconds()), http.StatusBadRequest)
+		return
+	}
+	announce := queryValues(r).Get("announce") != "0"
+	if r.ProtoMajor != 1 {
+		http.Error(w, "HTTP/1.x required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
 	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusInternalServerError)
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
-
-	for i := range data {
-		b := data[i]
-		if 'a' <= b && b <= 'z' {
-			data[i] = b - ('a' - 'A')
-		}
+	defer conn.Close()
+	fmt.Fprintf(brw, "HTTP/1.1 200 OK\r\nDate: %s\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n",
+		time.Now().UTC().Format(http.TimeFormat))
+	if announce {
+		brw.WriteString("Connection: close\r\n")
+	}
+	brw.WriteString("\r\n")
+	if r.Method != http.MethodHead {
+		brw.WriteString("ok")
+	}
+	if brw.Flush() != nil {
+		return
 	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
-	_, _ = w.Write(data)
+// handleVersion reports the build metadata so benchmark results can be
+// attributed to a specific build.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	type versionResponse struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		BuildTime string `json:"build_time"`
+		GoVersion string `json:"go_version"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versionResponse{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	})
 }
 
-func handleBodyCodec(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+// handleFavicon avoids 404 noise from browsers poking the server.
+func handleFavicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Header().Set("Content-Length", strconv.Itoa(len(faviconPNG)))
+	_, _ = w.Write(faviconPNG)
+}
+
+// handleStatic serves staticFS, mapping directory paths (ending in "/",
+// including "/" itself) to their index.html.
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	decoded := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/"))
+	if strings.HasSuffix(r.URL.Path, "/") {
+		decoded = path.Join(decoded, "index.html")
+	}
+	// fs.FS names are unrooted and may not contain "..", so traversal outside
+	// the static root is rejected by Open.
+	name := strings.TrimPrefix(decoded, "/")
+	if !fs.ValidPath(name) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	var reader io.ReadCloser = r.Body
-	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
-		gz, err := gzip.NewReader(r.Body)
+
+	var content io.ReadSeeker
+	var info fs.FileInfo
+	var etag string
+	if cached, ok := staticCache[name]; ok {
+		content, info, etag = bytes.NewReader(cached.data), cached.info, cached.etag
+	} else {
+		file, err := staticFS.Open(name)
 		if err != nil {
-			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			http.NotFound(w, r)
 			return
 		}
-		reader = gz
-		defer gz.Close()
-	}
-	defer reader.Close()
-
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusInternalServerError)
-		return
-	}
-	for i := range data {
-		data[i] = data[i] + 1
-	}
-	w.Header().Set("Content-Type", "application/octet-stream")
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		var buf bytes.Buffer
-		gz := gzip.NewWriter(&buf)
-		if _, err := gz.Write(data); err != nil {
-			_ = gz.Close()
-			http.Error(w, "Compression failed", http.StatusInternalServerError)
+		defer file.Close()
+		if info, err = file.Stat(); err != nil || info.IsDir() {
+			http.NotFound(w, r)
 			return
 		}
-		if err := gz.Close(); err != nil {
-			http.Error(w, "Compression failed", http.StatusInternalServerError)
+		if content, ok = file.(io.ReadSeeker); !ok {
+			http.Error(w, "Unseekable file", http.StatusInternalServerError)
+			return
+		}
+		if etag, err = staticETag(name, info, content); err != nil {
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Content-Encoding", "gzip")
-		w.Header().Add("Vary", "Accept-Encoding")
-		_, _ = w.Write(buf.Bytes())
-		return
 	}
-	_, _ = w.Write(data)
-}
 
-func handleCompute(w http.ResponseWriter, r *http.Request) {
-	complexity := getQueryInt(r, "complexity", 30)
-	hashIters := getQueryInt(r, "hash_iters", 1000)
-
-	fibResult := fibonacci(complexity)
-	hashResult := computeHash(fmt.Sprintf("benchmark-data-%d", complexity), hashIters)
-
-	w.Header().Set("X-Fib-Result", strconv.FormatUint(fibResult, 10))
-	w.Header().Set("X-Hash-Result", strconv.FormatUint(hashResult, 10))
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "fib(%d)=%d, hash=%d", complexity, fibResult, hashResult)
+	contentType := getContentType(decoded)
+	if contentType == "" {
+		var err error
+		if contentType, err = sniffContentType(content); err != nil {
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
 }
 
-func handleJSON(w http.ResponseWriter, r *http.Request) {
-	items := getQueryInt(r, "items", 10)
+// preloadStatic reads every regular file of fsys into memory using up to
+// concurrency goroutines (--preload-concurrency), returning the cache and its
+// total size. Workers only hand results back over a channel, so the map is
+// written by this goroutine alone.
+func preloadStatic(fsys fs.FS, concurrency int) (map[string]*cachedFile, int64, error) {
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			names = append(names, name)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	concurrency = max(1, min(concurrency, len(names)))
 
-	type Item struct {
-		ID    int    `json:"id"`
-		Name  string `json:"name"`
-		Value int    `json:"value"`
+	type loaded struct {
+		name string
+		file *cachedFile
+		err  error
 	}
-	type Response struct {
-		Items []Item `json:"items"`
+	jobs := make(chan string)
+	results := make(chan loaded)
+	for range concurrency {
+		go func() {
+			for name := range jobs {
+				data, err := fs.ReadFile(fsys, name)
+				var info fs.FileInfo
+				if err == nil {
+					info, err = fs.Stat(fsys, name)
+				}
+				file := &cachedFile{data: data, info: info}
+				if err == nil {
+					file.etag, err = contentETag(info, bytes.NewReader(data))
+				}
+				results <- loaded{name, file, err}
+			}
+		}()
 	}
+	go func() {
+		for _, name := range names {
+			jobs <- name
+		}
+		close(jobs)
+	}()
 
-	resp := Response{Items: make([]Item, items)}
-	for i := 0; i < items; i++ {
-		resp.Items[i] = Item{
-			ID:    i,
-			Name:  fmt.Sprintf("item-%d", i),
-			Value: i * 100,
+	cache := make(map[string]*cachedFile, len(names))
+	var size int64
+	for range names {
+		res := <-results
+		if res.err != nil && err == nil {
+			err = fmt.Errorf("%s: %w", res.name, res.err)
 		}
+		cache[res.name] = res.file
+		size += int64(len(res.file.data))
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cache, size, nil
 }
 
-func handleDelay(w http.ResponseWriter, r *http.Request) {
-	delayMs := getQueryInt(r, "ms", 10)
-	time.Sleep(time.Duration(delayMs) * time.Millisecond)
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "Delayed %d ms", delayMs)
+// sniffContentType applies http.DetectContentType to the first 512 bytes and
+// rewinds content.
+func sniffContentType(content io.ReadSeeker) (string, error) {
+	var head [512]byte
+	n, err := io.ReadFull(content, head[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
 }
 
-func handleBody(w http.ResponseWriter, r *http.Request) {
-	size := getQueryInt(r, "size", 1024)
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(randomString(size)))
+// staticETagKey identifies a version of a static file in staticETags.
+type staticETagKey struct {
+	name    string
+	modTime int64
+	size    int64
 }
 
-func handleStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"server":"go","threads":%d,"h2":%t,"tls":%t,"status":"ok"}`, numThreads, h2Enabled, tlsEnabled)
-}
+// staticETags caches the content-hashed ETags of files that are not
+// preloaded, so each file is hashed once rather than on every request. Only
+// files without a modification time are hashed, embedded ones for a start,
+// and those do not change, so the cache stays as small as the file set.
+var staticETags sync.Map // staticETagKey -> string
 
-func handleStatic(w http.ResponseWriter, r *http.Request) {
-	// Strip / prefix
-	filePath := strings.TrimPrefix(r.URL.Path, "/")
-	if filePath == "" {
-		http.NotFound(w, r)
-		return
+// staticETag returns the ETag of the static file name, from staticETags when
+// it was hashed before.
+func staticETag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if !info.ModTime().IsZero() {
+		return contentETag(info, content)
 	}
-	decoded := filepath.Clean("/" + filePath)
-	if decoded == "/" {
-		http.NotFound(w, r)
-		return
+	key := staticETagKey{name, info.ModTime().UnixNano(), info.Size()}
+	if etag, ok := staticETags.Load(key); ok {
+		return etag.(string), nil
 	}
-	fullPath := filepath.Join(staticDir, decoded)
-
-	absStatic, _ := filepath.Abs(staticDir)
-	absPath, _ := filepath.Abs(fullPath)
-	if !strings.HasPrefix(absPath, absStatic) {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
+	etag, err := contentETag(info, content)
+	if err == nil {
+		staticETags.Store(key, etag)
 	}
+	return etag, err
+}
 
-	file, err := os.Open(fullPath)
-	if err != nil {
-		http.NotFound(w, r)
-		return
+// contentETag derives a strong ETag from size and modification time. Embedded
+// files have no modification time, so their content is hashed instead.
+func contentETag(info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()), nil
 	}
-	defer file.Close()
-	info, err := file.Stat()
-	if err != nil || info.IsDir() {
-		http.NotFound(w, r)
-		return
+	h := fnv.New64a()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
 	}
-
-	contentType := getContentType(decoded)
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
-	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x-%x"`, h.Sum64(), info.Size()), nil
 }
 
 func handleUserPost(w http.ResponseWriter, r *http.Request) {
-	matches := userPostPattern.FindStringSubmatch(r.URL.Path)
-	if matches == nil {
+	var buf [2]string
+	params, ok := userPostPattern.match(r.URL.Path, buf[:0])
+	if !ok {
 		http.NotFound(w, r)
 		return
 	}
-	fmt.Fprintf(w, "user %s post %s", matches[1], matches[2])
+	fmt.Fprintf(w, "user %s post %s", params[0], params[1])
 }
 
 func handleApiPattern(w http.ResponseWriter, r *http.Request) {
-	matches := apiPattern.FindStringSubmatch(r.URL.Path)
-	if matches == nil {
+	var buf [3]string
+	params, ok := apiPattern.match(r.URL.Path, buf[:0])
+	if !ok {
 		http.NotFound(w, r)
 		return
 	}
-	fmt.Fprintf(w, "resource %s item %s action %s", matches[1], matches[2], matches[3])
+	fmt.Fprintf(w, "resource %s item %s action %s", params[0], params[1], params[2])
 }
 
-func getContentType(path string) string {
-	switch {
-	case strings.HasSuffix(path, ".html"):
+// newGeneratedPatternRoute builds the idx-th --pattern-routes route. Depth
+// cycles from 1 to 4 parameters: /p{idx}/{a}, /p{idx}/{a}/{b}, ...
+func newGeneratedPatternRoute(idx int) patternRoute {
+	depth := 1 + idx%4
+	pattern := compileSegmentPattern(fmt.Sprintf("/p%d%s", idx, strings.Repeat("/:param", depth)))
+	return patternRoute{
+		pattern: pattern,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			var buf [4]string
+			params, ok := pattern.match(r.URL.Path, buf[:0])
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "pattern %d params %s", idx, strings.Join(params, ","))
+		},
+	}
+}
+
+// getContentType maps a file name to its Content-Type, consulting the
+// --mime-types overrides first. It returns "" for unknown extensions so the
+// caller can sniff the content instead.
+func getContentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, ok := mimeOverrides[ext]; ok {
+		return contentType
+	}
+	switch ext {
+	case ".html", ".htm":
 		return "text/html"
-	case strings.HasSuffix(path, ".css"):
+	case ".css":
 		return "text/css"
-	case strings.HasSuffix(path, ".js"):
+	case ".js", ".mjs":
 		return "application/javascript"
-	case strings.HasSuffix(path, ".json"):
+	case ".json", ".map":
 		return "application/json"
-	default:
+	case ".txt":
+		return "text/plain"
+	case ".xml":
+		return "application/xml"
+	case ".svg":
+		return "image/svg+xml"
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".avif":
+		return "image/avif"
+	case ".ico":
+		return "image/x-icon"
+	case ".woff":
+		return "font/woff"
+	case ".woff2":
+		return "font/woff2"
+	case ".ttf":
+		return "font/ttf"
+	case ".otf":
+		return "font/otf"
+	case ".wasm":
+		return "application/wasm"
+	case ".pdf":
+		return "application/pdf"
+	case ".mp4":
+		return "video/mp4"
+	case ".webm":
+		return "video/webm"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".bin":
 		return "application/octet-stream"
+	default:
+		return ""
+	}
+}
+
+// loadMimeTypes reads --mime-types overrides: one "extension type" pair per
+// line (e.g. ".md text/markdown"), blank lines and # comments ignored.
+func loadMimeTypes(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"extension type\"", i+1)
+		}
+		ext := strings.ToLower(fields[0])
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		overrides[ext] = fields[1]
 	}
+	return overrides, nil
 }
 
 func getPort() int {
@@ -447,8 +7630,26 @@ func getRouteCount() int {
 	return 1000
 }
 
+func getFlagInt(flag string, defaultValue int) int {
+	if val := getFlagValue(flag); val != "" {
+		if n, err := strconv.Atoi(val); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getFlagDuration(flag string, defaultValue time.Duration) time.Duration {
+	if val := getFlagValue(flag); val != "" {
+		if d, err := time.ParseDuration(val); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
 func getQueryInt(r *http.Request, key string, defaultValue int) int {
-	if val := r.URL.Query().Get(key); val != "" {
+	if val := queryValues(r).Get(key); val != "" {
 		if n, err := strconv.Atoi(val); err == nil {
 			return n
 		}
@@ -458,12 +7659,31 @@ func getQueryInt(r *http.Request, key string, defaultValue int) int {
 
 func randomString(length int) string {
 	b := make([]byte, length)
+	if seededRand != nil {
+		seededRand.fill(b)
+		return string(b)
+	}
 	for i := range b {
 		b[i] = charset[rand.Intn(len(charset))]
 	}
 	return string(b)
 }
 
+// lockedRand is a goroutine-safe wrapper around a seeded *rand.Rand.
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// fill overwrites b with random charset bytes under a single lock acquisition.
+func (l *lockedRand) fill(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range b {
+		b[i] = charset[l.rng.Intn(len(charset))]
+	}
+}
+
 func fibonacci(n int) uint64 {
 	if n <= 1 {
 		return uint64(n)
@@ -487,6 +7707,511 @@ func computeHash(data string, iterations int) uint64 {
 	return hash
 }
 
+// mandelbrotChecksum folds the escape iteration count of every pixel, row by
+// row, into an FNV-1a hash. The explicit float64 conversions forbid fused
+// multiply-add, so the result is identical on every architecture.
+func mandelbrotChecksum(width, height, maxIter int) uint64 {
+	hash := uint64(0xcbf29ce484222325) // FNV-1a offset basis
+	for py := 0; py < height; py++ {
+		ci := 1.5 - 3*float64(py)/float64(height)
+		for px := 0; px < width; px++ {
+			cr := -2 + 3*float64(px)/float64(width)
+			zr, zi := 0.0, 0.0
+			n := 0
+			for ; n < maxIter; n++ {
+				zr2, zi2 := float64(zr*zr), float64(zi*zi)
+				if zr2+zi2 > 4 {
+					break
+				}
+				zi = float64(2*zr*zi) + ci
+				zr = float64(zr2-zi2) + cr
+			}
+			for shift := 0; shift < 32; shift += 8 {
+				hash ^= uint64(n>>shift) & 0xff
+				hash *= 0x100000001b3 // FNV-1a prime
+			}
+		}
+	}
+	return hash
+}
+
+// selfTestCase is one request of --self-test against a route.
+type selfTestCase struct {
+	route  string // route template covered, as listed by router.routes
+	method string
+	target string
+	header http.Header
+	body   string
+	status int  // expected status; 0 leaves it to check
+	stream bool // read the body as a slow consumer would
+	check  func(resp *http.Response, body []byte) error
+}
+
+// selfTestReadSize and selfTestReadPause make a streaming case's client a
+// deterministic slow consumer: small reads with a pause after each one.
+const (
+	selfTestReadSize  = 4096
+	selfTestReadPause = time.Millisecond
+)
+
+// selfTestBody returns a check that the body is exactly want.
+func selfTestBody(want string) func(*http.Response, []byte) error {
+	return func(_ *http.Response, body []byte) error {
+		if string(body) != want {
+			return fmt.Errorf("body %q, want %q", truncateForLog(body), truncateForLog([]byte(want)))
+		}
+		return nil
+	}
+}
+
+// selfTestSize returns a check that the body is n bytes long.
+func selfTestSize(n int) func(*http.Response, []byte) error {
+	return func(_ *http.Response, body []byte) error {
+		if len(body) != n {
+			return fmt.Errorf("body of %d bytes, want %d", len(body), n)
+		}
+		return nil
+	}
+}
+
+// selfTestJSON returns a check that the body is JSON containing want.
+func selfTestJSON(want string) func(*http.Response, []byte) error {
+	return func(_ *http.Response, body []byte) error {
+		if !json.Valid(body) {
+			return fmt.Errorf("invalid JSON %q", truncateForLog(body))
+		}
+		if !bytes.Contains(body, []byte(want)) {
+			return fmt.Errorf("body %q lacks %q", truncateForLog(body), want)
+		}
+		return nil
+	}
+}
+
+// gunzipString decompresses a gzip body.
+func gunzipString(body []byte) (string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(zr)
+	return string(data), err
+}
+
+// gzipString compresses s.
+func gzipString(s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.String()
+}
+
+// truncateForLog keeps error messages about bodies short.
+func truncateForLog(b []byte) []byte {
+	if len(b) > 64 {
+		return b[:64]
+	}
+	return b
+}
+
+// selfTestCases lists the --self-test requests against the server at base:
+// at least one per route of newLiteralRoutes, the fixed patterns and the
+// static tree, with small parameters so the whole run takes a second or so,
+// plus error cases. Streaming routes are read incrementally and compressed
+// ones decoded on the client side. notFound adds the unmatched-path case,
+// which only answers 404 without --default-handler.
+func selfTestCases(base string, notFound bool) []selfTestCase {
+	gz := gzipString("self-test payload")
+	cases := []selfTestCase{
+		{route: "/ping", target: "/ping", status: 200, check: selfTestBody("pong")},
+		{route: "/readyz", target: "/readyz", status: 200, check: selfTestBody("ready\n")},
+		{route: "/headers", target: "/headers?count=3&size=8", status: 200, check: func(resp *http.Response, _ []byte) error {
+			if len(resp.Header.Get("X-Bench-Header-2")) != 8 {
+				return errors.New("missing X-Bench-Header-2")
+			}
+			return nil
+		}},
+		{route: "/uppercase", method: http.MethodPost, target: "/uppercase", body: "hello", status: 200, check: selfTestBody("HELLO")},
+		{route: "/body-codec", method: http.MethodPost, target: "/body-codec", body: gzipString("abc"),
+			header: http.Header{"Content-Encoding": {"gzip"}, "Accept-Encoding": {"gzip"}}, status: 200,
+			check: func(resp *http.Response, body []byte) error {
+				if resp.Header.Get("Content-Encoding") != "gzip" {
+					return errors.New("reply not gzip-encoded")
+				}
+				got, err := gunzipString(body)
+				if err != nil || got != "bcd" {
+					return fmt.Errorf("decoded %q (%v), want \"bcd\"", got, err)
+				}
+				return nil
+			}},
+		{route: "/decompress", method: http.MethodPost, target: "/decompress", body: gz,
+			header: http.Header{"Content-Encoding": {"gzip"}}, status: 200,
+			check: selfTestJSON(fmt.Sprintf(`"decompressed_bytes":%d`, len("self-test payload")))},
+		{route: "/decompress", method: http.MethodPost, target: "/decompress", body: "x",
+			header: http.Header{"Content-Encoding": {"br"}}, status: http.StatusUnsupportedMediaType},
+		{route: "/compute", target: "/compute?complexity=10&hash_iters=10", status: 200, check: func(resp *http.Response, _ []byte) error {
+			if resp.Header.Get("X-Fib-Result") != "55" {
+				return fmt.Errorf("X-Fib-Result %q, want 55", resp.Header.Get("X-Fib-Result"))
+			}
+			return nil
+		}},
+		{route: "/mandelbrot", target: "/mandelbrot?width=16&height=16&iter=16", status: 200},
+		{route: "/mandelbrot", target: "/mandelbrot?width=0", status: http.StatusBadRequest},
+		{route: "/json", target: "/json?items=3", status: 200, check: selfTestJSON(`"name":"item-2"`)},
+		{route: "/slow-json", target: "/slow-json?items=5&work=10&flush=1", status: 200, stream: true, check: selfTestJSON(`"id":4`)},
+		{route: "/ndjson", target: "/ndjson?lines=50&flush=5", status: 200, stream: true, check: func(_ *http.Response, body []byte) error {
+			lines := bytes.Split(bytes.TrimSuffix(body, []byte("\n")), []byte("\n"))
+			if len(lines) != 50 || !json.Valid(lines[49]) {
+				return fmt.Errorf("%d lines, want 50 JSON objects", len(lines))
+			}
+			return nil
+		}},
+		{route: "/ndjson", target: "/ndjson?lines=-1", status: http.StatusBadRequest},
+		{route: "/countdown", target: "/countdown?n=3&ms=30", status: 200, stream: true, check: selfTestBody("3\n2\n1\ndone\n")},
+		{route: "/delay", target: "/delay?ms=1", status: 200, check: selfTestBody("Delayed 1 ms")},
+		{route: "/latency-budget", target: "/latency-budget?ops=2&ms=1&work=10", status: 200},
+		{route: "/body", target: "/body?size=100", status: 200, check: selfTestSize(100)},
+		{route: "/priority", target: "/priority?size=100", header: http.Header{"Priority": {"u=1, i"}}, status: 200,
+			check: func(resp *http.Response, _ []byte) error {
+				if resp.Header.Get("X-Priority-Urgency") != "1" || resp.Header.Get("X-Priority-Incremental") != "true" {
+					return errors.New("Priority header not reported")
+				}
+				return nil
+			}},
+		{route: "/status", target: "/status", status: 200, check: selfTestJSON(`"status":"ok"`)},
+		{route: "/custom-status", target: "/custom-status?code=299&reason=Fine", status: 299},
+		{route: "/partial-write-flush", target: "/partial-write-flush", status: 200, stream: true, check: func(resp *http.Response, _ []byte) error {
+			if resp.Header.Get("X-Before-Write") != "sent" || resp.Header.Get("X-After-Write") != "" {
+				return errors.New("headers set after the first write reached the client")
+			}
+			return nil
+		}},
+		{route: "/reflect-status-from-body", method: http.MethodPost, target: "/reflect-status-from-body",
+			body: `{"status":201,"headers":{"X-Foo":"bar"},"body":"hi"}`, status: 201, check: func(resp *http.Response, body []byte) error {
+				if resp.Header.Get("X-Foo") != "bar" || string(body) != "hi" {
+					return fmt.Errorf("X-Foo %q, body %q", resp.Header.Get("X-Foo"), body)
+				}
+				return nil
+			}},
+		{route: "/reflect-status-from-body", method: http.MethodPost, target: "/reflect-status-from-body",
+			body: `{"headers":{"X-Foo":"bar\r\nSet-Cookie: x=1"}}`, status: http.StatusBadRequest},
+		{route: "/resource/", method: http.MethodPut, target: "/resource/self-test", body: "v1", check: func(resp *http.Response, _ []byte) error {
+			if (resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent) || resp.Header.Get("ETag") == "" {
+				return fmt.Errorf("status %d, ETag %q, want 201 or 204 with an ETag", resp.StatusCode, resp.Header.Get("ETag"))
+			}
+			return nil
+		}},
+		{route: "/resource/", target: "/resource/self-test", status: 200, check: selfTestBody("v1")},
+		{route: "/resource/", method: http.MethodPut, target: "/resource/self-test", body: "v2",
+			header: http.Header{"If-Match": {`"stale"`}}, status: http.StatusPreconditionFailed},
+		// HTTP/2 connections cannot be hijacked: the route answers 505 there.
+		{route: "/connection-close-race", target: "/connection-close-race", check: func(resp *http.Response, body []byte) error {
+			if resp.ProtoMajor == 2 && resp.StatusCode == http.StatusHTTPVersionNotSupported {
+				return nil
+			}
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("status %d, want 200", resp.StatusCode)
+			}
+			return selfTestBody("ok")(resp, body)
+		}},
+		{route: "/protobuf", target: "/protobuf?items=3", status: 200},
+		{route: "/xml", target: "/xml?items=3", status: 200, check: func(_ *http.Response, body []byte) error {
+			var doc struct {
+				Items []struct {
+					ID int `xml:"id"`
+				} `xml:"item"`
+			}
+			if err := xml.Unmarshal(body, &doc); err != nil || len(doc.Items) != 3 {
+				return fmt.Errorf("%d items (%v), want 3", len(doc.Items), err)
+			}
+			return nil
+		}},
+		{route: "/inspect", target: "/inspect", status: 200, check: selfTestJSON(`"proto"`)},
+		{route: "/conninfo", target: "/conninfo", status: 200, check: selfTestJSON(`"local_addr"`)},
+		{route: "/early-hints", target: "/early-hints", status: 200, check: func(resp *http.Response, _ []byte) error {
+			if resp.Header.Get("Content-Type") != "text/html" {
+				return errors.New("final response is not text/html")
+			}
+			return nil
+		}},
+		{route: "/echo-body", method: http.MethodPost, target: "/echo-body", body: "echo", status: 200, check: selfTestBody("echo")},
+		{route: "/gzip-stream", target: "/gzip-stream?chunks=4&size=1024", status: 200, stream: true, check: func(_ *http.Response, body []byte) error {
+			got, err := gunzipString(body)
+			if err != nil || len(got) != 4096 {
+				return fmt.Errorf("decoded %d bytes (%v), want 4096", len(got), err)
+			}
+			return nil
+		}},
+		{route: "/version", target: "/version", status: 200, check: selfTestJSON(`"go_version"`)},
+		{route: "/favicon.ico", target: "/favicon.ico", status: 200, check: selfTestSize(len(faviconPNG))},
+		{route: "/flaky", target: "/flaky?up_ms=1000&down_ms=0", status: 200},
+		{route: "/slow-body", method: http.MethodPost, target: "/slow-body", body: "slow", status: 200},
+		{route: "/download", target: "/download?size=1000", status: 200, stream: true, check: selfTestSize(1000)},
+		{route: "/query", method: http.MethodPost, target: "/query", body: `{"query":"{ items { id name } }","variables":{"count":2}}`,
+			status: 200, check: selfTestJSON(`"name"`)},
+		{route: "/query", target: "/query", status: http.StatusMethodNotAllowed},
+		{route: "/backpressure", target: "/backpressure?size=262144&chunk=16384", status: 200, stream: true, check: selfTestSize(262144)},
+		{route: "/throttle", target: "/throttle?size=8192&kbps=1000", status: 200, stream: true, check: selfTestSize(8192)},
+		{route: "/csv", target: "/csv?rows=10&cols=2", status: 200, stream: true, check: func(_ *http.Response, body []byte) error {
+			if n := bytes.Count(body, []byte("\n")); n != 11 {
+				return fmt.Errorf("%d lines, want 11", n)
+			}
+			return nil
+		}},
+		{route: "/params", target: "/params?a=1&a=2", status: 200, check: selfTestBody(`{"a":["1","2"]}`)},
+		{route: "/sequence", target: "/sequence", status: 200, check: selfTestJSON(`"sequence"`)},
+		{route: "/encoding", target: "/encoding?charset=latin-1", status: 200},
+		{route: "/encoding", target: "/encoding?charset=ebcdic", status: http.StatusBadRequest},
+		{route: "/multipart-mixed", target: "/multipart-mixed?parts=2&size=10", status: 200, stream: true, check: func(resp *http.Response, body []byte) error {
+			_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil {
+				return err
+			}
+			mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+			for i := 0; i < 2; i++ {
+				part, err := mr.NextPart()
+				if err != nil {
+					return fmt.Errorf("part %d: %v", i, err)
+				}
+				if id := part.Header.Get("Content-ID"); id != fmt.Sprintf("<part-%d>", i) {
+					return fmt.Errorf("part %d has Content-ID %q", i, id)
+				}
+			}
+			if _, err := mr.NextPart(); err != io.EOF {
+				return errors.New("more than 2 parts")
+			}
+			return nil
+		}},
+		{route: "/locale", target: "/locale", header: http.Header{"Accept-Language": {"fr;q=0.9, xx"}}, status: 200, check: selfTestJSON(`"locale"`)},
+		{route: "/range", target: "/range?size=1000", header: http.Header{"Range": {"bytes=0-99"}}, status: http.StatusPartialContent, check: selfTestSize(100)},
+		{route: "/time", target: "/time?format=unix", status: 200, check: selfTestJSON(`"format":"unix"`)},
+		{route: "/id", target: "/id?count=2&type=ulid", status: 200, check: selfTestJSON(`[`)},
+		{route: "/tee", method: http.MethodPost, target: "/tee", body: "tee", status: 200, check: func(resp *http.Response, body []byte) error {
+			sum := sha256.Sum256([]byte("tee"))
+			if string(body) != "tee" || resp.Trailer.Get("X-Body-SHA256") != hex.EncodeToString(sum[:]) {
+				return fmt.Errorf("body %q, trailer %q", body, resp.Trailer.Get("X-Body-SHA256"))
+			}
+			return nil
+		}},
+		// A WebSocket handshake needs a WebSocket client; without one the
+		// route must refuse the plain request.
+		{route: "/ws-ping", target: "/ws-ping", status: http.StatusBadRequest},
+		// With TLS the upstream calls fail certificate verification; the
+		// summary is checked, not their outcome.
+		{route: "/fanout", target: "/fanout?n=2&upstream=" + url.QueryEscape(base+"/ping"), status: 200, check: selfTestJSON(`"n":2`)},
+		{route: "/batch", method: http.MethodPost, target: "/batch", body: `[{"method":"GET","path":"/ping"}]`, status: 200, check: selfTestJSON(`"body":"pong"`)},
+		{route: "/consistency", target: "/consistency?path=/ping", status: 200},
+		{route: "/upload", method: http.MethodPost, target: "/upload", body: strings.Repeat("u", 1024), status: 200},
+		{route: "/upload", target: "/upload", status: http.StatusMethodNotAllowed},
+		{route: "/hash", method: http.MethodPost, target: "/hash?algo=sha256", body: "abc", status: 200,
+			check: selfTestJSON(`"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"`)},
+		{route: "/redirect", target: "/redirect?n=2", status: 200},
+		{route: "/redirect", target: "/redirect?to=file:///etc/passwd", status: http.StatusBadRequest},
+		{route: "/encoding-passthrough", method: http.MethodPost, target: "/encoding-passthrough", body: gz,
+			header: http.Header{"Content-Encoding": {"gzip"}}, status: 200, check: selfTestBody(gz)},
+		// Failing checks answer 503: a dependency's state, not a handler bug.
+		{route: "/health/deep", target: "/health/deep", check: func(resp *http.Response, body []byte) error {
+			if resp.StatusCode != 200 && resp.StatusCode != http.StatusServiceUnavailable {
+				return fmt.Errorf("status %d, want 200 or 503", resp.StatusCode)
+			}
+			return selfTestJSON(`"checks"`)(resp, body)
+		}},
+		{route: "/_routes", target: "/_routes", status: 200, check: selfTestJSON(`"template":"/ping"`)},
+		{route: "/metrics", target: "/metrics", status: 200, check: func(_ *http.Response, body []byte) error {
+			if !bytes.Contains(body, []byte("go_bench_requests_total")) {
+				return errors.New("no go_bench_requests_total series")
+			}
+			return nil
+		}},
+	}
+	cases = append(cases,
+		selfTestCase{route: userPostPattern.template, target: "/users/7/posts/9", status: 200, check: selfTestBody("user 7 post 9")},
+		selfTestCase{route: apiPattern.template, target: "/api/v1/resources/r/items/i/actions/a", status: 200,
+			check: selfTestBody("resource r item i action a")})
+	if name, data, ok := selfTestStaticFile(); ok {
+		cases = append(cases, selfTestCase{route: "static", target: "/" + name, status: 200, check: selfTestBody(data)})
+	}
+	if notFound {
+		cases = append(cases, selfTestCase{route: "unmatched", target: "/self-test/no-such-route", status: http.StatusNotFound})
+	}
+	return cases
+}
+
+// selfTestStaticFile returns the first regular file of staticFS, in lexical
+// order, and its contents.
+func selfTestStaticFile() (name, data string, ok bool) {
+	if staticFS == nil {
+		return "", "", false
+	}
+	fs.WalkDir(staticFS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || ok {
+			return nil
+		}
+		if b, err := fs.ReadFile(staticFS, p); err == nil {
+			name, data, ok = p, string(b), true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return name, data, ok
+}
+
+// selfTestTarget returns a request target that routes to ri: parameters
+// of a pattern filled in, a name under a prefix, the static root, or an
+// unregistered path.
+func selfTestTarget(ri routeInfo) string {
+	switch ri.Kind {
+	case "pattern":
+		segments := strings.Split(ri.Template, "/")
+		for i, seg := range segments {
+			if strings.HasPrefix(seg, ":") {
+				segments[i] = "1"
+			}
+		}
+		return strings.Join(segments, "/")
+	case "prefix":
+		return ri.Template + "self-test"
+	case "static":
+		return "/"
+	case "default":
+		return "/self-test/no-such-route"
+	}
+	return ri.Template
+}
+
+// runSelfTest sends every case whose route is in routes to base through
+// client, then a plain GET to each route no case covers (generated /rN and
+// --pattern-routes ones, say), expecting anything but a 5xx, and logs one
+// line per request. It returns the number of failures.
+func runSelfTest(client *http.Client, base string, routes []routeInfo, cases []selfTestCase) int {
+	registered := make(map[string]bool, len(routes))
+	for _, ri := range routes {
+		registered[ri.Template] = true
+	}
+	covered := make(map[string]bool)
+	var run []selfTestCase
+	for _, c := range cases {
+		if registered[c.route] {
+			if c.method == "" {
+				c.method = http.MethodGet
+			}
+			run = append(run, c)
+			covered[c.route] = true
+		}
+	}
+	for _, ri := range routes {
+		if covered[ri.Template] {
+			continue
+		}
+		run = append(run, selfTestCase{route: ri.Template, method: http.MethodGet, target: selfTestTarget(ri), check: func(resp *http.Response, _ []byte) error {
+			if resp.StatusCode >= 500 {
+				return fmt.Errorf("status %d", resp.StatusCode)
+			}
+			return nil
+		}})
+	}
+
+	failures := 0
+	for _, c := range run {
+		start := time.Now()
+		status, err := runSelfTestCase(client, base, c)
+		if err != nil {
+			failures++
+			slog.Error("self-test fail", "method", c.method, "target", c.target, "status", status, "err", err)
+			continue
+		}
+		slog.Info("self-test pass", "method", c.method, "target", c.target, "status", status, "elapsed", time.Since(start))
+	}
+	return failures
+}
+
+func runSelfTestCase(client *http.Client, base string, c selfTestCase) (int, error) {
+	var body io.Reader
+	if c.body != "" {
+		body = strings.NewReader(c.body)
+	}
+	req, err := http.NewRequest(c.method, base+c.target, body)
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var data []byte
+	if c.stream {
+		buf := make([]byte, selfTestReadSize)
+		for {
+			n, err := resp.Body.Read(buf)
+			data = append(data, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return resp.StatusCode, fmt.Errorf("reading body: %w", err)
+			}
+			time.Sleep(selfTestReadPause)
+		}
+	} else if data, err = io.ReadAll(resp.Body); err != nil {
+		return resp.StatusCode, fmt.Errorf("reading body: %w", err)
+	}
+	if c.status != 0 && resp.StatusCode != c.status {
+		return resp.StatusCode, fmt.Errorf("want status %d", c.status)
+	}
+	if c.check != nil {
+		return resp.StatusCode, c.check(resp, data)
+	}
+	return resp.StatusCode, nil
+}
+
+// newSelfTestClient returns the --self-test client: a fresh connection per
+// request, so /connection-close-race and /custom-status closing theirs does
+// not fail the next case, no transparent decompression, so compressed
+// replies are checked as sent, and for TLS no certificate verification, the
+// server's certificate rarely naming 127.0.0.1.
+func newSelfTestClient(tlsServe bool) *http.Client {
+	transport := &http.Transport{
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+	}
+	if tlsServe {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		transport.ForceAttemptHTTP2 = h2Enabled
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
+
+// selfTest waits for the server at base to be ready, runs the self-test and
+// exits with status 0 if every case passed and 1 otherwise (--self-test).
+func selfTest(base string, tlsServe bool, rt *router) {
+	client := newSelfTestClient(tlsServe)
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		resp, err := client.Get(base + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			fatal("self-test: server not ready", "err", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cases := selfTestCases(base, getFlagValue("--default-handler") == "")
+	failures := runSelfTest(client, base, rt.routes(), cases)
+	if failures > 0 {
+		slog.Error("self-test failed", "failures", failures)
+		os.Exit(1)
+	}
+	slog.Info("self-test passed")
+	os.Exit(0)
+}
+
 func hasFlag(flag string) bool {
 	for _, arg := range os.Args {
 		if arg == flag {
@@ -0,0 +1,3179 @@
+// go_server_test.go - tests for the Go benchmark server
+//
+// The directory also holds C++ sources, so run the tests on the file list:
+// go test go_server.go go_server_test.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+)
+
+// The regexps the segment matchers replaced, kept as the semantic reference.
+var (
+	userPostRegexp = regexp.MustCompile(`^/users/([^/]+)/posts/([^/]+)$`)
+	apiRegexp      = regexp.MustCompile(`^/api/v1/resources/([^/]+)/items/([^/]+)/actions/([^/]+)$`)
+)
+
+// anyMethod registers handlers as literal routes answering any method.
+func anyMethod(handlers map[string]http.HandlerFunc) routeTable {
+	routes := make(routeTable, len(handlers))
+	for path, h := range handlers {
+		routes.handle(path, h)
+	}
+	return routes
+}
+
+// newTestTopHandler is newTopHandler over a router for handlers.
+func newTestTopHandler(handlers map[string]http.HandlerFunc) http.Handler {
+	return newTopHandler(newRouter(anyMethod(handlers)))
+}
+
+var patternPaths = []string{
+	"/users/42/posts/7",
+	"/users/alice/posts/hello-world",
+	"/users//posts/7",
+	"/users/42/posts/",
+	"/users/42/posts/7/",
+	"/users/42/posts/7/extra",
+	"/users/42/post/7",
+	"users/42/posts/7",
+	"/users/42",
+	"/",
+	"",
+	"/api/v1/resources/r1/items/i2/actions/a3",
+	"/api/v1/resources/r1/items/i2/actions/",
+	"/api/v2/resources/r1/items/i2/actions/a3",
+	"/api/v1/resources/r1/items//actions/a3",
+	"/r42",
+}
+
+func TestSegmentPatternMatchesRegexpSemantics(t *testing.T) {
+	cases := []struct {
+		pattern segmentPattern
+		re      *regexp.Regexp
+	}{
+		{userPostPattern, userPostRegexp},
+		{apiPattern, apiRegexp},
+	}
+	for _, c := range cases {
+		for _, path := range patternPaths {
+			want := c.re.FindStringSubmatch(path)
+			got, ok := c.pattern.match(path, nil)
+			if ok != (want != nil) {
+				t.Errorf("%s: segment match %t, regexp match %t", path, ok, want != nil)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			if len(got) != len(want)-1 {
+				t.Errorf("%s: got params %q, want %q", path, got, want[1:])
+				continue
+			}
+			for i := range got {
+				if got[i] != want[i+1] {
+					t.Errorf("%s: got params %q, want %q", path, got, want[1:])
+					break
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkPatternMatchRegexp(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, path := range patternPaths {
+			if !userPostRegexp.MatchString(path) {
+				apiRegexp.MatchString(path)
+			}
+		}
+	}
+}
+
+func BenchmarkPatternMatchSegments(b *testing.B) {
+	var buf [3]string
+	for i := 0; i < b.N; i++ {
+		for _, path := range patternPaths {
+			if _, ok := userPostPattern.match(path, buf[:0]); !ok {
+				apiPattern.match(path, buf[:0])
+			}
+		}
+	}
+}
+
+// acceptEncodingValues mixes the fast-path strings with values only the full
+// parser understands.
+var acceptEncodingValues = []string{
+	"gzip, deflate, br, zstd",
+	"gzip, deflate, br",
+	"gzip, deflate",
+	"gzip,deflate",
+	"deflate, gzip",
+	"br, gzip",
+	"gzip, br",
+	"gzip",
+	"",
+	"identity",
+	"gzip;q=0, deflate",
+	"br;q=1.0, gzip;q=0.8, *;q=0.1",
+	"*",
+	"*;q=0",
+	"gzip;q=0, *",
+	"GZIP",
+}
+
+func TestAcceptEncodingFastPathMatchesFullParser(t *testing.T) {
+	for _, value := range acceptEncodingValues {
+		if fast, full := parseAcceptEncoding(value), parseAcceptEncodingFull(value); fast != full {
+			t.Errorf("%q: fast path %04b, full parser %04b", value, fast, full)
+		}
+	}
+	for value, want := range map[string]acceptedEncodings{
+		"gzip;q=0, deflate": encodingDeflate,
+		"gzip;q=0, *":       allEncodings &^ encodingGzip,
+		"*;q=0":             0,
+		"x-gzip":            encodingGzip,
+	} {
+		if got := parseAcceptEncoding(value); got != want {
+			t.Errorf("%q: got %04b, want %04b", value, got, want)
+		}
+	}
+}
+
+func BenchmarkAcceptEncodingFastPath(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		parseAcceptEncoding("gzip, deflate, br, zstd")
+	}
+}
+
+func BenchmarkAcceptEncodingFullParse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		parseAcceptEncodingFull("gzip, deflate, br, zstd")
+	}
+}
+
+func TestEarlyHintsReachHTTP2ClientBeforeFinalResponse(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(handleEarlyHints))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	var events []int
+	var hintLinks []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			events = append(events, code)
+			hintLinks = header.Values("Link")
+			return nil
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/early-hints?ms=20", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events = append(events, resp.StatusCode)
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if len(events) != 2 || events[0] != http.StatusEarlyHints || events[1] != http.StatusOK {
+		t.Fatalf("expected 103 then 200, got %v", events)
+	}
+	if len(hintLinks) != 2 {
+		t.Fatalf("expected 2 Link headers in 103, got %q", hintLinks)
+	}
+}
+
+func benchmarkPing(b *testing.B, metrics bool) {
+	prev := metricsEnabled
+	metricsEnabled = metrics
+	defer func() { metricsEnabled = prev }()
+
+	handler := newTestTopHandler(map[string]http.HandlerFunc{"/ping": handlePing})
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
+
+func BenchmarkPing(b *testing.B) {
+	benchmarkPing(b, false)
+}
+
+func BenchmarkPingWithMetrics(b *testing.B) {
+	benchmarkPing(b, true)
+}
+
+func TestWriteBodyFramingFollowsChunkedThreshold(t *testing.T) {
+	defer func(old int) { chunkedThreshold = old }(chunkedThreshold)
+	chunkedThreshold = 1024
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeBody(w, bytes.Repeat([]byte("b"), getQueryInt(r, "size", 0)))
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		size    int
+		chunked bool
+	}{
+		{0, false},
+		{1024, false},
+		{1025, true},
+		{10 * 1024, true},
+	} {
+		resp, err := ts.Client().Get(fmt.Sprintf("%s/?size=%d", ts.URL, tc.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		chunked := slices.Equal(resp.TransferEncoding, []string{"chunked"})
+		if len(body) != tc.size || chunked != tc.chunked || (!chunked && resp.ContentLength != int64(tc.size)) {
+			t.Errorf("size %d: %d bytes, Content-Length %d, Transfer-Encoding %q, want chunked %t",
+				tc.size, len(body), resp.ContentLength, resp.TransferEncoding, tc.chunked)
+		}
+	}
+}
+
+// BenchmarkWriteBody compares the Content-Length and chunked paths of
+// writeBody for a body of the same size.
+func BenchmarkWriteBody(b *testing.B) {
+	defer func(old int) { chunkedThreshold = old }(chunkedThreshold)
+	data := bytes.Repeat([]byte("b"), 64*1024)
+	for _, threshold := range []int{0, 16 * 1024} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			chunkedThreshold = threshold
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				writeBody(httptest.NewRecorder(), data)
+			}
+		})
+	}
+}
+
+func TestPanicRecoveryReturns500AndKeepsConnection(t *testing.T) {
+	handler := withRecovery(newTestTopHandler(map[string]http.HandlerFunc{
+		"/panic": func(w http.ResponseWriter, r *http.Request) {
+			var m map[string]int
+			m["boom"]++ // nil-map write panics
+		},
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	client := ts.Client()
+	var reused []bool
+	for i := 0; i < 2; i++ {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+		}
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/panic", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Request-ID", "test-id")
+		resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("expected 500, got %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Request-ID"); got != "test-id" {
+			t.Fatalf("expected X-Request-ID test-id, got %q", got)
+		}
+	}
+	if len(reused) != 2 || !reused[1] {
+		t.Fatalf("expected the second request to reuse the connection, got %v", reused)
+	}
+}
+
+func TestChaosPanicGoesThroughRecovery(t *testing.T) {
+	handler := withChaos(http.HandlerFunc(handlePing))
+	before := panicCount.Load()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping?_fail=panic", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("X-Request-ID") == "" {
+		t.Fatalf("status %d, X-Request-ID %q, want withRecovery's 500", rec.Code, rec.Header().Get("X-Request-ID"))
+	}
+	if got := panicCount.Load() - before; got != 1 {
+		t.Fatalf("panic counted %d times, want 1", got)
+	}
+}
+func newHTTP10TestServer(t *testing.T) net.Conn {
+	t.Helper()
+	ts := httptest.NewServer(withHTTP10Compat(newTestTopHandler(map[string]http.HandlerFunc{
+		"/ping":        handlePing,
+		"/gzip-stream": handleGzipStream,
+		"/echo-body":   handleEchoBody,
+	})))
+	t.Cleanup(ts.Close)
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readRawResponse(t *testing.T, br *bufio.Reader) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestHTTP10StreamingResponseUsesContentLength(t *testing.T) {
+	conn := newHTTP10TestServer(t)
+	io.WriteString(conn, "GET /gzip-stream?chunks=3&size=100 HTTP/1.0\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, body := readRawResponse(t, br)
+	if len(resp.TransferEncoding) != 0 {
+		t.Fatalf("unexpected Transfer-Encoding %v for HTTP/1.0", resp.TransferEncoding)
+	}
+	if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Fatalf("Content-Length %q does not match body length %d", got, len(body))
+	}
+	if !resp.Close {
+		t.Fatal("expected HTTP/1.0 response without keep-alive to close the connection")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestHTTP10KeepAliveIsHonored(t *testing.T) {
+	conn := newHTTP10TestServer(t)
+	br := bufio.NewReader(conn)
+	for _, req := range []string{
+		"GET /ping HTTP/1.0\r\nConnection: keep-alive\r\n\r\n",
+		"POST /echo-body HTTP/1.0\r\nConnection: keep-alive\r\nContent-Length: 5\r\n\r\nhello",
+	} {
+		io.WriteString(conn, req)
+		resp, body := readRawResponse(t, br)
+		if resp.Close {
+			t.Fatalf("%q: expected keep-alive, got Connection: close", req)
+		}
+		if len(resp.TransferEncoding) != 0 || resp.ContentLength != int64(len(body)) {
+			t.Fatalf("%q: expected Content-Length framing, got TE %v CL %d", req, resp.TransferEncoding, resp.ContentLength)
+		}
+	}
+}
+
+func TestOversizedHeaderValueIsRejectedWith431(t *testing.T) {
+	called := false
+	handler := withMaxHeaderValueSize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		handleHeaders(w, r)
+	}), 8*1024)
+
+	req := httptest.NewRequest(http.MethodGet, "/headers", nil)
+	req.Header.Set("X-Small", "ok")
+	req.Header.Set("X-Huge", strings.Repeat("a", 1<<20))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431, got %d", rec.Code)
+	}
+	if called {
+		t.Fatal("handler ran despite the oversized header value")
+	}
+
+	req.Header.Del("X-Huge")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !called {
+		t.Fatalf("expected request under the limit to reach the handler, got %d", rec.Code)
+	}
+}
+
+func newTimeout408TestServer(t *testing.T, headerTimeout, bodyTimeout time.Duration) string {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(withBodyReadTimeout(newTestTopHandler(map[string]http.HandlerFunc{
+		"/ping":      handlePing,
+		"/uppercase": handleUppercase,
+	}), bodyTimeout))
+	ts.Listener = timeout408Listener{ts.Listener}
+	ts.Config.ReadHeaderTimeout = headerTimeout
+	ts.Config.IdleTimeout = headerTimeout
+	ts.Config.ConnState = trackTimeout408State
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func TestIncompleteRequestGets408(t *testing.T) {
+	addr := newTimeout408TestServer(t, 100*time.Millisecond, 100*time.Millisecond)
+	for name, partial := range map[string]string{
+		"absent request line":  "",
+		"partial request line": "GET /pi",
+		"partial headers":      "GET /ping HTTP/1.1\r\nHost: x\r\n",
+		"partial body":         "POST /uppercase HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nhello",
+		"idle after response":  "GET /ping HTTP/1.1\r\nHost: x\r\n\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, partial)
+
+			br := bufio.NewReader(conn)
+			resp, body := readRawResponse(t, br)
+			if name == "idle after response" {
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("expected 200 before going idle, got %d", resp.StatusCode)
+				}
+				resp, body = readRawResponse(t, br)
+			}
+			if resp.StatusCode != http.StatusRequestTimeout {
+				t.Fatalf("expected 408, got %d %q", resp.StatusCode, body)
+			}
+			if strings.TrimSpace(string(body)) != "Request Timeout" {
+				t.Fatalf("unexpected 408 body %q", body)
+			}
+			if !resp.Close {
+				t.Fatal("expected Connection: close on 408")
+			}
+			if rest, err := io.ReadAll(br); err != nil || len(rest) != 0 {
+				t.Fatalf("expected connection to be closed after 408, got %q %v", rest, err)
+			}
+		})
+	}
+}
+
+func TestResetMetricsLosesNoIncrements(t *testing.T) {
+	const workers, perWorker = 8, 10000
+	takeMetricsSnapshot(true) // drop counts left by earlier tests
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < perWorker; j++ {
+				requestCounters.inc("/reset-test")
+				addCounter(&panicCount, 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+
+	var requests, panics int64
+	for finished := 0; finished < workers; {
+		select {
+		case <-done:
+			finished++
+		default:
+			snap := takeMetricsSnapshot(true)
+			requests += snap.Requests["/reset-test"]
+			panics += snap.Panics
+		}
+	}
+	snap := takeMetricsSnapshot(true)
+	requests += snap.Requests["/reset-test"]
+	panics += snap.Panics
+	if requests != workers*perWorker || panics != workers*perWorker {
+		t.Fatalf("expected %d of each across resets, got %d requests and %d panics", workers*perWorker, requests, panics)
+	}
+}
+
+func TestResetMetricsClearsGaugesAndLatencyWindows(t *testing.T) {
+	flakyUp.Store(1)
+	wsPongLatency.add(time.Second)
+	acceptWait.add(time.Second)
+	takeMetricsSnapshot(true)
+	if flakyUp.Load() != 0 {
+		t.Error("flaky_up gauge survived the reset")
+	}
+	for name, lw := range map[string]*latencyWindow{"ws pong": &wsPongLatency, "accept wait": &acceptWait} {
+		if p50, p99, n := lw.quantiles(); p50 != 0 || p99 != 0 || n != 0 {
+			t.Errorf("%s window after reset: p50 %v p99 %v count %d", name, p50, p99, n)
+		}
+	}
+}
+
+func TestResponseCountersSplitRoutesByStatusClass(t *testing.T) {
+	prev := metricsEnabled
+	metricsEnabled = true
+	defer func() { metricsEnabled = prev }()
+	takeMetricsSnapshot(true) // drop counts left by earlier tests
+
+	handler := withRecovery(newTestTopHandler(map[string]http.HandlerFunc{
+		"/ping": handlePing,
+		"/panic": func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		},
+	}))
+	for _, path := range []string{"/ping", "/ping", "/missing", "/panic"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`go_bench_responses_total{route="/ping",class="2xx"} 2`,
+		`go_bench_responses_total{route="unmatched",class="4xx"} 1`,
+		`go_bench_responses_total{route="/panic",class="5xx"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("metrics lack %s:\n%s", want, rec.Body.String())
+		}
+	}
+	if strings.Contains(rec.Body.String(), `route="unmatched",class="2xx"`) {
+		t.Error("404 counted as 2xx")
+	}
+}
+
+// readFromRecorder is a ResponseRecorder that notes whether its ReadFrom,
+// net/http's sendfile path, was used.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestMetricsKeepStaticFilesOnReadFrom(t *testing.T) {
+	prevMetrics, prevStatic := metricsEnabled, staticFS
+	defer func() { metricsEnabled, staticFS = prevMetrics, prevStatic }()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), bytes.Repeat([]byte("static "), 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	staticFS = os.DirFS(dir)
+	handler := newTestTopHandler(map[string]http.HandlerFunc{})
+
+	serve := func(metrics bool) *readFromRecorder {
+		metricsEnabled = metrics
+		rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file.txt", nil))
+		return rec
+	}
+	plain := serve(false)
+	takeMetricsSnapshot(true) // drop counts left by earlier tests
+	counted := serve(true)
+	if !plain.readFrom || !counted.readFrom {
+		t.Fatalf("ReadFrom used without metrics %t, with metrics %t", plain.readFrom, counted.readFrom)
+	}
+	if counted.Code != plain.Code || counted.Body.String() != plain.Body.String() ||
+		!reflect.DeepEqual(counted.Header(), plain.Header()) {
+		t.Fatalf("metrics changed the response: %d %v vs %d %v", counted.Code, counted.Header(), plain.Code, plain.Header())
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`go_bench_requests_total{route="static"} 1`,
+		`go_bench_responses_total{route="static",class="2xx"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("metrics lack %s:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestHandlerErrorsAreLogged(t *testing.T) {
+	var logged bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(prevLogger)
+	handler := newTestTopHandler(map[string]http.HandlerFunc{
+		"/fail":     func(w http.ResponseWriter, r *http.Request) { http.Error(w, "backend exploded", http.StatusBadGateway) },
+		"/missing":  func(w http.ResponseWriter, r *http.Request) { http.Error(w, "no such item", http.StatusNotFound) },
+		"/ok":       func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "fine") },
+		"/scripted": func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+	})
+
+	for _, path := range []string{"/fail", "/missing", "/ok", "/scripted"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	var records []map[string]any
+	dec := json.NewDecoder(&logged)
+	for dec.More() {
+		var rec map[string]any
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	want := []struct {
+		level, route, err string
+		status            float64
+	}{
+		{"ERROR", "/fail", "backend exploded", 502},
+		{"DEBUG", "/missing", "no such item", 404},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d log records, got %v", len(want), records)
+	}
+	for i, w := range want {
+		rec := records[i]
+		if rec["msg"] != "handler error" || rec["level"] != w.level || rec["route"] != w.route ||
+			rec["status"] != w.status || rec["error"] != w.err {
+			t.Errorf("record %d: got %v", i, rec)
+		}
+	}
+}
+
+func TestRepeatedHeaderReachesHTTP1AndHTTP2Clients(t *testing.T) {
+	for _, h2 := range []bool{false, true} {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(handleHeaders))
+		ts.EnableHTTP2 = h2
+		ts.StartTLS()
+		defer ts.Close()
+
+		resp, err := ts.Client().Get(ts.URL + "/headers?repeat=Set-Cookie&count=5&size=8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if wantMajor := map[bool]int{false: 1, true: 2}[h2]; resp.ProtoMajor != wantMajor {
+			t.Fatalf("expected HTTP/%d, got %s", wantMajor, resp.Proto)
+		}
+		if got := resp.Header.Values("Set-Cookie"); len(got) != 5 {
+			t.Fatalf("%s: expected 5 Set-Cookie values, got %d: %q", resp.Proto, len(got), got)
+		}
+	}
+
+	for _, name := range []string{"Content-Length", "transfer-encoding", "Connection", "Content-Type", "Trailer", "Upgrade"} {
+		rec := httptest.NewRecorder()
+		handleHeaders(rec, httptest.NewRequest(http.MethodGet, "/headers?count=3&repeat="+name, nil))
+		if rec.Code != http.StatusBadRequest || len(rec.Header().Values(name)) > 1 {
+			t.Errorf("repeat=%s: status %d, values %q", name, rec.Code, rec.Header().Values(name))
+		}
+	}
+}
+
+func newTEGzipTestConn(t *testing.T) net.Conn {
+	t.Helper()
+	oldTEGzip := teGzip
+	teGzip = true
+	t.Cleanup(func() { teGzip = oldTEGzip })
+	ts := httptest.NewUnstartedServer(withTransferGzip(newTestTopHandler(map[string]http.HandlerFunc{
+		"/ping":       handlePing,
+		"/body-codec": handleBodyCodec,
+	})))
+	ts.Listener = teGzipListener{ts.Listener}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTransferEncodingGzipRequestIsDecoded(t *testing.T) {
+	conn := newTEGzipTestConn(t)
+	br := bufio.NewReader(conn)
+
+	compressed := gzipBytes(t, []byte("hello"))
+	var req bytes.Buffer
+	req.WriteString("POST /body-codec HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n")
+	// Split the gzip stream over two chunks to exercise the framing tracker.
+	for _, chunk := range [][]byte{compressed[:4], compressed[4:]} {
+		fmt.Fprintf(&req, "%x\r\n%s\r\n", len(chunk), chunk)
+	}
+	req.WriteString("0\r\n\r\n")
+	// A spoofed marker on a plain request must be ignored.
+	req.WriteString("POST /body-codec HTTP/1.1\r\nHost: x\r\n" + teGzipMarker + ": gzip\r\nContent-Length: 3\r\n\r\nabc")
+	req.WriteString("GET /ping HTTP/1.1\r\nHost: x\r\n\r\n")
+	conn.Write(req.Bytes())
+
+	for _, want := range []string{"ifmmp", "bcd", "pong"} {
+		resp, body := readRawResponse(t, br)
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Fatalf("expected 200 %q, got %d %q", want, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestTransferEncodingGzipResponse(t *testing.T) {
+	conn := newTEGzipTestConn(t)
+	io.WriteString(conn, "POST /body-codec HTTP/1.1\r\nHost: x\r\nTE: gzip\r\nContent-Length: 5\r\n\r\nhello")
+
+	// http.ReadResponse rejects non-chunked transfer codings, so parse by hand.
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "HTTP/1.1 200 OK" {
+		t.Fatalf("unexpected status line %q", status)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(header.Values("Transfer-Encoding"), ", "); got != "gzip, chunked" {
+		t.Fatalf("expected Transfer-Encoding gzip, chunked, got %q", got)
+	}
+	if header.Get("Content-Length") != "" || header.Get("Content-Encoding") != "" {
+		t.Fatalf("unexpected Content-Length/Content-Encoding in %v", header)
+	}
+	gz, err := gzip.NewReader(httputil.NewChunkedReader(tp.R))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ifmmp" {
+		t.Fatalf("expected decoded body %q, got %q", "ifmmp", body)
+	}
+}
+
+func TestTEGzipIgnoredWithoutFlag(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handleBodyCodec))
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "POST /body-codec HTTP/1.1\r\nHost: x\r\nTE: gzip\r\nContent-Length: 5\r\n\r\nhello")
+	resp, body := readRawResponse(t, bufio.NewReader(conn))
+	if len(resp.TransferEncoding) != 0 || string(body) != "ifmmp" {
+		t.Fatalf("TE: gzip honored without --te-gzip: Transfer-Encoding %q, body %q", resp.TransferEncoding, body)
+	}
+}
+
+// rawExchange writes raw to a server behind withTransferGzip, optionally
+// through teGzipListener, and returns every response read back until the
+// connection closes, as "status body" strings. It is safe to call from
+// several goroutines: net/http lingers 500ms before closing on a bad request,
+// so cases run concurrently.
+func rawExchange(t *testing.T, wrap bool, raw string) []string {
+	ts := httptest.NewUnstartedServer(withTransferGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %q", r.Method, r.URL.Path, body)
+	})))
+	if wrap {
+		ts.Listener = teGzipListener{ts.Listener}
+	}
+	ts.Start()
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, raw+"GET /end HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	br := bufio.NewReader(conn)
+	var got []string
+	for {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return got
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		got = append(got, fmt.Sprintf("%d %s", resp.StatusCode, strings.TrimSpace(string(body))))
+	}
+}
+
+func TestTEGzipConnFramesHostileRequestsLikeNetHTTP(t *testing.T) {
+	var wg sync.WaitGroup
+	// Without a gzip coding the tracker must be invisible: whatever net/http
+	// makes of these on its own, it must make of them behind teGzipConn too.
+	for _, tc := range []struct{ name, raw string }{
+		{"CL.TE", "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"},
+		{"TE.CL", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n"},
+		{"HTTP/1.0 TE ignored", "POST /a HTTP/1.0\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"},
+		{"two TE lines", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+		{"folded TE", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding:\r\n chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"},
+		{"bare LF headers", "POST /a HTTP/1.1\nHost: x\nContent-Length: 2\n\nhiGET /b HTTP/1.1\nHost: x\n\n"},
+		{"CRLF after POST", "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nhi\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n"},
+		{"signed Content-Length", "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: +2\r\n\r\nhi"},
+		{"signed chunk size", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n+2\r\nhi\r\n0\r\n\r\n"},
+		{"negative chunk size", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n-1\r\nhi\r\n0\r\n\r\n"},
+		{"prefixed chunk size", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0x2\r\nhi\r\n0\r\n\r\n"},
+		{"padded chunk size", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n 2\r\nhi\r\n0\r\n\r\n"},
+		{"chunk extension", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2 ;x=\"0\"\r\nhi\r\n0\r\n\r\n"},
+		{"bare LF chunk size", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2\nhi\r\n0\r\n\r\n"},
+		{"16-digit chunk size", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0000000000000002\r\nhi\r\n0\r\n\r\n"},
+		{"17-digit chunk size", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n00000000000000002\r\nhi\r\n0\r\n\r\n"},
+		{"overlong chunk", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nhi\r\n0\r\n\r\n"},
+		{"trailer", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\nX-T: 1\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n"},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			plain, wrapped := rawExchange(t, false, tc.raw), rawExchange(t, true, tc.raw)
+			if !slices.Equal(plain, wrapped) {
+				t.Errorf("%s: net/http alone answered\n%q\nbehind teGzipConn\n%q", tc.name, plain, wrapped)
+			}
+		}()
+	}
+
+	gzipped := gzipBytes(t, []byte("hi"))
+	for _, tc := range []struct {
+		name, raw string
+		want      []string
+	}{
+		{"gzip with Content-Length",
+			fmt.Sprintf("POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\nContent-Length: 5\r\n\r\n%x\r\n%s\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n", len(gzipped), gzipped),
+			[]string{"501 Unsupported transfer encoding"}},
+		{"gzip with bad chunk size",
+			"POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\nzz\r\nhi\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n",
+			[]string{"400 Invalid gzip transfer coding"}},
+		{"gzip on HTTP/1.0",
+			"POST /a HTTP/1.0\r\nConnection: keep-alive\r\nTransfer-Encoding: gzip, chunked\r\nContent-Length: 2\r\n\r\nhi",
+			[]string{`200 POST /a "hi"`, `200 GET /end ""`}},
+		{"spoofed marker",
+			"POST /a HTTP/1.1\r\nHost: x\r\n" + teGzipMarker + ": gzip\r\nContent-Length: 2\r\n\r\nhi",
+			[]string{`200 POST /a "hi"`, `200 GET /end ""`}},
+		{"gzip pipelined",
+			fmt.Sprintf("POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", len(gzipped), gzipped),
+			[]string{`200 POST /a "hi"`, `200 GET /end ""`}},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := rawExchange(t, true, tc.raw); !slices.Equal(got, tc.want) {
+				t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRouterDispatchOrderWithStaticFiles(t *testing.T) {
+	oldStatic := staticFS
+	staticFS = fstest.MapFS{
+		"index.html":       {Data: []byte("<h1>index</h1>")},
+		"nested/file":      {Data: []byte("nested file")},
+		"other/index.html": {Data: []byte("other index")},
+	}
+	defer func() { staticFS = oldStatic }()
+
+	for _, tc := range []struct {
+		name     string
+		literals map[string]http.HandlerFunc
+		path     string
+		route    string
+		body     string
+	}{
+		{"root serves index", nil, "/", "static", "<h1>index</h1>"},
+		{"nested file", nil, "/nested/file", "static", "nested file"},
+		{"directory index", nil, "/other/", "static", "other index"},
+		{"missing file", nil, "/nested/missing", "static", "404 page not found\n"},
+		{"pattern before static", nil, "/users/1/posts/2", userPostPattern.template, ""},
+		{"literal before static", map[string]http.HandlerFunc{"/ping": handlePing}, "/ping", "/ping", "pong"},
+		{"literal root", map[string]http.HandlerFunc{"/": handlePing}, "/", "/", "pong"},
+		{"literal root catches nested", map[string]http.HandlerFunc{"/": handlePing}, "/nested/file", "/", "pong"},
+		{"prefix before static", map[string]http.HandlerFunc{"/nested/": handlePing}, "/nested/file", "/nested/", "pong"},
+		{"longest prefix wins", map[string]http.HandlerFunc{
+			"/":        handleWrongRoute,
+			"/nested/": handlePing,
+		}, "/nested/file", "/nested/", "pong"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := newRouter(anyMethod(tc.literals))
+			// Map iteration order differs between runs; the result must not.
+			for i := 0; i < 20; i++ {
+				if route, _ := newRouter(anyMethod(tc.literals)).lookup(tc.path); route != tc.route {
+					t.Fatalf("lookup(%q) = %q, want %q", tc.path, route, tc.route)
+				}
+			}
+			if tc.body == "" {
+				return
+			}
+			_, h := rt.lookup(tc.path)
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if rec.Body.String() != tc.body {
+				t.Fatalf("GET %s: body %q, want %q", tc.path, rec.Body.String(), tc.body)
+			}
+		})
+	}
+}
+
+func handleWrongRoute(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "wrong route", http.StatusTeapot)
+}
+
+func TestTeeEchoesBodyAndSendsDigestTrailer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handleTee))
+	defer ts.Close()
+
+	input := bytes.Repeat([]byte("tee-body-"), 20000) // larger than one copy buffer
+	resp, err := http.Post(ts.URL+"/tee", "application/octet-stream", bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	echoed, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, input) {
+		t.Fatalf("echoed %d bytes differ from the %d sent", len(echoed), len(input))
+	}
+	sum := sha256.Sum256(input)
+	if got, want := resp.Trailer.Get("X-Body-SHA256"), hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("trailer digest %q, want %q", got, want)
+	}
+}
+
+func TestFanoutAggregatesConcurrentUpstreamCalls(t *testing.T) {
+	// Upstream calls block until all n are in flight at once, so the test
+	// only completes if handleFanout really issues them concurrently.
+	var inFlight atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("hang") {
+			<-r.Context().Done()
+			return
+		}
+		inFlight.Add(1)
+		<-release
+		io.WriteString(w, "pong")
+	}))
+	defer upstream.Close()
+	defer func(old int) { maxFanout = old }(maxFanout)
+	maxFanout = 10
+
+	const n = 6
+	go func() {
+		for inFlight.Load() < n {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+	rec := httptest.NewRecorder()
+	handleFanout(rec, httptest.NewRequest(http.MethodGet, "/fanout?n=6&timeout=5s&upstream="+url.QueryEscape(upstream.URL), nil))
+	var summary struct {
+		N, OK, Failed int
+		Calls         []fanoutCall
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("status %d, body %q: %v", rec.Code, rec.Body.String(), err)
+	}
+	if summary.N != n || summary.OK != n || summary.Failed != 0 || len(summary.Calls) != n {
+		t.Fatalf("summary %+v, want %d successful calls", summary, n)
+	}
+	for _, c := range summary.Calls {
+		if c.Status != http.StatusOK || c.Bytes != 4 {
+			t.Fatalf("call %+v, want 200 with 4 bytes", c)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handleFanout(rec, httptest.NewRequest(http.MethodGet, "/fanout?n=2&timeout=50ms&upstream="+url.QueryEscape(upstream.URL+"/?hang=1"), nil))
+	summary.Calls = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Failed != 2 || summary.Calls[0].Error == "" {
+		t.Fatalf("summary %+v, want both calls to time out", summary)
+	}
+
+	rec = httptest.NewRecorder()
+	handleFanout(rec, httptest.NewRequest(http.MethodGet, "/fanout?n=11&upstream="+url.QueryEscape(upstream.URL), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("n above --max-fanout: status %d, want 400", rec.Code)
+	}
+}
+
+func TestBatchDispatchesInOrderWithSharedDeadline(t *testing.T) {
+	defer func(h http.Handler, size int, timeout time.Duration) {
+		batchHandler, maxBatchSize, batchTimeout = h, size, timeout
+	}(batchHandler, maxBatchSize, batchTimeout)
+	batchHandler = newTestTopHandler(map[string]http.HandlerFunc{
+		"/uppercase": handleUppercase,
+		"/slow": func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	})
+	maxBatchSize = 5
+	batchTimeout = 50 * time.Millisecond
+
+	body := `[{"method":"POST","path":"/uppercase","body":"abc"},{"path":"/missing"},{"path":"/a b"},{"path":"/slow"},{"path":"/uppercase"}]`
+	rec := httptest.NewRecorder()
+	handleBatch(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+	var results []batchResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("status %d, body %q: %v", rec.Code, rec.Body.String(), err)
+	}
+	want := []batchResult{
+		{Status: http.StatusOK, Body: "ABC"},
+		{Status: http.StatusNotFound, Body: "404 page not found\n"},
+		{Status: http.StatusBadRequest, Body: "invalid path"},
+		{Status: http.StatusServiceUnavailable},
+		{Status: http.StatusGatewayTimeout, Body: "batch deadline exceeded"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, results[i], want[i])
+		}
+	}
+}
+
+func TestUploadRejectsOversizedExpectContinueBeforeBody(t *testing.T) {
+	defer func(old int64) { maxUploadSize = old }(maxUploadSize)
+	maxUploadSize = 1024
+	ts := httptest.NewServer(http.HandlerFunc(handleUpload))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Only the headers go out; the test fails on the deadline if the server
+	// waits for a body.
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", 1<<30)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("first response status %d, want 413 (and no 100 Continue)", resp.StatusCode)
+	}
+
+	// Within the limit, the client gets 100 Continue and the upload succeeds.
+	ts.Client().Transport.(*http.Transport).ExpectContinueTimeout = 5 * time.Second
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/upload", strings.NewReader(strings.Repeat("u", 1000)))
+	req.Header.Set("Expect", "100-continue")
+	var gotContinue bool
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got100Continue: func() { gotContinue = true },
+	}))
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !gotContinue || resp.StatusCode != http.StatusOK || string(body) != "{\"received\":1000}\n" {
+		t.Fatalf("in-limit upload: continue %t, status %d, body %q", gotContinue, resp.StatusCode, body)
+	}
+}
+
+func TestMandelbrotChecksumIsStable(t *testing.T) {
+	// Pinned so that a change to the region, the escape test or float
+	// evaluation (e.g. FMA fusion on another architecture) is caught.
+	if got, want := mandelbrotChecksum(64, 48, 100), uint64(16623193271567302291); got != want {
+		t.Fatalf("mandelbrotChecksum(64, 48, 100) = %d, want %d", got, want)
+	}
+	if mandelbrotChecksum(64, 48, 101) == mandelbrotChecksum(64, 48, 100) {
+		t.Fatal("checksum ignores the iteration limit")
+	}
+}
+
+func TestValidateSchemaReportsErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	schema := `{
+		"type": "object",
+		"required": ["id", "name"],
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"name": {"type": "string", "maxLength": 8}
+		}
+	}`
+	if err := os.WriteFile(path, []byte(schema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *jsonschema.Schema, max int64) { bodySchema, maxUploadSize = s, max }(bodySchema, maxUploadSize)
+	var err error
+	if bodySchema, err = jsonschema.NewCompiler().Compile(path); err != nil {
+		t.Fatal(err)
+	}
+	maxUploadSize = 1 << 20
+
+	for _, tc := range []struct {
+		body      string
+		status    int
+		locations []string
+	}{
+		{`{"id": 3, "name": "ok"}`, http.StatusOK, nil},
+		{`{"id": 0, "name": "much too long"}`, http.StatusBadRequest, []string{"/id", "/name"}},
+		{`{"name": "x"}`, http.StatusBadRequest, []string{""}},
+		{`{"id": `, http.StatusBadRequest, []string{""}},
+	} {
+		rec := httptest.NewRecorder()
+		handleSchema(rec, httptest.NewRequest(http.MethodPost, "/validate-schema", strings.NewReader(tc.body)))
+		var resp struct {
+			Valid  bool
+			Errors []schemaError
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", tc.body, err)
+		}
+		if rec.Code != tc.status || resp.Valid != (tc.status == http.StatusOK) {
+			t.Fatalf("%s: status %d valid %t, want %d", tc.body, rec.Code, resp.Valid, tc.status)
+		}
+		var got []string
+		for _, e := range resp.Errors {
+			got = append(got, e.InstanceLocation)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tc.locations) {
+			t.Fatalf("%s: error locations %q, want %q (%+v)", tc.body, got, tc.locations, resp.Errors)
+		}
+	}
+}
+
+func TestHealthDeepAggregatesAndCachesChecks(t *testing.T) {
+	defer func(checks []healthCheck, timeout, ttl time.Duration) {
+		healthChecks, healthTimeout, healthCacheTTL = checks, timeout, ttl
+		healthResults = nil
+	}(healthChecks, healthTimeout, healthCacheTTL)
+	var runs atomic.Int32
+	failing := false
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	healthChecks = []healthCheck{
+		{"counted", func(ctx context.Context) error {
+			runs.Add(1)
+			if failing {
+				return errors.New("down")
+			}
+			return nil
+		}},
+		{"stuck", func(ctx context.Context) error {
+			if failing {
+				<-release // ignores ctx; must be abandoned at the timeout
+			}
+			return nil
+		}},
+	}
+	healthTimeout = 20 * time.Millisecond
+	healthCacheTTL = time.Hour
+	healthResults = nil
+
+	get := func() (int, string) {
+		rec := httptest.NewRecorder()
+		handleHealthDeep(rec, httptest.NewRequest(http.MethodGet, "/health/deep", nil))
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := get(); code != http.StatusOK || !strings.Contains(body, `"status":"ok"`) {
+		t.Fatalf("healthy: %d %s", code, body)
+	}
+	failing = true
+	if code, _ := get(); code != http.StatusOK || runs.Load() != 1 {
+		t.Fatalf("cached probe: status %d after %d runs, want 200 after 1", code, runs.Load())
+	}
+
+	healthCacheTTL = 0
+	code, body := get()
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, `"error":"down"`) ||
+		!strings.Contains(body, `"error":"context deadline exceeded"`) {
+		t.Fatalf("failing: %d %s", code, body)
+	}
+}
+
+func TestHealthDeepProbesShareOneRunWithoutHoldingTheCache(t *testing.T) {
+	defer func(checks []healthCheck, timeout, ttl time.Duration) {
+		healthChecks, healthTimeout, healthCacheTTL = checks, timeout, ttl
+		healthResults = nil
+	}(healthChecks, healthTimeout, healthCacheTTL)
+	var runs atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	healthChecks = []healthCheck{{"slow", func(ctx context.Context) error {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil
+	}}}
+	healthTimeout = 5 * time.Second
+	healthCacheTTL = time.Hour
+	healthResults = nil
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			rec := httptest.NewRecorder()
+			handleHealthDeep(rec, httptest.NewRequest(http.MethodGet, "/health/deep", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("shared probe: %d %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+	<-started
+	// The cache lock must stay free while the checks run.
+	locked := make(chan struct{})
+	go func() {
+		healthMu.Lock()
+		healthMu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("healthMu is held while the checks run")
+	}
+	time.Sleep(20 * time.Millisecond) // let the other probes join the run
+	close(release)
+	wg.Wait()
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("concurrent probes ran the checks %d times, want 1", n)
+	}
+}
+
+func TestEncodingPassthroughKeepsBodyCompressed(t *testing.T) {
+	defer func(old int64) { maxUploadSize = old }(maxUploadSize)
+	maxUploadSize = 1 << 20
+	ts := httptest.NewServer(http.HandlerFunc(handleEncodingPassthrough))
+	defer ts.Close()
+
+	compressed := gzipBytes(t, bytes.Repeat([]byte("passthrough "), 500))
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Type", "text/plain")
+	// Set explicitly so the transport does not decompress the reply.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, compressed) {
+		t.Fatalf("body is %d bytes, want the %d compressed bytes sent", len(body), len(compressed))
+	}
+	if resp.ContentLength != int64(len(compressed)) || resp.Header.Get("Content-Encoding") != "gzip" ||
+		resp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("length %d, headers %v", resp.ContentLength, resp.Header)
+	}
+}
+
+func TestPreloadStaticServesFromCache(t *testing.T) {
+	files := fstest.MapFS{}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("assets/%d.txt", i)] = &fstest.MapFile{Data: []byte(strings.Repeat(strconv.Itoa(i), i+1))}
+	}
+	files["index.html"] = &fstest.MapFile{Data: []byte("<p>home</p>")}
+	cache, size, err := preloadStatic(files, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != len(files) {
+		t.Fatalf("preloaded %d files, want %d", len(cache), len(files))
+	}
+	var want int64
+	for _, f := range files {
+		want += int64(len(f.Data))
+	}
+	if size != want {
+		t.Fatalf("preloaded %d bytes, want %d", size, want)
+	}
+
+	// With an empty backing FS, every hit must come from the cache.
+	defer func(fsys fs.FS, c map[string]*cachedFile) { staticFS, staticCache = fsys, c }(staticFS, staticCache)
+	staticFS, staticCache = fstest.MapFS{}, cache
+	for path, body := range map[string]string{"/": "<p>home</p>", "/assets/7.txt": "77777777"} {
+		rec := httptest.NewRecorder()
+		handleStatic(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != body {
+			t.Fatalf("GET %s: %d %q, want %q", path, rec.Code, rec.Body.String(), body)
+		}
+	}
+}
+
+// readCountingFS counts the bytes read from the files it opens.
+type readCountingFS struct {
+	fs.FS
+	read *atomic.Int64
+}
+
+func (c readCountingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readCountingFile{f.(readSeekFile), c.read}, nil
+}
+
+type readSeekFile interface {
+	fs.File
+	io.Seeker
+}
+
+type readCountingFile struct {
+	readSeekFile
+	read *atomic.Int64
+}
+
+func (f readCountingFile) Read(p []byte) (int, error) {
+	n, err := f.readSeekFile.Read(p)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func TestStaticETagHashesEachFileOnce(t *testing.T) {
+	defer func(fsys fs.FS, c map[string]*cachedFile) {
+		staticFS, staticCache = fsys, c
+		staticETags.Clear()
+	}(staticFS, staticCache)
+	staticETags.Clear()
+	body := strings.Repeat("embedded ", 1000)
+	// MapFS files have no modification time, like embedded ones.
+	files := fstest.MapFS{"hashed.txt": &fstest.MapFile{Data: []byte(body)}}
+	var read atomic.Int64
+	staticFS, staticCache = readCountingFS{files, &read}, nil
+
+	var etags []string
+	for i := range 2 {
+		read.Store(0)
+		rec := httptest.NewRecorder()
+		handleStatic(rec, httptest.NewRequest(http.MethodGet, "/hashed.txt", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != body {
+			t.Fatalf("request %d: %d, %d bytes", i, rec.Code, rec.Body.Len())
+		}
+		etags = append(etags, rec.Header().Get("ETag"))
+		// The first request hashes the file and serves it, later ones only
+		// serve it.
+		if want := int64(len(body) * (2 - i)); read.Load() != want {
+			t.Errorf("request %d read %d bytes, want %d", i, read.Load(), want)
+		}
+	}
+	cache, _, err := preloadStatic(files, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etags[0] == "" || etags[1] != etags[0] || cache["hashed.txt"].etag != etags[0] {
+		t.Fatalf("ETags %q, preloaded %q, want one value", etags, cache["hashed.txt"].etag)
+	}
+}
+
+// wsClientFrame builds a masked, final client frame with a short payload.
+func wsClientFrame(op byte, payload []byte) []byte {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := append([]byte{0x80 | op, 0x80 | byte(len(payload))}, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	return frame
+}
+
+// readWSServerFrame reads an unmasked server frame with a short payload.
+func readWSServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// newWSPingServer serves /ws-ping with the given --ws-ping-interval and
+// --ws-max-frame. The flags are restored only once the hijacked handlers,
+// which outlive ts.Close, have returned.
+func newWSPingServer(t *testing.T, interval time.Duration, maxFrame int) *httptest.Server {
+	prevInterval, prevMax := wsPingInterval, wsMaxFrame
+	wsPingInterval, wsMaxFrame = interval, maxFrame
+	var handlers sync.WaitGroup
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		handleWSPing(w, r)
+	}))
+	t.Cleanup(func() {
+		ts.Close()
+		handlers.Wait()
+		wsPingInterval, wsMaxFrame = prevInterval, prevMax
+	})
+	return ts
+}
+
+// dialWSPing opens a WebSocket connection to a /ws-ping server; t.Cleanup
+// closes it.
+func dialWSPing(t *testing.T, ts *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /ws-ping HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The accept value for this key is the worked example of RFC 6455 section 1.3.
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %d %v", resp.StatusCode, resp.Header)
+	}
+	return conn, br
+}
+
+func TestWSPingEchoesFramesAndMeasuresPongs(t *testing.T) {
+	ts := newWSPingServer(t, 10*time.Millisecond, 1024)
+	conn, br := dialWSPing(t, ts)
+
+	_, _, before := wsPongLatency.quantiles()
+	conn.Write(wsClientFrame(wsOpText, []byte("ts=1700000000123")))
+	gotEcho, gotPing := false, false
+	for !gotEcho || !gotPing {
+		op, payload := readWSServerFrame(t, br)
+		switch op {
+		case wsOpText:
+			if string(payload) != "ts=1700000000123" {
+				t.Fatalf("echo %q", payload)
+			}
+			gotEcho = true
+		case wsOpPing:
+			conn.Write(wsClientFrame(wsOpPong, payload))
+			gotPing = true
+		default:
+			t.Fatalf("unexpected opcode %#x", op)
+		}
+	}
+	conn.Write(wsClientFrame(wsOpClose, []byte{0x03, 0xe8}))
+	for {
+		op, payload := readWSServerFrame(t, br)
+		if op == wsOpClose {
+			if !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+				t.Fatalf("close payload %x, want the 1000 status echoed", payload)
+			}
+			break
+		}
+	}
+	_, _, count := wsPongLatency.quantiles()
+	if count <= before {
+		t.Fatal("pong latency was not recorded")
+	}
+}
+
+func TestWSPingClosesProtocolErrorsWith1002(t *testing.T) {
+	ts := newWSPingServer(t, 0, 1024)
+
+	unfinishedPing := wsClientFrame(wsOpPing, []byte("x"))
+	unfinishedPing[0] &^= 0x80
+	bigPing := append([]byte{0x80 | wsOpPing, 0x80 | 126, 0, 126}, make([]byte, 4+126)...)
+	for name, frame := range map[string][]byte{
+		"unmasked":        {0x80 | wsOpText, 2, 'h', 'i'},
+		"fragmented ping": unfinishedPing,
+		"126-byte ping":   bigPing,
+	} {
+		conn, br := dialWSPing(t, ts)
+		conn.Write(frame)
+		op, payload := readWSServerFrame(t, br)
+		if op != wsOpClose || !bytes.Equal(payload, []byte{0x03, 0xea}) {
+			t.Errorf("%s: got opcode %#x payload %x, want close 1002", name, op, payload)
+		}
+	}
+}
+
+func TestWSPingIgnoresUnsolicitedPongs(t *testing.T) {
+	ts := newWSPingServer(t, time.Hour, 1024)
+	conn, br := dialWSPing(t, ts)
+
+	_, _, before := wsPongLatency.quantiles()
+	forged := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(-time.Minute).UnixNano()))
+	conn.Write(wsClientFrame(wsOpPong, forged))
+	// The echo of a later frame shows the pong was handled.
+	conn.Write(wsClientFrame(wsOpText, []byte("after")))
+	if op, payload := readWSServerFrame(t, br); op != wsOpText || string(payload) != "after" {
+		t.Fatalf("got opcode %#x payload %q, want the echo", op, payload)
+	}
+	if _, _, count := wsPongLatency.quantiles(); count != before {
+		t.Fatalf("unsolicited pong recorded: %d samples, had %d", count, before)
+	}
+}
+
+func TestHashUploadDigests(t *testing.T) {
+	defer func(old string) { hashAlgo = old }(hashAlgo)
+	hashAlgo = "sha256"
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<14) // several copy buffers
+	sha := sha256.Sum256(body)
+	for algo, digest := range map[string]string{
+		"":        hex.EncodeToString(sha[:]),
+		"blake2b": fmt.Sprintf("%x", blake2b.Sum256(body)),
+		"crc32":   fmt.Sprintf("%08x", crc32.ChecksumIEEE(body)),
+		"sha1":    fmt.Sprintf("%x", sha1.Sum(body)),
+		"sha256":  hex.EncodeToString(sha[:]),
+	} {
+		rec := httptest.NewRecorder()
+		handleHashUpload(rec, httptest.NewRequest(http.MethodPost, "/hash?algo="+algo, bytes.NewReader(body)))
+		var resp struct {
+			Algo   string
+			Bytes  int
+			Digest string
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("algo %q: %v (%q)", algo, err, rec.Body.String())
+		}
+		if resp.Bytes != len(body) || resp.Digest != digest || (algo != "" && resp.Algo != algo) {
+			t.Fatalf("algo %q: got %+v, want %d bytes and digest %s", algo, resp, len(body), digest)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleHashUpload(rec, httptest.NewRequest(http.MethodPost, "/hash?algo=md5", strings.NewReader("x")))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unsupported algo: status %d, want 400", rec.Code)
+	}
+}
+
+func TestCloseAfterRouteKeepsOtherRoutesReusingConnections(t *testing.T) {
+	defer func(prev *liveConfig) { currentConfig.Store(prev) }(currentConfig.Load())
+	applyConfig(&fileConfig{Routes: map[string]routeConfig{"/stream": {CloseAfter: true}}})
+	ts := httptest.NewServer(withRuntimeConfig(newTestTopHandler(map[string]http.HandlerFunc{
+		"/ping":   handlePing,
+		"/stream": handlePing,
+	})))
+	defer ts.Close()
+
+	get := func(path string) (reused bool) {
+		t.Helper()
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, ts.URL+path, nil)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.Close != (path == "/stream") {
+			t.Fatalf("GET %s: Connection: close %t", path, resp.Close)
+		}
+		return reused
+	}
+	for i, step := range []struct {
+		path   string
+		reused bool
+	}{
+		{"/ping", false},
+		{"/ping", true},
+		{"/stream", true}, // served on the pooled connection, which it then closes
+		{"/ping", false},
+		{"/ping", true},
+	} {
+		if reused := get(step.path); reused != step.reused {
+			t.Fatalf("request %d (%s): reused %t, want %t", i, step.path, reused, step.reused)
+		}
+	}
+}
+
+func TestRouteTimeoutOutlastsWriteTimeout(t *testing.T) {
+	defer func(prev *liveConfig) { currentConfig.Store(prev) }(currentConfig.Load())
+	applyConfig(&fileConfig{Routes: map[string]routeConfig{"/slow": {Timeout: configDuration(2 * time.Second)}}})
+	ts := httptest.NewUnstartedServer(withRuntimeConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "done")
+	})))
+	ts.Config.WriteTimeout = 100 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/slow")
+	if err != nil {
+		t.Fatalf("response cut by the server WriteTimeout: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "done" {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+}
+
+func TestNormalizeHeaderMergesPerRFC9110(t *testing.T) {
+	h := http.Header{
+		"Accept":          {"text/html", "application/json;q=0.9"},
+		"Accept-Encoding": {"gzip", " ", "br;q=0.5"},
+		"Cache-Control":   {"no-cache", "max-age=0"},
+		"Cookie":          {"a=1", "b=2"},
+		"X-Custom":        {"one", "two"},
+		"User-Agent":      {"bench/1"},
+	}
+	got, err := normalizeHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := http.Header{
+		"Accept":          {"text/html, application/json;q=0.9"},
+		"Accept-Encoding": {"gzip, br;q=0.5"},
+		"Cache-Control":   {"no-cache, max-age=0"},
+		"Cookie":          {"a=1; b=2"},
+		"X-Custom":        {"one", "two"}, // not a known list field: lines kept
+		"User-Agent":      {"bench/1"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("normalized\n%v\nwant\n%v", got, want)
+	}
+	if len(h["Accept"]) != 2 {
+		t.Fatal("normalizeHeader modified its input")
+	}
+	for _, name := range []string{"Content-Type", "Authorization", "Range"} {
+		if _, err := normalizeHeader(http.Header{name: {"x", "y"}}); err == nil {
+			t.Errorf("repeated %s accepted", name)
+		}
+	}
+}
+
+func TestRepeatedSingletonHeadersOnTheWire(t *testing.T) {
+	defer func(h http.HandlerFunc) { defaultHandler = h }(defaultHandler)
+	defaultHandler = handleDefaultEcho
+	ts := httptest.NewServer(newTestTopHandler(map[string]http.HandlerFunc{}))
+	defer ts.Close()
+	cases := []struct {
+		name    string
+		headers string
+		status  int
+	}{
+		{"repeated Content-Type", "Content-Type: a\r\nContent-Type: b\r\nContent-Length: 1\r\n", http.StatusBadRequest},
+		{"differing Content-Length", "Content-Length: 1\r\nContent-Length: 2\r\n", http.StatusBadRequest},
+		{"repeated Host", "Host: y\r\nContent-Length: 1\r\n", http.StatusBadRequest},
+		// Merged by net/http before any handler runs; see singletonHeaders.
+		{"identical Content-Length", "Content-Length: 1\r\nContent-Length: 1\r\n", http.StatusOK},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "POST /nowhere HTTP/1.1\r\nHost: x\r\n"+tc.headers+"\r\na")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d (%q)", tc.name, resp.StatusCode, tc.status, body)
+		}
+		if resp.StatusCode == http.StatusOK && !bytes.Contains(body, []byte("\nContent-Length: 1\n\na")) {
+			t.Errorf("%s: echoed %q, want one Content-Length line", tc.name, body)
+		}
+	}
+}
+
+func TestSplitAcceptHeadersNegotiateLikeOneLine(t *testing.T) {
+	// Multi-line Accept-Language and Accept-Encoding, as sent by proxies that
+	// append rather than merge.
+	ts := httptest.NewServer(newTestTopHandler(map[string]http.HandlerFunc{
+		"/locale":     handleLocale,
+		"/body-codec": handleBodyCodec,
+	}))
+	defer ts.Close()
+	send := func(request string) *http.Response {
+		t.Helper()
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		io.WriteString(conn, request)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := send("GET /locale HTTP/1.1\r\nHost: x\r\nAccept-Language: de;q=0.5\r\nAccept-Language: fr\r\n\r\n")
+	if lang := resp.Header.Get("Content-Language"); lang != "fr" {
+		t.Fatalf("split Accept-Language negotiated %q, want fr", lang)
+	}
+	resp = send("POST /body-codec HTTP/1.1\r\nHost: x\r\nAccept-Encoding: identity\r\nAccept-Encoding: gzip\r\nContent-Length: 1\r\n\r\na")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("split Accept-Encoding gave Content-Encoding %q, want gzip", enc)
+	}
+
+	defer func(h http.HandlerFunc) { defaultHandler = h }(defaultHandler)
+	defaultHandler = handleDefaultEcho
+	resp = send("GET /nowhere HTTP/1.1\r\nHost: x\r\nContent-Type: a\r\nContent-Type: b\r\n\r\n")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("repeated Content-Type echoed with status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRedirectChainAndExternalTargets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handleRedirect))
+	defer ts.Close()
+	hops := 0
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { hops++; return nil }}
+	resp, err := client.Get(ts.URL + "/redirect?n=5&code=307")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if hops != 5 || resp.StatusCode != http.StatusOK || string(body) != "redirect chain done" {
+		t.Fatalf("chain: %d hops, status %d, body %q", hops, resp.StatusCode, body)
+	}
+
+	for target, want := range map[string]int{
+		"https://example.com/landing?x=1": http.StatusFound,
+		"http://example.org":              http.StatusFound,
+		"file:///etc/passwd":              http.StatusBadRequest,
+		"javascript:alert(1)":             http.StatusBadRequest,
+		"//example.com/protocol-relative": http.StatusBadRequest,
+		"/internal":                       http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handleRedirect(rec, httptest.NewRequest(http.MethodGet, "/redirect?to="+url.QueryEscape(target), nil))
+		if rec.Code != want {
+			t.Errorf("to=%s: status %d, want %d", target, rec.Code, want)
+		}
+		if want == http.StatusFound && rec.Header().Get("Location") != target {
+			t.Errorf("to=%s: Location %q", target, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestProxyProtoListenerReportsClientAddress(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newProxyProtoListener(inner, time.Second)
+	defer ln.Close()
+
+	v4 := []byte{192, 0, 2, 7, 10, 0, 0, 1, 0x1f, 0x90, 0, 80}
+	v6 := append(append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...), 0x30, 0x39, 0, 80)
+	cases := []struct {
+		name   string
+		header []byte
+		want   string // empty: the proxy's own address
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.9 10.0.0.1 4242 80\r\n"), "203.0.113.9:4242"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::9 2001:db8::2 4243 80\r\n"), "[2001:db8::9]:4243"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", proxyV2Header(1, 0x11, v4), "192.0.2.7:8080"},
+		{"v2 tcp6 with tlv", proxyV2Header(1, 0x21, append(v6, 0x04, 0, 1, 'x')), "[2001:db8::1]:12345"},
+		{"v2 local", proxyV2Header(0, 0x00, nil), ""},
+	}
+	for _, tc := range cases {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write(append(tc.header, "hello"...))
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		want := tc.want
+		if want == "" {
+			want = c.LocalAddr().String()
+		}
+		if got := sc.RemoteAddr().String(); got != want {
+			t.Errorf("%s: RemoteAddr %s, want %s", tc.name, got, want)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%s: payload %q, %v", tc.name, buf, err)
+		}
+		sc.Close()
+		c.Close()
+	}
+
+	// A connection without a header is dropped, not handed to the server.
+	c, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("headerless connection left open (read %d, %v)", n, err)
+	}
+}
+
+func TestHandshakeTimingOnFirstResponseOnly(t *testing.T) {
+	defer func(old bool) { handshakeTiming = old }(handshakeTiming)
+	handshakeTiming = true
+	ts := httptest.NewUnstartedServer(withConnTracking(http.HandlerFunc(handlePing)))
+	ts.Config.ConnContext = connContext
+	ts.Listener = firstByteListener{ts.Listener}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Cleartext setup time runs from accept to the first byte, so the idle
+	// time before the request counts.
+	time.Sleep(100 * time.Millisecond)
+	br := bufio.NewReader(c)
+	var values []string
+	for range 2 {
+		fmt.Fprint(c, "GET /ping HTTP/1.1\r\nHost: x\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		values = append(values, resp.Header.Get("X-Handshake-Ms"))
+	}
+	if ms, err := strconv.ParseFloat(values[0], 64); err != nil || ms < 50 || ms > 5000 {
+		t.Errorf("first response: X-Handshake-Ms %q, want about 100", values[0])
+	}
+	if values[1] != "" {
+		t.Errorf("second response: X-Handshake-Ms %q, want none", values[1])
+	}
+
+	// A cached response must not replay the X-Handshake-Ms of the
+	// connection that filled the entry.
+	defer func(old *lruCache, ttl time.Duration, size int) {
+		responseCache, responseCacheTTL, responseCacheMaxEntry = old, ttl, size
+	}(responseCache, responseCacheTTL, responseCacheMaxEntry)
+	responseCache, responseCacheTTL, responseCacheMaxEntry = newLRUCache(16), time.Minute, 64*1024
+	cached := httptest.NewUnstartedServer(withConnTracking(withResponseCache(http.HandlerFunc(handleVersion))))
+	cached.Config.ConnContext = connContext
+	cached.Listener = firstByteListener{cached.Listener}
+	cached.Start()
+	defer cached.Close()
+	get := func(c net.Conn, br *bufio.Reader) (xCache, ms string) {
+		fmt.Fprint(c, "GET /version HTTP/1.1\r\nHost: x\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.Header.Get("X-Cache"), resp.Header.Get("X-Handshake-Ms")
+	}
+	first, err := net.Dial("tcp", cached.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	time.Sleep(100 * time.Millisecond)
+	firstReader := bufio.NewReader(first)
+	if xCache, ms := get(first, firstReader); xCache != "MISS" || ms == "" {
+		t.Fatalf("cache fill: X-Cache %q, X-Handshake-Ms %q", xCache, ms)
+	}
+	if xCache, ms := get(first, firstReader); xCache != "HIT" || ms != "" {
+		t.Errorf("cache hit on the same connection: X-Cache %q, X-Handshake-Ms %q, want HIT and none", xCache, ms)
+	}
+	second, err := net.Dial("tcp", cached.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	xCache, ms := get(second, bufio.NewReader(second))
+	if v, err := strconv.ParseFloat(ms, 64); xCache != "HIT" || err != nil || v >= 50 {
+		t.Errorf("cache hit on a new connection: X-Cache %q, X-Handshake-Ms %q, want HIT and its own setup time", xCache, ms)
+	}
+
+	tlsServer := httptest.NewUnstartedServer(withConnTracking(http.HandlerFunc(handlePing)))
+	tlsServer.Config.ConnContext = connContext
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	resp, err := tlsServer.Client().Get(tlsServer.URL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ms, err := strconv.ParseFloat(resp.Header.Get("X-Handshake-Ms"), 64); err != nil || ms <= 0 {
+		t.Errorf("TLS: X-Handshake-Ms %q, want the handshake time", resp.Header.Get("X-Handshake-Ms"))
+	}
+}
+
+func TestConnInfoReportsListenerAndProxy(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(handleConnInfo))
+	ts.Config.ConnContext = connContext
+	ts.Listener = newProxyProtoListener(ts.Listener, time.Second)
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "PROXY TCP4 203.0.113.9 10.0.0.1 4242 80\r\nGET /conninfo HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info struct {
+		RemoteAddr    string `json:"remote_addr"`
+		LocalAddr     string `json:"local_addr"`
+		Network       string `json:"network"`
+		ProxyProtocol bool   `json:"proxy_protocol"`
+		PeerAddr      string `json:"peer_addr"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.RemoteAddr != "203.0.113.9:4242" || info.LocalAddr != ts.Listener.Addr().String() ||
+		info.Network != "tcp" || !info.ProxyProtocol || info.PeerAddr != c.LocalAddr().String() {
+		t.Fatalf("unexpected %+v", info)
+	}
+}
+
+func TestCustomStatusSendsReasonPhrase(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleCustomStatus))
+	defer srv.Close()
+
+	for _, tc := range []struct{ query, status, body string }{
+		{"code=200&reason=Groovy", "200 Groovy", "Groovy\n"},
+		{"code=418&reason=Short+and+Stout", "418 Short and Stout", "Short and Stout\n"},
+		{"code=503&reason=", "503 ", "\n"},
+	} {
+		resp, err := http.Get(srv.URL + "/custom-status?" + tc.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Status != tc.status || string(body) != tc.body || !resp.Close {
+			t.Errorf("%s: status %q body %q close %t", tc.query, resp.Status, body, resp.Close)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/custom-status?reason=a%0d%0aX-Injected:+1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Injected") != "" {
+		t.Errorf("CRLF in reason: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+
+	// HTTP/1.0 goes through withHTTP10Compat, which must not write to the
+	// hijacked connection once the handler returns.
+	var serverLog bytes.Buffer
+	done := make(chan struct{})
+	http10 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		withHTTP10Compat(http.HandlerFunc(handleCustomStatus)).ServeHTTP(w, r)
+	}))
+	http10.Config.ErrorLog = log.New(&serverLog, "", 0)
+	http10.Start()
+	defer http10.Close()
+	c, err := net.Dial("tcp", http10.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET /custom-status?code=418&reason=Teapot HTTP/1.0\r\n\r\n")
+	resp, body := readRawResponse(t, bufio.NewReader(c))
+	<-done
+	if resp.Status != "418 Teapot" || string(body) != "Teapot\n" || serverLog.Len() != 0 {
+		t.Errorf("HTTP/1.0: status %q body %q, server log %q", resp.Status, body, serverLog.String())
+	}
+}
+
+func TestConnectionCloseRaceClosesAfterDelay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleConnectionCloseRace))
+	defer srv.Close()
+
+	for _, announce := range []bool{true, false} {
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := "us=50000"
+		if !announce {
+			query += "&announce=0"
+		}
+		fmt.Fprintf(c, "GET /connection-close-race?%s HTTP/1.1\r\nHost: x\r\n\r\n", query)
+		start := time.Now()
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" || resp.Close != announce {
+			t.Errorf("announce=%t: status %d body %q close %t", announce, resp.StatusCode, body, resp.Close)
+		}
+		// A follow-up request goes unanswered: the socket closes after the delay.
+		fmt.Fprintf(c, "GET /ping HTTP/1.1\r\nHost: x\r\n\r\n")
+		// Unread data makes the close a reset rather than a clean EOF.
+		if n, err := br.Read(make([]byte, 1)); err != io.EOF && !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("announce=%t: follow-up read %d, %v; want EOF or reset", announce, n, err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("announce=%t: closed after %v, want >= 50ms", announce, elapsed)
+		}
+		c.Close()
+	}
+}
+
+func TestIDGeneratesEachType(t *testing.T) {
+	defer func(old int) { maxIDCount = old }(maxIDCount)
+	maxIDCount = 100
+	formats := map[string]*regexp.Regexp{
+		"uuid4": regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		"uuid7": regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		"ulid":  regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+	}
+	for typ, format := range formats {
+		before := time.Now().UnixMilli()
+		rec := httptest.NewRecorder()
+		handleID(rec, httptest.NewRequest(http.MethodGet, "/id?type="+typ+"&count=20", nil))
+		var ids []string
+		if err := json.Unmarshal(rec.Body.Bytes(), &ids); err != nil || len(ids) != 20 {
+			t.Fatalf("%s: %v, %d ids in %q", typ, err, len(ids), rec.Body)
+		}
+		seen := map[string]bool{}
+		for _, id := range ids {
+			if !format.MatchString(id) || seen[id] {
+				t.Fatalf("%s: bad or repeated id %q", typ, id)
+			}
+			seen[id] = true
+		}
+		// The time-ordered types lead with the 48-bit millisecond timestamp.
+		var ms int64
+		switch typ {
+		case "uuid7":
+			ms, _ = strconv.ParseInt(strings.ReplaceAll(ids[0], "-", "")[:12], 16, 64)
+		case "ulid":
+			for _, c := range ids[0][:10] {
+				ms = ms<<5 | int64(strings.IndexRune(crockfordBase32, c))
+			}
+		default:
+			continue
+		}
+		if ms < before || ms > time.Now().UnixMilli() {
+			t.Errorf("%s: timestamp %d outside [%d, now]", typ, ms, before)
+		}
+	}
+
+	for _, target := range []string{"/id?count=0", "/id?count=101", "/id?type=uuid1"} {
+		rec := httptest.NewRecorder()
+		handleID(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", target, rec.Code)
+		}
+	}
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleXML(rec, httptest.NewRequest(http.MethodGet, "/xml?items=3", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	var doc struct {
+		Items []struct {
+			ID    int    `xml:"id"`
+			Name  string `xml:"name"`
+			Value int    `xml:"value"`
+		} `xml:"item"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("%v in %s", err, rec.Body)
+	}
+	if len(doc.Items) != 3 || doc.Items[2].Name != "item-2" || doc.Items[2].Value != 200 {
+		t.Fatalf("items %+v", doc.Items)
+	}
+
+	post := httptest.NewRecorder()
+	handleXML(post, httptest.NewRequest(http.MethodPost, "/xml", bytes.NewReader(rec.Body.Bytes())))
+	if got := post.Body.String(); got != `{"items":3,"fields":9}` {
+		t.Errorf("POST counts %s", got)
+	}
+
+	bad := httptest.NewRecorder()
+	handleXML(bad, httptest.NewRequest(http.MethodPost, "/xml", strings.NewReader("<items><item>")))
+	if bad.Code != http.StatusBadRequest {
+		t.Errorf("truncated XML: status %d", bad.Code)
+	}
+
+	huge := httptest.NewRecorder()
+	handleXML(huge, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/xml?items=%d", maxXMLItems+1), nil))
+	if huge.Code != http.StatusBadRequest {
+		t.Errorf("items above the cap: status %d", huge.Code)
+	}
+	put := httptest.NewRecorder()
+	handleXML(put, httptest.NewRequest(http.MethodPut, "/xml", nil))
+	if put.Code != http.StatusMethodNotAllowed || put.Header().Get("Allow") != "GET, HEAD, POST" {
+		t.Errorf("PUT: status %d, Allow %q", put.Code, put.Header().Get("Allow"))
+	}
+}
+
+func TestProtobufItemsAreCapped(t *testing.T) {
+	for _, tc := range []struct {
+		items  int
+		status int
+	}{
+		{-1, http.StatusBadRequest},
+		{maxProtobufItems + 1, http.StatusBadRequest},
+		{3, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handleProtobuf(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/protobuf?items=%d", tc.items), nil))
+		if rec.Code != tc.status {
+			t.Errorf("items=%d: status %d, want %d", tc.items, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestUpgradeRequestsAreRoutedByProtocol(t *testing.T) {
+	ts := httptest.NewServer(newTestTopHandler(map[string]http.HandlerFunc{"/ping": handlePing}))
+	defer ts.Close()
+
+	roundTrip := func(headers string) *http.Response {
+		t.Helper()
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET /ping HTTP/1.1\r\nHost: x\r\n%s\r\n", headers)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	cases := []struct {
+		name    string
+		headers string
+		want    int
+	}{
+		{"websocket on any path", "Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", http.StatusSwitchingProtocols},
+		{"websocket after unknown offer", "Connection: keep-alive, Upgrade\r\nUpgrade: foo/2, WebSocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", http.StatusSwitchingProtocols},
+		{"h2c without --h2c", "Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n", http.StatusOK},
+		{"unknown protocol", "Connection: Upgrade\r\nUpgrade: foo/1.0\r\n", http.StatusNotImplemented},
+		{"Upgrade not named by Connection", "Upgrade: foo/1.0\r\n", http.StatusOK},
+	}
+	for _, tc := range cases {
+		if resp := roundTrip(tc.headers); resp.StatusCode != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestThrottlePacesBytesAndReportsRate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handleThrottle))
+	defer ts.Close()
+
+	// 30KB at 100KB/s in 10KB chunks: the first chunk is the bucket's burst,
+	// the other two take 100ms each.
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/throttle?size=30000&kbps=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+	if len(body) != 30000 {
+		t.Fatalf("got %d bytes", len(body))
+	}
+	if elapsed < 180*time.Millisecond {
+		t.Errorf("finished in %v, want about 200ms", elapsed)
+	}
+	achieved, err := strconv.ParseFloat(resp.Trailer.Get("X-Achieved-Kbps"), 64)
+	if err != nil || achieved <= 0 || achieved > 200 {
+		t.Errorf("X-Achieved-Kbps %q", resp.Trailer.Get("X-Achieved-Kbps"))
+	}
+}
+
+// blockingWriter stalls every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+	bytes.Buffer
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	<-bw.release
+	return bw.Buffer.Write(p)
+}
+
+func (bw *blockingWriter) Close() error { return nil }
+
+func TestRecordingWritesNDJSONAndDropsWhenFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.ndjson")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := newRequestRecorder(f, 16, 4)
+	h := withRecording(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+	}), rr)
+	req := httptest.NewRequest(http.MethodPost, "/upload?x=1", strings.NewReader("hello"))
+	req.Header.Set("X-Test", "a")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+	rr.close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines:\n%s", len(lines), data)
+	}
+	var rec recordedRequest
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Method != http.MethodPost || rec.Target != "/upload?x=1" || rec.Headers["X-Test"][0] != "a" ||
+		string(rec.Body) != "hell" || rec.BodySize != 5 || !rec.BodyTruncated {
+		t.Errorf("first record %+v", rec)
+	}
+
+	// With the writer stuck, records beyond the queue are dropped instead of
+	// blocking the handler.
+	before := recordDropped.Load()
+	bw := &blockingWriter{release: make(chan struct{})}
+	rr = newRequestRecorder(bw, 1, 0)
+	h = withRecording(http.HandlerFunc(handlePing), rr)
+	const sent = 100
+	for i := 0; i < sent; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+	}
+	dropped := recordDropped.Load() - before
+	close(bw.release)
+	rr.close()
+	written := strings.Count(bw.String(), "\n")
+	if dropped == 0 || written+int(dropped) != sent {
+		t.Errorf("dropped %d, written %d, want a sum of %d with some dropped", dropped, written, sent)
+	}
+}
+
+func TestListenTCPSetsFastOpenQueue(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_FASTOPEN is only set on Linux")
+	}
+	defer func(q int, err error) { tcpFastOpenQueue, tcpFastOpenErr = q, err }(tcpFastOpenQueue, tcpFastOpenErr)
+	tcpFastOpenQueue = 16
+	ln, err := listenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if tcpFastOpenErr != nil {
+		t.Fatal(tcpFastOpenErr)
+	}
+	raw, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var qlen int
+	raw.Control(func(fd uintptr) {
+		qlen, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenLinux)
+	})
+	if err != nil || qlen != 16 {
+		t.Errorf("TCP_FASTOPEN = %d, %v; want 16", qlen, err)
+	}
+}
+
+func TestDecompressBoundsOutputAndRatio(t *testing.T) {
+	defer func(size int64, ratio int) { maxDecompressedSize, maxDecompressRatio = size, ratio }(maxDecompressedSize, maxDecompressRatio)
+	maxDecompressedSize, maxDecompressRatio = 1<<20, 100
+
+	compress := func(coding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var zw io.WriteCloser = gzip.NewWriter(&buf)
+		if coding == "deflate" {
+			zw = zlib.NewWriter(&buf)
+		}
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
+	post := func(coding string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/decompress", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", coding)
+		rec := httptest.NewRecorder()
+		handleDecompress(rec, req)
+		return rec
+	}
+
+	text := []byte(randomString(50000))
+	for _, coding := range []string{"gzip", "deflate"} {
+		body := compress(coding, text)
+		rec := post(coding, body)
+		want := fmt.Sprintf(`"compressed_bytes":%d,"decompressed_bytes":50000`, len(body))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s: %d %s", coding, rec.Code, rec.Body)
+		}
+	}
+
+	// 512KB of zeros shrinks well past 100:1.
+	if rec := post("gzip", compress("gzip", make([]byte, 512*1024))); rec.Code != http.StatusBadRequest ||
+		!strings.Contains(rec.Body.String(), "Suspected bomb: ratio") {
+		t.Errorf("zeros: %d %s", rec.Code, rec.Body)
+	}
+	maxDecompressRatio = 1 << 20
+	if rec := post("gzip", compress("gzip", make([]byte, 4<<20))); rec.Code != http.StatusBadRequest ||
+		!strings.Contains(rec.Body.String(), "Suspected bomb: output") {
+		t.Errorf("oversized: %d %s", rec.Code, rec.Body)
+	}
+	if rec := post("br", []byte("x")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("br: %d", rec.Code)
+	}
+}
+
+func TestLatencyBudgetReturnsPartialResults(t *testing.T) {
+	defer func(d time.Duration) { latencyBudget = d }(latencyBudget)
+	latencyBudget = 100 * time.Millisecond
+
+	for _, tc := range []struct {
+		query         string
+		status        int
+		minDone, done int
+	}{
+		{"ops=3&ms=5&work=10", http.StatusOK, 3, 3},
+		// Six 30ms steps fit 3 times in 100ms.
+		{"ops=6&ms=30&work=10", http.StatusPartialContent, 2, 3},
+	} {
+		rec := httptest.NewRecorder()
+		handleLatencyBudget(rec, httptest.NewRequest(http.MethodGet, "/latency-budget?"+tc.query, nil))
+		var resp struct {
+			Ops       int      `json:"ops"`
+			Completed int      `json:"completed"`
+			Results   []uint64 `json:"results"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if rec.Code != tc.status || resp.Completed < tc.minDone || resp.Completed > tc.done || len(resp.Results) != resp.Completed {
+			t.Errorf("%s: status %d, %s", tc.query, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestAcceptLoopsShareAPortAndCountAccepts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only set on Linux")
+	}
+	defer func(n int, counts []atomic.Int64) { acceptLoops, acceptCounts = n, counts }(acceptLoops, acceptCounts)
+	acceptLoops = 2
+	acceptCounts = make([]atomic.Int64, 2)
+	first, err := listenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := listenTCP(first.Addr().String())
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", first.Addr(), err)
+	}
+	defer second.Close()
+
+	// With the first listener gone every new connection lands on the second.
+	first.Close()
+	ln := &acceptStatsListener{Listener: second, loop: 1}
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", second.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.Close()
+	}
+	if got := acceptCounts[1].Load(); got != 2 || acceptCounts[0].Load() != 0 {
+		t.Errorf("accept counts %d, %d; want 0, 2", acceptCounts[0].Load(), got)
+	}
+}
+
+func TestConsistencyReportsHeadGetDifferences(t *testing.T) {
+	defer func(h http.Handler) { batchHandler = h }(batchHandler)
+	batchHandler = newTestTopHandler(map[string]http.HandlerFunc{
+		"/ping": handlePing,
+		// A HEAD shortcut that forgets the body's length and type.
+		"/bad": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "hello")
+		},
+	})
+	check := func(path string) (consistent bool, diff []string) {
+		rec := httptest.NewRecorder()
+		handleConsistency(rec, httptest.NewRequest(http.MethodGet, "/consistency?path="+url.QueryEscape(path), nil))
+		var resp struct {
+			Consistent bool `json:"consistent"`
+			Diff       []struct {
+				Header string `json:"header"`
+			} `json:"diff"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v in %s", path, err, rec.Body)
+		}
+		for _, d := range resp.Diff {
+			diff = append(diff, d.Header)
+		}
+		return resp.Consistent, diff
+	}
+	if ok, diff := check("/ping"); !ok {
+		t.Errorf("/ping: differences %v", diff)
+	}
+	if ok, diff := check("/bad?x=1"); ok || !slices.Equal(diff, []string{"Content-Type", "Content-Length", "Cache-Control"}) {
+		t.Errorf("/bad: consistent %t, differences %v", ok, diff)
+	}
+
+	rec := httptest.NewRecorder()
+	handleConsistency(rec, httptest.NewRequest(http.MethodGet, "/consistency?path=/a%20b", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("path with a space: status %d, want 400", rec.Code)
+	}
+}
+
+func TestWriteErrorsTruncateAndAbortResponses(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	ts := httptest.NewServer(withWriteErrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 1024)
+		for i := 0; i < 2*maxInjectedWriteCut/len(chunk); i++ {
+			if _, err := w.Write(chunk); err != nil {
+				handlerErr <- err
+				return
+			}
+		}
+		handlerErr <- nil
+	}), 1))
+	defer ts.Close()
+
+	before := writeErrorsInjected.Load()
+	resp, err := http.Get(ts.URL)
+	if err == nil {
+		n, readErr := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if readErr == nil {
+			t.Errorf("read %d bytes with no error, want a truncated body", n)
+		}
+	}
+	if err := <-handlerErr; !errors.Is(err, errInjectedWrite) {
+		t.Errorf("handler saw %v, want errInjectedWrite", err)
+	}
+	if got := writeErrorsInjected.Load() - before; got != 1 {
+		t.Errorf("injected %d errors, want 1", got)
+	}
+}
+
+func TestH2PriorityTapRecordsPrioritySignals(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("GET / HTTP/1.1\r\nHost: x\r\nUpgrade: h2c\r\n\r\n")
+	buf.Write(h2Preface)
+	fr := http2.NewFramer(&buf, nil)
+	fr.WriteSettings()
+	fr.WriteData(1, false, make([]byte, 300))
+	fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID: 3, BlockFragment: []byte{0x82}, EndHeaders: true, PadLength: 4,
+		Priority: http2.PriorityParam{StreamDep: 1, Exclusive: true, Weight: 255},
+	})
+	fr.WritePriority(5, http2.PriorityParam{StreamDep: 3, Weight: 15})
+	fr.WriteRawFrame(0x10, 0, 0, append([]byte{0, 0, 0, 5}, "u=1, i"...))
+	want := []string{
+		"stream=3 src=headers dep=1 weight=256 exclusive=true",
+		"stream=5 src=priority dep=3 weight=16 exclusive=false",
+		`stream=5 src=priority_update value="u=1, i"`,
+	}
+
+	for _, chunk := range []int{1, 7, buf.Len()} {
+		tap := &h2PriorityTap{}
+		for b := buf.Bytes(); len(b) > 0; {
+			n := min(chunk, len(b))
+			tap.scan(b[:n])
+			b = b[n:]
+		}
+		if got := tap.prioritySignals(); !slices.Equal(got, want) {
+			t.Errorf("chunks of %d: signals %q", chunk, got)
+		}
+	}
+
+	priorKnowledge := &h2PriorityTap{}
+	priorKnowledge.scan(buf.Bytes()[bytes.Index(buf.Bytes(), h2Preface):])
+	if got := priorKnowledge.prioritySignals(); !slices.Equal(got, want) {
+		t.Errorf("prior knowledge: signals %q", got)
+	}
+	// The preface only counts at the start or right after the first request
+	// head; HTTP/1.1 traffic is not searched any further.
+	for name, raw := range map[string]string{
+		"second request": "GET / HTTP/1.1\r\nHost: x\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\n" + string(buf.Bytes()[bytes.Index(buf.Bytes(), h2Preface):]),
+		"request body":   "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc" + string(buf.Bytes()[bytes.Index(buf.Bytes(), h2Preface):]),
+		"oversized head": "GET / HTTP/1.1\r\nX: " + strings.Repeat("x", maxUpgradeHead),
+	} {
+		tap := &h2PriorityTap{}
+		tap.scan([]byte(raw))
+		if !tap.off || len(tap.prioritySignals()) != 0 {
+			t.Errorf("%s: off %t, signals %q", name, tap.off, tap.prioritySignals())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/priority?size=10", nil)
+	req.Header.Set("Priority", "u=1, i")
+	handlePriority(rec, req)
+	if rec.Header().Get("X-Priority-Urgency") != "1" || rec.Header().Get("X-Priority-Incremental") != "true" || rec.Body.Len() != 10 {
+		t.Errorf("/priority: %v, %d bytes", rec.Header(), rec.Body.Len())
+	}
+}
+
+func TestReadinessGatesRoutesUntilReady(t *testing.T) {
+	reason := "preloading static files"
+	notReady.Store(&reason)
+	defer notReady.Store(nil)
+	h := withReadiness(newTestTopHandler(map[string]http.HandlerFunc{"/ping": handlePing, "/readyz": handleReadyz}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	for _, path := range []string{"/ping", "/readyz"} {
+		if rec := get(path); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" ||
+			!strings.Contains(rec.Body.String(), reason) {
+			t.Errorf("%s before ready: %d %q", path, rec.Code, rec.Body)
+		}
+	}
+	notReady.Store(nil)
+	if rec := get("/ping"); rec.Code != http.StatusOK {
+		t.Errorf("/ping once ready: %d", rec.Code)
+	}
+	if rec := get("/readyz"); rec.Code != http.StatusOK || rec.Body.String() != "ready\n" {
+		t.Errorf("/readyz once ready: %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestReadinessExemptsHealthAndMetricsRoutes(t *testing.T) {
+	reason := "preloading static files"
+	notReady.Store(&reason)
+	defer notReady.Store(nil)
+	ok := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }
+	h := withReadiness(newTestTopHandler(map[string]http.HandlerFunc{
+		"/status": ok, "/health/deep": ok, "/metrics": ok, "/version": ok, "/_routes": ok, "/ping": ok,
+	}))
+
+	for _, path := range []string{"/status", "/health/deep", "/metrics", "/version", "/_routes"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s before ready: %d %q, want it exempt", path, rec.Code, rec.Body)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ping before ready: %d, want 503", rec.Code)
+	}
+}
+
+func TestNDJSONStreamsOneObjectPerLine(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleNDJSON(rec, httptest.NewRequest(http.MethodGet, "/ndjson?lines=25&flush=10", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" || !rec.Flushed {
+		t.Fatalf("Content-Type %q, flushed %t", ct, rec.Flushed)
+	}
+	dec := json.NewDecoder(rec.Body)
+	for i := 0; i < 25; i++ {
+		var item struct {
+			ID    int    `json:"id"`
+			Name  string `json:"name"`
+			Value int    `json:"value"`
+		}
+		if err := dec.Decode(&item); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if item.ID != i || item.Name != fmt.Sprintf("item-%d", i) || item.Value != i*100 {
+			t.Fatalf("line %d: %+v", i, item)
+		}
+	}
+	if dec.More() {
+		t.Error("more than 25 lines")
+	}
+}
+
+func TestSelfTestCoversEveryRoute(t *testing.T) {
+	prevStatic := staticFS
+	defer func() { staticFS = prevStatic }()
+	staticFS = fstest.MapFS{"b.txt": {Data: []byte("b")}, "a/index.html": {Data: []byte("a")}}
+	covered := make(map[string]bool)
+	for _, c := range selfTestCases("http://127.0.0.1:1", true) {
+		covered[c.route] = true
+		if c.route == "static" && (c.target != "/a/index.html" || c.check == nil) {
+			t.Errorf("static case requests %s, want the first file /a/index.html", c.target)
+		}
+	}
+	for _, ri := range newRouter(newLiteralRoutes()).routes() {
+		if !covered[ri.Template] {
+			t.Errorf("no self-test case for %s route %s", ri.Kind, ri.Template)
+		}
+	}
+}
+
+func TestSelfTestReportsFailingRoutes(t *testing.T) {
+	routes := map[string]http.HandlerFunc{
+		"/ping":        handlePing,
+		"/uppercase":   handleUppercase,
+		"/ndjson":      handleNDJSON,
+		"/countdown":   handleCountdown,
+		"/gzip-stream": handleGzipStream,
+		"/extra":       handlePing,
+		"/json": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		},
+	}
+	ts := httptest.NewServer(newTestTopHandler(routes))
+	defer ts.Close()
+
+	cases := selfTestCases(ts.URL, true)
+	listed := newRouter(anyMethod(routes)).routes()
+	if failures := runSelfTest(newSelfTestClient(false), ts.URL, listed, cases); failures != 1 {
+		t.Fatalf("expected only /json to fail, got %d failures", failures)
+	}
+
+	// Uncovered pattern and prefix routes get a GET with a routable target.
+	defer func(prev []patternRoute) { patternRoutes = prev }(patternRoutes)
+	patternRoutes = []patternRoute{newGeneratedPatternRoute(1)}
+	routes["/broken/"] = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, r.URL.Path, http.StatusInternalServerError)
+	}
+	ts2 := httptest.NewServer(newTestTopHandler(routes))
+	defer ts2.Close()
+	listed = newRouter(anyMethod(routes)).routes()
+	if failures := runSelfTest(newSelfTestClient(false), ts2.URL, listed, selfTestCases(ts2.URL, true)); failures != 2 {
+		t.Fatalf("expected /json and /broken/ to fail, got %d failures", failures)
+	}
+}
+
+func TestH2MaxStreamsRefusesExtraStreams(t *testing.T) {
+	prev := h2MaxStreams
+	h2MaxStreams = 2
+	defer func() { h2MaxStreams = prev }()
+
+	release := make(chan struct{})
+	defer close(release)
+	ts := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}), newH2Server()))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, http2.ClientPreface)
+	fr := http2.NewFramer(c, c)
+	fr.WriteSettings()
+	for acked := false; !acked; {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, ok := f.(*http2.SettingsFrame)
+		switch {
+		case ok && sf.IsAck():
+			acked = true
+		case ok:
+			if v, _ := sf.Value(http2.SettingMaxConcurrentStreams); v != 2 {
+				t.Fatalf("advertised %d concurrent streams, want 2", v)
+			}
+			fr.WriteSettingsAck()
+		}
+	}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, hf := range [][2]string{{":method", "GET"}, {":scheme", "http"}, {":authority", "x"}, {":path", "/"}} {
+		enc.WriteField(hpack.HeaderField{Name: hf[0], Value: hf[1]})
+	}
+	for _, id := range []uint32{1, 3, 5} {
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: block.Bytes(), EndStream: true, EndHeaders: true})
+	}
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The limit was acknowledged, so exceeding it is a protocol error
+		// rather than REFUSED_STREAM (RFC 9113 section 5.1.2).
+		if rst, ok := f.(*http2.RSTStreamFrame); ok {
+			if rst.StreamID != 5 || rst.ErrCode != http2.ErrCodeProtocol {
+				t.Fatalf("RST_STREAM %d %v, want stream 5 PROTOCOL_ERROR", rst.StreamID, rst.ErrCode)
+			}
+			return
+		}
+	}
+}
+
+func TestPartialWriteFlushDropsLateHeaders(t *testing.T) {
+	for _, flush := range []string{"1", "0"} {
+		ts := httptest.NewServer(http.HandlerFunc(handlePartialWriteFlush))
+		resp, err := ts.Client().Get(ts.URL + "/partial-write-flush?flush=" + flush)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		ts.Close()
+		if resp.Header.Get("X-Before-Write") != "sent" || resp.Header.Get("X-After-Write") != "" ||
+			resp.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("flush=%s: unexpected headers %v", flush, resp.Header)
+		}
+		if bytes.Count(body, []byte("\n")) != 2 {
+			t.Errorf("flush=%s: body %q, want both parts", flush, body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	lw := &lateHeaderWriter{ResponseWriter: rec}
+	lw.Header().Set("Content-Type", "text/plain") // or the recorder sniffs one in
+	lw.Header().Set("Trailer", "X-Sum")
+	lw.Write([]byte("x"))
+	lw.Header().Set("X-Sum", "1")
+	lw.Header().Set(http.TrailerPrefix+"X-Other", "2")
+	lw.Header().Set("X-Late", "3")
+	if got := lw.late(); !slices.Equal(got, []string{"X-Late"}) {
+		t.Fatalf("late headers %v, want [X-Late]", got)
+	}
+}
+
+func TestPartialWriteFlushWarnsOnce(t *testing.T) {
+	var logged bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(prevLogger)
+	lateHeadersWarnOnce = sync.Once{}
+
+	for range 3 {
+		handlePartialWriteFlush(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/partial-write-flush", nil))
+	}
+	if warns, debugs := strings.Count(logged.String(), "level=WARN"), strings.Count(logged.String(), "level=DEBUG"); warns != 1 || debugs != 2 {
+		t.Fatalf("got %d warnings and %d debug records, want 1 and 2:\n%s", warns, debugs, logged.String())
+	}
+}
+
+func TestMemoryPressureShedsExpensiveRoutes(t *testing.T) {
+	defer memDegraded.Store(false)
+	handler := withMemoryShedding(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	status := func(target string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+
+	// Hysteresis: on above high, off only below low.
+	for _, step := range []struct {
+		heap     uint64
+		degraded bool
+	}{{50, false}, {101, true}, {90, true}, {79, false}, {95, false}, {150, true}} {
+		updateMemDegraded(step.heap, 100, 80)
+		if memDegraded.Load() != step.degraded {
+			t.Fatalf("heap %d: degraded %t, want %t", step.heap, memDegraded.Load(), step.degraded)
+		}
+	}
+
+	for target, want := range map[string]int{
+		"/compute":           http.StatusServiceUnavailable,
+		"/upload":            http.StatusServiceUnavailable,
+		"/body?size=1048576": http.StatusServiceUnavailable,
+		"/body?size=100":     http.StatusOK,
+		"/ping":              http.StatusOK,
+		"/health/deep":       http.StatusOK,
+		"/readyz":            http.StatusOK,
+	} {
+		if got := status(target); got != want {
+			t.Errorf("%s while degraded: %d, want %d", target, got, want)
+		}
+	}
+	updateMemDegraded(0, 100, 80)
+	if got := status("/compute"); got != http.StatusOK {
+		t.Errorf("/compute after recovery: %d, want 200", got)
+	}
+}
+
+func TestReflectStatusFromBody(t *testing.T) {
+	post := func(spec string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleReflectStatus(rec, httptest.NewRequest(http.MethodPost, "/reflect-status-from-body", strings.NewReader(spec)))
+		return rec
+	}
+
+	rec := post(`{"status":418,"headers":{"X-Foo":"bar","content-type":"text/x-tea"},"body":"short and stout"}`)
+	if rec.Code != 418 || rec.Header().Get("X-Foo") != "bar" || rec.Header().Get("Content-Type") != "text/x-tea" ||
+		rec.Body.String() != "short and stout" {
+		t.Fatalf("unexpected response %d %v %q", rec.Code, rec.Header(), rec.Body)
+	}
+	if rec := post(`{}`); rec.Code != 200 || rec.Body.Len() != 0 {
+		t.Fatalf("empty spec: %d %q, want an empty 200", rec.Code, rec.Body)
+	}
+	for _, spec := range []string{
+		`not json`,
+		`{"status":99}`,
+		`{"status":600}`,
+		`{"status":204,"body":"x"}`,
+		`{"headers":{"X-Foo":"bar\r\nSet-Cookie: x=1"}}`,
+		`{"headers":{"Bad Name":"x"}}`,
+		`{"headers":{"content-length":"5"}}`,
+	} {
+		if rec := post(spec); rec.Code != http.StatusBadRequest || rec.Header().Get("Set-Cookie") != "" {
+			t.Errorf("%s: status %d, want 400", spec, rec.Code)
+		}
+	}
+}
+
+func TestResourceOptimisticConcurrency(t *testing.T) {
+	do := func(method, key, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/resource/"+key, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handleResource(rec, req)
+		return rec
+	}
+	key := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	if rec := do(http.MethodGet, key, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET of a missing key: %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, key, "v0", "If-Match", "*"); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match: * on a missing key: %d, want 412", rec.Code)
+	}
+	rec := do(http.MethodPut, key, "v1", "If-None-Match", "*", "Content-Type", "text/plain")
+	etag1 := rec.Header().Get("ETag")
+	if rec.Code != http.StatusCreated || etag1 == "" {
+		t.Fatalf("create: %d %q", rec.Code, etag1)
+	}
+	if rec := do(http.MethodPut, key, "again", "If-None-Match", "*"); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("create-only on an existing key: %d, want 412", rec.Code)
+	}
+	rec = do(http.MethodGet, key, "")
+	if rec.Code != 200 || rec.Body.String() != "v1" || rec.Header().Get("ETag") != etag1 ||
+		rec.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("GET: %d %q %v", rec.Code, rec.Body, rec.Header())
+	}
+	if rec := do(http.MethodGet, key, "", "If-None-Match", etag1); rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional GET: %d, want 304", rec.Code)
+	}
+
+	// Two writers holding etag1: exactly one wins.
+	codes := make(chan int, 2)
+	for _, v := range []string{"a", "b"} {
+		go func() { codes <- do(http.MethodPut, key, v, "If-Match", etag1).Code }()
+	}
+	got := []int{<-codes, <-codes}
+	slices.Sort(got)
+	if got[0] != http.StatusNoContent || got[1] != http.StatusPreconditionFailed {
+		t.Fatalf("concurrent If-Match writes: %v, want one 204 and one 412", got)
+	}
+
+	etag2 := do(http.MethodGet, key, "").Header().Get("ETag")
+	if rec := do(http.MethodDelete, key, "", "If-Match", etag1); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with a stale ETag: %d, want 412", rec.Code)
+	}
+	if rec := do(http.MethodDelete, key, "", "If-Match", etag2); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d, want 204", rec.Code)
+	}
+	if rec := do(http.MethodGet, key, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: %d", rec.Code)
+	}
+}
+
+func TestResourceKeyLimitHoldsUnderConcurrentCreates(t *testing.T) {
+	defer resourceCount.Store(resourceCount.Load())
+	resourceCount.Store(maxResourceKeys - 5)
+	prefix := fmt.Sprintf("limit-%d-", time.Now().UnixNano())
+	var created, full atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Go(func() {
+			rec := httptest.NewRecorder()
+			handleResource(rec, httptest.NewRequest(http.MethodPut, "/resource/"+prefix+strconv.Itoa(i), strings.NewReader("v")))
+			switch rec.Code {
+			case http.StatusCreated:
+				created.Add(1)
+			case http.StatusInsufficientStorage:
+				full.Add(1)
+			default:
+				t.Errorf("PUT: status %d", rec.Code)
+			}
+		})
+	}
+	wg.Wait()
+	for i := range 50 {
+		resourceStore.Delete(prefix + strconv.Itoa(i))
+	}
+	if created.Load() != 5 || full.Load() != 45 || resourceCount.Load() != maxResourceKeys {
+		t.Fatalf("created %d, refused %d, count %d; want 5, 45 and %d",
+			created.Load(), full.Load(), resourceCount.Load(), maxResourceKeys)
+	}
+
+	rec := httptest.NewRecorder()
+	handleResource(rec, httptest.NewRequest(http.MethodPut, "/resource/"+prefix+"broken", iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("failed body read: status %d, want 400", rec.Code)
+	}
+}
+func TestIPVersionSelectsListenerFamilies(t *testing.T) {
+	for _, tc := range []struct{ version, host, want string }{
+		{"4", "", "127.0.0.1"},
+		{"6", "", "::1"},
+		{"dual", "", "::"},
+		{"4", "0.0.0.0", "0.0.0.0"},
+		{"6", "::", "::"},
+		{"4", "::1", ""},
+		{"6", "127.0.0.1", ""},
+		{"6", "::ffff:127.0.0.1", ""},
+		{"dual", "::1", ""},
+		{"4", "localhost", ""},
+		{"5", "", ""},
+	} {
+		got, err := resolveListenHost(tc.version, tc.host)
+		if got != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("resolveListenHost(%s, %q) = %q, %v; want %q", tc.version, tc.host, got, err, tc.want)
+		}
+	}
+
+	prev := ipVersion
+	defer func() { ipVersion = prev }()
+	for _, tc := range []struct {
+		version, addr string
+		v4, v6        bool
+	}{
+		{"4", "127.0.0.1:0", true, false},
+		{"6", "[::1]:0", false, true},
+		{"dual", "[::]:0", true, true},
+	} {
+		ipVersion = tc.version
+		ln, err := listenTCP(tc.addr)
+		if err != nil {
+			t.Skipf("--ip-version %s: %v", tc.version, err)
+		}
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		for host, want := range map[string]bool{"127.0.0.1": tc.v4, "::1": tc.v6} {
+			c, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), time.Second)
+			if c != nil {
+				c.Close()
+			}
+			if (err == nil) != want {
+				t.Errorf("--ip-version %s: dialing %s: %v, want connected %t", tc.version, host, err, want)
+			}
+		}
+		ln.Close()
+	}
+}
+
+func TestTLSHandshakeDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(handlePing))
+	ts.TLS = &tls.Config{}
+	delayHandshakes(ts.TLS, delay)
+	ts.StartTLS()
+	defer ts.Close()
+
+	cfg := ts.Client().Transport.(*http.Transport).TLSClientConfig
+	dial := func(timeout time.Duration) (time.Duration, error) {
+		start := time.Now()
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", ts.Listener.Addr().String(), cfg)
+		if err == nil {
+			c.Close()
+		}
+		return time.Since(start), err
+	}
+	if took, err := dial(5 * time.Second); err != nil || took < delay {
+		t.Fatalf("handshake took %v (%v), want at least %v", took, err, delay)
+	}
+	if _, err := dial(delay / 4); err == nil {
+		t.Fatal("handshake finished within a dial timeout shorter than the delay")
+	}
+}
+
+func TestRoutesListsRegistrationTable(t *testing.T) {
+	prevRouter, prevPatterns, prevStatic := servingRouter, patternRoutes, staticFS
+	defer func() { servingRouter, patternRoutes, staticFS = prevRouter, prevPatterns, prevStatic }()
+	staticFS = nil
+	patternRoutes = []patternRoute{newGeneratedPatternRoute(0)}
+	routes := make(routeTable)
+	routes.handle("/ping", handlePing)
+	routes.handle("/upload", handleUpload, http.MethodPost, http.MethodPut)
+	routes.handle("/resource/", handleResource, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	routes.handle("/_routes", handleRoutes)
+	servingRouter = newRouter(routes)
+
+	// Served through the router it lists.
+	rec := httptest.NewRecorder()
+	newTopHandler(servingRouter).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_routes", nil))
+	var got []routeInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []routeInfo{
+		{"/_routes", "literal", []string{"*"}},
+		{"/ping", "literal", []string{"*"}},
+		{"/upload", "literal", []string{"POST", "PUT"}},
+		{"/users/:id/posts/:post", "pattern", []string{"*"}},
+		{"/api/v1/resources/:resource/items/:item/actions/:action", "pattern", []string{"*"}},
+		{"/p0/:param", "pattern", []string{"*"}},
+		{"/resource/", "prefix", []string{"GET", "HEAD", "PUT", "DELETE"}},
+		{"unmatched", "default", []string{"*"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("routes:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestPostOnlyRoutesSendAllow(t *testing.T) {
+	for path, h := range map[string]http.HandlerFunc{
+		"/body-codec": handleBodyCodec,
+		"/decompress": handleDecompress,
+		"/query":      handleQuery,
+	} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("GET %s: status %d, Allow %q, want 405 with Allow: POST", path, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestRegisteredMethodsMatchHandlers(t *testing.T) {
+	// Every route registered with methods must refuse the others, and its 405
+	// must list the same methods in Allow. /ws-ping answers 400: a WebSocket
+	// handshake is a GET by definition.
+	for path, lr := range newLiteralRoutes() {
+		if lr.methods == nil {
+			continue
+		}
+		target := path
+		if strings.HasSuffix(path, "/") {
+			target += "key"
+		}
+		rec := httptest.NewRecorder()
+		lr.handler(rec, httptest.NewRequest(http.MethodPatch, target, strings.NewReader("x")))
+		if rec.Code != http.StatusMethodNotAllowed {
+			if rec.Code < 400 || rec.Code >= 500 {
+				t.Errorf("PATCH %s: status %d, want 405", target, rec.Code)
+			}
+			continue
+		}
+		if allow := rec.Header().Get("Allow"); allow != strings.Join(lr.methods, ", ") {
+			t.Errorf("%s: Allow %q, registered %q", path, allow, lr.methods)
+		}
+	}
+}